@@ -1,93 +1,356 @@
 package main
 
 import (
+	"errors"
 	"os"
 	"path"
+	"reflect"
 	"sync"
 	"time"
 
 	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
-	"./cache"
 	"./common"
 	"./config"
 	"./fs"
+	"./fx"
+	"./logger"
+	"./merchant"
 	"./model"
+	"./store"
 )
 
 func main() {
-	println("Service starts")
-	configFile := "./config/service.json"
-	if len(os.Args) > 1 {
-		configFile = os.Args[1]
-	}
-	println(configFile)
+	logger.Info("Service starts")
 
 	// Load config
-	var config config.ServiceConfig
-	config.LoadConfig(configFile)
-
-	// Load files from source
-	epaDir := config.IO.EPADIR
-	txDir := config.IO.TxDIR
+	cfg, err := config.Load(os.Args[1:], os.Environ())
+	if err != nil {
+		logger.Error("Config error", logger.KeyError, err)
+		os.Exit(3)
+	}
+	if err = logger.Configure(cfg.Log.Level, cfg.Log.Format, cfg.Log.Output); err != nil {
+		logger.Error("Log config error", logger.KeyError, err)
+		os.Exit(3)
+	}
+	if len(cfg.Currency.MerchantCurrencyFile) > 0 {
+		logger.Warn("Currency.MerchantCurrencyFile is deprecated, use Reference.MerchantFile", logger.KeyFile, cfg.Currency.MerchantCurrencyFile)
+	}
 
 	// Init DB connection
-	session := initDB(config)
+	session := initDB(cfg)
 	defer session.Close()
-	cAcc := session.DB("db-data").C("account")
-	cAccDA := session.DB("db-da").C("account")
-	cSub := session.DB("db-data").C("submission")
-	cSubDA := session.DB("db-da").C("submission")
-	cTx := session.DB("db-data").C("transaction")
+	cols := newMongoCollections(session, cfg.Database)
+
+	p := newPipeline(cfg, cols)
+	watcher := config.NewWatcher(os.Args[1:], os.Environ)
+	for {
+		p.run()
+
+		// Next round, with the config reloaded if it changed
+		watcher.Wait(time.Duration(p.config.PollInterval) * time.Second)
+		if next, err := watcher.Reload(); err != nil {
+			logger.Error("Config reload failed, keeping the current config", logger.KeyError, err)
+		} else if next != nil {
+			p.reconfigure(*next)
+		}
+	}
+}
+
+// collections - stores of the pipeline
+type collections struct {
+	acc     store.Collection
+	accDA   store.Collection
+	sub     store.Collection
+	subDA   store.Collection
+	tx      store.Collection
+	stats   store.Collection
+	pending store.Collection
+}
+
+// newMongoCollections - collections of the configured databases
+func newMongoCollections(session *mgo.Session, db config.DatabaseType) (cols collections) {
+	data := session.DB(db.DataDB)
+	da := session.DB(db.DADB)
+	names := db.Collections
+	cols.acc = store.NewMongo(data.C(names.Account))
+	cols.accDA = store.NewMongo(da.C(names.Account))
+	cols.sub = store.NewMongo(data.C(names.Submission))
+	cols.subDA = store.NewMongo(da.C(names.Submission))
+	cols.tx = store.NewMongo(data.C(names.Transaction))
+	cols.stats = store.NewMongo(data.C(names.Enrichment))
+	cols.pending = store.NewMongo(data.C(names.Pending))
+	return
+}
+
+// pipeline - state kept between rounds of loading transactions and activity files
+type pipeline struct {
+	config config.ServiceConfig
+	cols   collections
+	// accVersions, subVersions - max version of each account and submission file, kept apart as both files of a pair share a name
+	accVersions map[uint32]uint32
+	subVersions map[uint32]uint32
+	mutexes     map[uint32]*sync.Mutex
+	// rejected - modtimes of activity files which failed to load, skipped until modified
+	rejected    map[string]time.Time
+	rejectMutex *sync.Mutex
+	txCache     *model.TxCache
+	txIndex     *model.TxIndex
+	txLoader    *model.TxLoader
+	types       *util.TypeRegistry
+	profiles    *util.ProfileRegistry
+	businessDay *util.BusinessDay
+	rates       *fx.RateTable
+	merchants   *merchant.Master
+	writes      store.WriteConfig
+	startTime   time.Time
+}
+
+func newPipeline(config config.ServiceConfig, cols collections) *pipeline {
+	var p pipeline
+	p.config = config
+	p.cols = cols
 
 	// Load cache from store
-	versions := getVersions(cAcc, config.Routines)
-	mutexes := make(map[uint32]*sync.Mutex)
-	for k := range versions {
-		mutexes[k] = &sync.Mutex{}
+	p.accVersions = getVersions(cols.acc, config.Routines)
+	p.subVersions = getVersions(cols.sub, config.Routines)
+	p.mutexes = make(map[uint32]*sync.Mutex)
+	for k := range p.accVersions {
+		p.mutexes[k] = &sync.Mutex{}
+	}
+	for k := range p.subVersions {
+		p.mutexes[k] = &sync.Mutex{}
 	}
+	p.rejected = make(map[string]time.Time)
+	p.rejectMutex = &sync.Mutex{}
 
-	startTime := time.Now()
-	cachedFiles := fs.LoadFilesByName(epaDir)
-	aac, sac := removeUnpairedFiles(cachedFiles)
-	cache := cache.New(util.LRUCacheSize)
-	for {
-		txErr := model.LoadTxFile(txDir, cTx)
-		var wg sync.WaitGroup
-		for i := 0; i < config.Routines; i++ {
-			wg.Add(1)
-			subBatch := model.NewSubmissionActivityBatch()
-			subBatch.Cache = &cache
-			var sacOp model.SubmissionActivityOperation
-			go process(sac, epaDir, i, config.Routines, subBatch, sacOp, versions, cSub, cSubDA, cTx, &wg, mutexes)
-		}
+	p.startTime = time.Now()
+	cacheBytes := config.Cache.MaxBytes
+	if cacheBytes == 0 {
+		cacheBytes = util.LRUCacheBytes
+	}
+	cacheShards := config.Cache.Shards
+	if cacheShards == 0 {
+		cacheShards = util.LRUCacheShards
+	}
+	p.txCache = model.NewTxCache(cacheShards, cacheBytes, time.Duration(config.Cache.TTLMinutes)*time.Minute)
+	p.types = util.NewTypeRegistry(config.TransactionTypes)
+	p.profiles = util.NewProfileRegistry(config.Providers)
+	businessDay, err := util.NewBusinessDay(config.BusinessDay.TimeZone, config.BusinessDay.Cutoff)
+	if err != nil {
+		logger.Warn("Invalid business day, using UTC days", logger.KeyError, err)
+	}
+	p.businessDay = businessDay
+	txSchema := model.NewTxSchema(config.TransactionFile.Header, config.TransactionFile.Columns, config.TransactionFile.SelfReference)
+	p.txIndex = model.NewTxIndex(config.Enrichment.IndexedLookupThreshold, config.Enrichment.BloomFilter, config.Enrichment.BloomFalsePositiveRate)
+	p.txLoader = model.NewTxLoader(p.types, txSchema, config.IO.RejectDIR)
+	p.txLoader.Listeners = []model.TxListener{p.txIndex, model.TxCacheInvalidator{Cache: p.txCache}}
+	if len(config.TransactionFile.UpdatePolicy) > 0 {
+		p.txLoader.UpdatePolicy = config.TransactionFile.UpdatePolicy
+	}
+	p.txLoader.BatchSize = config.TransactionFile.BatchSize
+	p.rates = fx.New(config.Currency.GroupCurrency)
+	p.merchants = merchant.New(config.Reference.MerchantFile, time.Duration(config.Reference.ReloadInterval)*time.Minute)
+	p.writes = writeConfig(config.Database.Writes, &store.WriteStats{})
+	return &p
+}
 
-		for i := 0; i < config.Routines; i++ {
-			wg.Add(1)
-			accBatch := model.NewAccountActivityBatch()
-			var aacOp model.AccountActivityOperation
-			go process(aac, epaDir, i, config.Routines, accBatch, aacOp, versions, cAcc, cAccDA, cTx, &wg, mutexes)
+// writeConfig - bulk write settings of the config
+func writeConfig(writes config.WritesType, stats *store.WriteStats) store.WriteConfig {
+	return store.WriteConfig{
+		BatchSize:     writes.BatchSize,
+		Retries:       writes.Retries,
+		RetryInterval: time.Duration(writes.RetryIntervalMs) * time.Millisecond,
+		Stats:         stats,
+	}
+}
+
+// reconfigure - apply a reloaded config between rounds
+//
+// Dirs, routines, the poll interval, reference data, provider profiles, the enrichment date window, diff and bulk write settings,
+// the transaction update policy and batch size and the log change in place, keeping the version table and caches. Changes of the
+// database, currency, cache, business day, transaction index and file schema need a restart and keep their current values.
+func (p *pipeline) reconfigure(next config.ServiceConfig) {
+	old := p.config
+
+	writes := next.Database.Writes
+	next.Database.Writes = old.Database.Writes
+	keepConfig("Database", &next.Database, old.Database)
+	next.Database.Writes = writes
+	// The deprecated merchant currency file is applied as the reference merchant file
+	next.Currency.MerchantCurrencyFile = old.Currency.MerchantCurrencyFile
+	keepConfig("Currency", &next.Currency, old.Currency)
+	keepConfig("Cache", &next.Cache, old.Cache)
+	keepConfig("BusinessDay", &next.BusinessDay, old.BusinessDay)
+	dateWindow := next.Enrichment.DateWindow
+	next.Enrichment.DateWindow = old.Enrichment.DateWindow
+	keepConfig("Enrichment", &next.Enrichment, old.Enrichment)
+	next.Enrichment.DateWindow = dateWindow
+	policy, txBatchSize := next.TransactionFile.UpdatePolicy, next.TransactionFile.BatchSize
+	next.TransactionFile.UpdatePolicy, next.TransactionFile.BatchSize = old.TransactionFile.UpdatePolicy, old.TransactionFile.BatchSize
+	keepConfig("TransactionFile", &next.TransactionFile, old.TransactionFile)
+	next.TransactionFile.UpdatePolicy, next.TransactionFile.BatchSize = policy, txBatchSize
+	keepConfig("TransactionTypes", &next.TransactionTypes, old.TransactionTypes)
+
+	if next.Reference != old.Reference {
+		p.merchants = merchant.New(next.Reference.MerchantFile, time.Duration(next.Reference.ReloadInterval)*time.Minute)
+	}
+	if !reflect.DeepEqual(next.Providers, old.Providers) {
+		p.profiles = util.NewProfileRegistry(next.Providers)
+	}
+	p.txLoader.RejectDir = next.IO.RejectDIR
+	if len(next.TransactionFile.UpdatePolicy) > 0 {
+		p.txLoader.UpdatePolicy = next.TransactionFile.UpdatePolicy
+	}
+	p.txLoader.BatchSize = next.TransactionFile.BatchSize
+	p.writes = writeConfig(next.Database.Writes, p.writes.Stats)
+	if next.Log != old.Log {
+		if e := logger.Configure(next.Log.Level, next.Log.Format, next.Log.Output); e != nil {
+			logger.Error("Failed to apply the log config, keeping the current value", logger.KeyError, e)
+			next.Log = old.Log
 		}
+	}
+	p.config = next
+	logger.Info("Config reloaded", "routines", next.Routines, "pollinterval", next.PollInterval)
+}
 
-		// Wait till all goroutines are done
-		wg.Wait()
+// keepConfig - keep the current value of a config section which needs a restart to change
+func keepConfig[T any](name string, next *T, current T) {
+	if !reflect.DeepEqual(*next, current) {
+		logger.Warn("Config change requires a restart, keeping the current value", "section", name)
+		*next = current
+	}
+}
+
+// run - load reference data and transactions, then process the paired activity files of the EPA dir
+func (p *pipeline) run() {
+	config := p.config
+	epaDir := config.IO.EPADIR
+	txDir := config.IO.TxDIR
+	cachedFiles := p.skipRejected(fs.LoadFilesByName(epaDir))
+	aac, sac := removeUnpairedFiles(cachedFiles, p.aacOnly)
 
-		fs.DeleteFiles(epaDir, aac)
-		fs.DeleteFiles(epaDir, sac)
+	if reloaded, e := p.merchants.Reload(); e != nil {
+		logger.Error("Failed to reload merchant master", logger.KeyError, e)
+	} else if reloaded {
+		logger.Info("Loaded merchants", logger.KeyCount, p.merchants.Count())
+	}
+	p.rates.LoadRateFiles(config.IO.FxDIR)
+	txSummary, txErr := p.txLoader.LoadTxFile(txDir, p.cols.tx)
+	if txSummary.Inserted > 0 || txSummary.Updated > 0 {
+		reenriched := model.ReenrichPending(*config.Enrichment.DateWindow, p.businessDay, p.profiles, p.types, p.cols.pending, p.cols.sub, p.cols.subDA, p.cols.tx, p.writes)
+		logger.Info("Re-enriched pending submissions", logger.KeyCount, reenriched)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < config.Routines; i++ {
+		wg.Add(1)
+		subBatch := model.NewSubmissionActivityBatch()
+		subBatch.Cache = p.txCache
+		subBatch.Rates = p.rates
+		subBatch.Merchants = p.merchants
+		subBatch.Types = p.types
+		subBatch.DateWindow = *config.Enrichment.DateWindow
+		subBatch.BusinessDay = p.businessDay
+		subBatch.Index = p.txIndex
+		subBatch.StreamThreshold = config.Diff.StreamThreshold
+		subBatch.Writes = p.writes
+		subBatch.Profiles = p.profiles
+		var sacOp model.SubmissionActivityOperation
+		go process(sac, epaDir, i, config.Routines, subBatch, sacOp, p.subVersions, p.cols.sub, p.cols.subDA, p.cols.tx, p.cols.stats, p.cols.pending, &wg, p.mutexes, p.rejectFile)
+	}
+
+	for i := 0; i < config.Routines; i++ {
+		wg.Add(1)
+		accBatch := model.NewAccountActivityBatch()
+		accBatch.Rates = p.rates
+		accBatch.BusinessDay = p.businessDay
+		accBatch.Merchants = p.merchants
+		accBatch.StreamThreshold = config.Diff.StreamThreshold
+		accBatch.Writes = p.writes
+		accBatch.Profiles = p.profiles
+		var aacOp model.AccountActivityOperation
+		go process(aac, epaDir, i, config.Routines, accBatch, aacOp, p.accVersions, p.cols.acc, p.cols.accDA, p.cols.tx, p.cols.stats, p.cols.pending, &wg, p.mutexes, p.rejectFile)
+	}
 
-		if len(cachedFiles) > 0 || txErr == nil {
-			println("Elapsed time:", time.Since(startTime).Seconds())
+	// Wait till all goroutines are done
+	wg.Wait()
+
+	// Rejected files are kept or were moved to the reject dir
+	fs.DeleteFiles(epaDir, p.withoutRejected(aac))
+	fs.DeleteFiles(epaDir, p.withoutRejected(sac))
+
+	if len(cachedFiles) > 0 || txErr == nil {
+		logger.Info("Transactions", txSummary.Fields()...)
+		stats := p.txCache.Stats()
+		logger.Info("Tx cache", "entries", stats.Entries, "bytes", stats.Cost, "hits", stats.Hits, "misses", stats.Misses, "evictions", stats.Evictions, "expirations", stats.Expirations)
+		writes := p.writes.Stats.Snapshot()
+		logger.Info("Written documents", logger.KeyCount, writes.Docs, "batches", writes.Batches, "retries", writes.Retries, "failures", writes.Failures, "docspersecond", int64(writes.DocsPerSecond()))
+		logger.Info("Elapsed time", "seconds", time.Since(p.startTime).Seconds())
+	}
+	for k, count := range p.types.Unknown() {
+		logger.Warn("Unknown transaction type", "type", k, logger.KeyCount, count)
+	}
+}
+
+// rejectFile - move an activity file which cannot be loaded to the reject dir, or keep it but skip it until it is modified
+func (p *pipeline) rejectFile(dir string, file os.FileInfo, reason error) {
+	p.rejectMutex.Lock()
+	p.rejected[file.Name()] = file.ModTime()
+	p.rejectMutex.Unlock()
+	if rejectDir := p.config.IO.RejectDIR; len(rejectDir) > 0 {
+		e := fs.MoveFile(path.Join(dir, file.Name()), rejectDir)
+		if e == nil {
+			logger.Error("Rejected activity file", logger.KeyFile, file.Name(), "dir", rejectDir, logger.KeyError, reason)
+			return
 		}
+		logger.Error("Failed to move activity file to the reject dir", logger.KeyFile, file.Name(), logger.KeyError, e)
+	}
+	logger.Error("Rejected activity file, skipped until modified", logger.KeyFile, file.Name(), logger.KeyError, reason)
+}
 
-		// Next round
-		time.Sleep(5 * time.Second)
-		cachedFiles = fs.LoadFilesByName(epaDir)
-		aac, sac = removeUnpairedFiles(cachedFiles)
+// skipRejected - the listed files without the rejected ones which are unchanged, forgetting the rejected files
+// which were modified, moved or removed since
+func (p *pipeline) skipRejected(files []os.FileInfo) []os.FileInfo {
+	p.rejectMutex.Lock()
+	listed := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		listed[file.Name()] = file.ModTime()
 	}
+	for name, modTime := range p.rejected {
+		if t, ok := listed[name]; !ok || !t.Equal(modTime) {
+			delete(p.rejected, name)
+		}
+	}
+	p.rejectMutex.Unlock()
+	return p.withoutRejected(files)
+}
+
+// withoutRejected - the files which have not been rejected
+func (p *pipeline) withoutRejected(files []os.FileInfo) (kept []os.FileInfo) {
+	p.rejectMutex.Lock()
+	defer p.rejectMutex.Unlock()
+	for _, file := range files {
+		if t, ok := p.rejected[file.Name()]; !ok || !t.Equal(file.ModTime()) {
+			kept = append(kept, file)
+		}
+	}
+	return
+}
+
+// aacOnly - the profile of the provider of an aac file allows it without a sac file
+func (p *pipeline) aacOnly(file os.FileInfo) bool {
+	provider, e := model.PeekProvider(path.Join(p.config.IO.EPADIR, file.Name()))
+	if e != nil {
+		logger.Error("Failed to read provider", logger.KeyFile, file.Name(), logger.KeyError, e)
+		return false
+	}
+	return p.profiles.Get(provider).Pairing == util.PairingAACOnly
 }
 
-func removeUnpairedFiles(files []os.FileInfo) (aac []os.FileInfo, sac []os.FileInfo) {
+// removeUnpairedFiles - the aac and sac files of batches with both files, and the aac files without a sac file
+// accepted by aacOnly, e.g. of providers whose profile allows them
+func removeUnpairedFiles(files []os.FileInfo, aacOnly func(file os.FileInfo) bool) (aac []os.FileInfo, sac []os.FileInfo) {
 	counts := make(map[string]int16)
 	for _, file := range files {
 		name := file.Name()
@@ -105,8 +368,8 @@ func removeUnpairedFiles(files []os.FileInfo) (aac []os.FileInfo, sac []os.FileI
 
 		if v, ok := counts[key]; ok {
 			ext := name[len(name)-4:]
-			// It is legal to have aac without sac, but need to revise later. For now, it requires manual intervention
-			if v == 2 /*|| ext == ".aac" && file.Size() < 10000*/ {
+			// It is legal to have aac without sac for some providers, the others require manual intervention
+			if v == 2 || ext == ".aac" && aacOnly(file) {
 				if ext == ".aac" {
 					aac = append(aac, file)
 				}
@@ -125,18 +388,30 @@ func initDB(config config.ServiceConfig) *mgo.Session {
 	if err != nil {
 		panic(err)
 	}
-	// Optional. Switch the session to a monotonic behavior.
-	session.SetMode(mgo.Monotonic, true)
+	mode, err := sessionMode(config.Database.Mode)
+	if err != nil {
+		panic(err)
+	}
+	session.SetMode(mode, true)
 	return session
 }
 
+// sessionMode - the session mode of a configured name, case insensitive
+func sessionMode(name string) (mgo.Mode, error) {
+	mode, ok := config.DBMode(name)
+	if !ok {
+		return 0, errors.New("unknown database mode " + name)
+	}
+	return mode, nil
+}
+
 // VersionTable - max version mapping table
 type VersionTable struct {
 	Keys    map[string]string `bson:"_id"`
 	Version uint32
 }
 
-func getVersions(col *mgo.Collection, routines int) (versions map[uint32]uint32) {
+func getVersions(col store.Collection, routines int) (versions map[uint32]uint32) {
 	versions = make(map[uint32]uint32)
 	stageGroup := bson.M{"$group": bson.M{"_id": bson.M{"batchname": "$batchname", "provider": "$adviceprovider"}, "version": bson.M{"$max": "$versionnumber"}}}
 	pipe := col.Pipe([]bson.M{stageGroup})
@@ -153,19 +428,25 @@ func getKeyHashCode(filename string, provider string) uint32 {
 	return util.Hash(filename + "|" + provider)
 }
 
-func process(files []os.FileInfo, dir string, shard int, routines int, batch model.IActivityBatch, op model.IActivityOperation, versions map[uint32]uint32, cData *mgo.Collection, cDA *mgo.Collection, cTx *mgo.Collection, wg *sync.WaitGroup, mutexes map[uint32]*sync.Mutex) {
+func process(files []os.FileInfo, dir string, shard int, routines int, batch model.IActivityBatch, op model.IActivityOperation, versions map[uint32]uint32, cData store.Collection, cDA store.Collection, cTx store.Collection, cStats store.Collection, cPending store.Collection, wg *sync.WaitGroup, mutexes map[uint32]*sync.Mutex, reject func(dir string, file os.FileInfo, e error)) {
 	for i := 0; i < len(files); i++ {
 		file := files[i]
 		hash := int(util.Hash(file.Name()))
 		if hash%routines == shard {
 			batch.Clear()
-			println("Shard", shard, "is loading", file.Name(), file.ModTime().String())
-			count := batch.LoadDataFile(path.Join(dir, file.Name()))
-			println("Shard", shard, "has loaded from file:[", file.Name(), "] count:", count)
+			log := logger.With(logger.KeyShard, shard, logger.KeyFile, file.Name())
+			log.Info("Loading file", "modtime", file.ModTime())
+			count, e := batch.LoadDataFile(path.Join(dir, file.Name()))
+			if e != nil {
+				reject(dir, file, e)
+				continue
+			}
+			log.Info("Loaded file", logger.KeyCount, count)
 
 			// If there is any record
 			if count > 0 {
 				batchname, provider, version := batch.GetKeys()
+				log = log.With(logger.KeyBatchName, batchname, logger.KeyProvider, provider, logger.KeyVersion, version)
 
 				// Load existing records
 				h := getKeyHashCode(batchname, provider)
@@ -182,21 +463,23 @@ func process(files []os.FileInfo, dir string, shard int, routines int, batch mod
 
 					// Add the current version to data db
 					batch.InsertToStore(cData)
+					batch.TrackEnrichment(cStats, cPending)
 
 					// Load last version, compare and add new DA activities, and remove updates/deletes from remaining batch
 					batch.GetAndCompareLastBatch(batchname, provider, version, lastVer, cData, cDA)
 
 					// Put remaining new records to DA
 					batch.InsertToStore(cDA)
-					println("Shard", shard, "has compared and updated from file:[", file.Name(), "] count:", count)
+					log.Info("Compared and updated", logger.KeyCount, count, "lastversion", lastVer)
 				} else if !ok {
 					// Load Additional properties from tx
 					batch.LoadAdditionalProperties(cTx)
 
 					// If new file, write to both data and DA stores
 					batch.InsertToStore(cData)
+					batch.TrackEnrichment(cStats, cPending)
 					batch.InsertToStore(cDA)
-					println("Shard", shard, "has inserted new from file:[", file.Name(), "] count:", count)
+					log.Info("Inserted new", logger.KeyCount, count)
 				}
 
 				// Update the cached max version table for the shard
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"./config"
+	"./store"
+)
+
+// fileInfo - stub of a listed file
+type fileInfo string
+
+func (f fileInfo) Name() string       { return string(f) }
+func (f fileInfo) Size() int64        { return 0 }
+func (f fileInfo) Mode() os.FileMode  { return 0 }
+func (f fileInfo) ModTime() time.Time { return time.Time{} }
+func (f fileInfo) IsDir() bool        { return false }
+func (f fileInfo) Sys() interface{}   { return nil }
+
+func TestRemoveUnpairedFiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		aac   []string
+		sac   []string
+	}{
+		{"paired", []string{"1.aac", "1.sac", "2.sac", "2.aac"}, []string{"1.aac", "2.aac"}, []string{"1.sac", "2.sac"}},
+		{"aac without sac", []string{"1.aac", "2.aac", "2.sac"}, []string{"2.aac"}, []string{"2.sac"}},
+		{"sac without aac", []string{"1.sac", "2.aac", "2.sac"}, []string{"2.aac"}, []string{"2.sac"}},
+		{"nothing paired", []string{"1.aac", "2.sac"}, nil, nil},
+		{"aac only provider", []string{"9.aac", "2.aac", "2.sac"}, []string{"9.aac", "2.aac"}, []string{"2.sac"}},
+		{"empty", nil, nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var files []os.FileInfo
+			for _, name := range test.files {
+				files = append(files, fileInfo(name))
+			}
+			// 9.aac is of a provider allowing aac files without sac
+			aac, sac := removeUnpairedFiles(files, func(file os.FileInfo) bool { return file.Name() == "9.aac" })
+			if !sameNames(aac, test.aac) || !sameNames(sac, test.sac) {
+				t.Errorf("got %v %v, want %v %v", aac, sac, test.aac, test.sac)
+			}
+		})
+	}
+}
+
+func sameNames(files []os.FileInfo, names []string) bool {
+	if len(files) != len(names) {
+		return false
+	}
+	for i := range files {
+		if files[i].Name() != names[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSessionMode(t *testing.T) {
+	tests := []struct {
+		name string
+		mode mgo.Mode
+		ok   bool
+	}{
+		{"Monotonic", mgo.Monotonic, true},
+		{"strong", mgo.Strong, true},
+		{"SecondaryPreferred", mgo.SecondaryPreferred, true},
+		{"Fastest", 0, false},
+		{"", 0, false},
+	}
+	for _, test := range tests {
+		mode, err := sessionMode(test.name)
+		if mode != test.mode || (err == nil) != test.ok {
+			t.Errorf("%q: got %v, %v", test.name, mode, err)
+		}
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	var cfg config.ServiceConfig
+	cfg.ApplyDefaults()
+	cfg.Routines = 2
+	p := newPipeline(cfg, newMemoryCollections())
+	cache, merchants, stats := p.txCache, p.merchants, p.writes.Stats
+
+	next := cfg
+	next.Routines = 4
+	next.IO.RejectDIR = "rejected"
+	window := uint32(3)
+	next.Enrichment.DateWindow = &window
+	next.Database.Writes.BatchSize = 10
+	next.Database.DataDB = "other"
+	next.Cache.Shards = 64
+	next.Reference.MerchantFile = "merchants.csv"
+	p.reconfigure(next)
+
+	if p.config.Routines != 4 || *p.config.Enrichment.DateWindow != 3 || p.txLoader.RejectDir != "rejected" || p.writes.BatchSize != 10 {
+		t.Errorf("safe changes not applied: %+v", p.config)
+	}
+	if p.config.Database.DataDB != cfg.Database.DataDB || p.config.Cache.Shards != cfg.Cache.Shards || p.txCache != cache {
+		t.Errorf("changes needing a restart applied: %+v", p.config)
+	}
+	if p.merchants == merchants || p.writes.Stats != stats {
+		t.Error("merchant master not replaced or write stats not kept")
+	}
+}
+
+func TestPairVersionsKeptApart(t *testing.T) {
+	// Both files of a pair share a name, so with one version table the second file of a round was skipped
+	for i := 0; i < 5; i++ {
+		cols := newMemoryCollections()
+		runScenario(t, filepath.Join("testdata", "golden", "versions"), cols)
+		for name, col := range map[string]store.Collection{"account": cols.acc, "submission": cols.sub} {
+			for _, version := range []uint32{1, 2} {
+				if n, _ := col.Find(bson.M{"versionnumber": version}).Count(); n == 0 {
+					t.Fatalf("run %d: no %s records of version %d", i, name, version)
+				}
+			}
+		}
+	}
+
+	// After a restart the version of each file is read from its own store
+	cols := newMemoryCollections()
+	cols.sub.Insert(bson.M{"batchname": "1001", "adviceprovider": "Paypal", "versionnumber": 2})
+	var cfg config.ServiceConfig
+	cfg.Routines = 1
+	cfg.ApplyDefaults()
+	p := newPipeline(cfg, cols)
+	if h := getKeyHashCode("1001", "Paypal"); p.subVersions[h] != 2 || len(p.accVersions) != 0 {
+		t.Errorf("got account versions %v and submission versions %v", p.accVersions, p.subVersions)
+	}
+}
+
+func TestRejectedFileNotReversed(t *testing.T) {
+	versions := filepath.Join("testdata", "golden", "versions")
+	fixed, err := os.ReadFile(filepath.Join(versions, "2", "epa", "1001.sac"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The line of MRN2 cannot be decoded, skipping it would reverse MRN2
+	broken := bytes.Replace(fixed, []byte(`"Amount":35`), []byte(`"Amount":`), 1)
+
+	for name, rejectDir := range map[string]string{"moved": "rejected", "kept": ""} {
+		t.Run(name, func(t *testing.T) {
+			work := t.TempDir()
+			var cfg config.ServiceConfig
+			cfg.Routines = 1
+			cfg.IO.EPADIR = filepath.Join(work, "epa")
+			cfg.IO.TxDIR = filepath.Join(work, "tx")
+			if len(rejectDir) > 0 {
+				cfg.IO.RejectDIR = filepath.Join(work, rejectDir)
+			}
+			cfg.ApplyDefaults()
+			cols := newMemoryCollections()
+			p := newPipeline(cfg, cols)
+			copyDir(t, filepath.Join(versions, "1", "epa"), cfg.IO.EPADIR)
+			p.run()
+			before, _ := cols.subDA.Find(nil).Count()
+
+			copyDir(t, filepath.Join(versions, "2", "epa"), cfg.IO.EPADIR)
+			sac := filepath.Join(cfg.IO.EPADIR, "1001.sac")
+			os.WriteFile(sac, broken, 0644)
+			p.run()
+			p.run()
+			if after, _ := cols.subDA.Find(nil).Count(); after != before {
+				t.Errorf("got %d submission DA after the rejected file, want %d", after, before)
+			}
+			if n, _ := cols.sub.Find(bson.M{"versionnumber": 2}).Count(); n != 0 {
+				t.Errorf("loaded %d records of the rejected file", n)
+			}
+			if n, _ := cols.acc.Find(bson.M{"versionnumber": 2}).Count(); n == 0 {
+				t.Error("account file of the pair not loaded")
+			}
+
+			if len(rejectDir) > 0 {
+				if _, err := os.Stat(filepath.Join(cfg.IO.RejectDIR, "1001.sac")); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := os.Stat(sac); !os.IsNotExist(err) {
+					t.Fatalf("rejected file kept in the EPA dir: %v", err)
+				}
+				return
+			}
+			// Kept until fixed, then loaded with its pair
+			if _, err := os.Stat(sac); err != nil {
+				t.Fatal(err)
+			}
+			copyDir(t, filepath.Join(versions, "2", "epa"), cfg.IO.EPADIR)
+			later := time.Now().Add(time.Minute)
+			os.Chtimes(sac, later, later)
+			p.run()
+			if n, _ := cols.sub.Find(bson.M{"versionnumber": 2}).Count(); n != 3 {
+				t.Errorf("got %d records of the fixed file, want 3", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package bloom
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// Filter - bloom filter over string keys
+type Filter struct {
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+// New - create a filter sized for n keys with the false positive rate
+func New(n int, fpRate float64) *Filter {
+	if n < 1 {
+		n = 1
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = 0.01
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	var filter Filter
+	filter.bits = make([]uint64, (m+63)/64)
+	filter.m = m
+	filter.k = k
+	return &filter
+}
+
+// Add - add a key
+func (filter *Filter) Add(key string) {
+	h1, h2 := hashes(key)
+	for i := uint64(0); i < filter.k; i++ {
+		bit := (h1 + i*h2) % filter.m
+		filter.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// Test - false if the key has never been added, true if it may have been
+func (filter *Filter) Test(key string) bool {
+	h1, h2 := hashes(key)
+	for i := uint64(0); i < filter.k; i++ {
+		bit := (h1 + i*h2) % filter.m
+		if filter.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Size - memory used by the filter in bytes
+func (filter *Filter) Size() int {
+	return len(filter.bits) * 8
+}
+
+// hashes - two independent hashes for double hashing
+func hashes(key string) (h1 uint64, h2 uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h1 = h.Sum64()
+	h = fnv.New64()
+	h.Write([]byte(key))
+	h2 = h.Sum64() | 1
+	return
+}
@@ -0,0 +1,49 @@
+package bloom
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestNoFalseNegatives(t *testing.T) {
+	for _, n := range []int{0, 1, 100, 10000} {
+		filter := New(n, 0.01)
+		for i := 0; i < n; i++ {
+			filter.Add("MRN" + strconv.Itoa(i) + "-Charge")
+		}
+		for i := 0; i < n; i++ {
+			if key := "MRN" + strconv.Itoa(i) + "-Charge"; !filter.Test(key) {
+				t.Fatalf("n %d: added key %s not found", n, key)
+			}
+		}
+	}
+}
+
+func TestFalsePositiveRate(t *testing.T) {
+	const n = 10000
+	for _, fpRate := range []float64{0.01, 0.001} {
+		filter := New(n, fpRate)
+		for i := 0; i < n; i++ {
+			filter.Add("MRN" + strconv.Itoa(i))
+		}
+		positives := 0
+		for i := n; i < 11*n; i++ {
+			if filter.Test("MRN" + strconv.Itoa(i)) {
+				positives++
+			}
+		}
+		if rate := float64(positives) / (10 * n); rate > 2*fpRate {
+			t.Errorf("got false positive rate %v, want about %v", rate, fpRate)
+		}
+	}
+}
+
+func TestNewDefaults(t *testing.T) {
+	// Invalid rates fall back to 1%, sized for at least one key
+	if a, b := New(0, 0), New(1, 0.01); a.m != b.m || a.k != b.k {
+		t.Errorf("got m %d k %d, want m %d k %d", a.m, a.k, b.m, b.k)
+	}
+	if filter := New(1000, 0.01); filter.Size() != len(filter.bits)*8 || filter.m > uint64(filter.Size())*8 {
+		t.Errorf("got size %d for %d bits", filter.Size(), filter.m)
+	}
+}
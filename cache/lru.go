@@ -2,68 +2,241 @@ package cache
 
 import (
 	"container/list"
+	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// LRUCache - least recent used cache
-type LRUCache struct {
-	items *list.List
-	table map[uint32]*list.Element
-	cap   int
-	mutex *sync.RWMutex
+// ErrLoadPanicked - returned to callers waiting for a load of the same key which panicked
+var ErrLoadPanicked = errors.New("cache load panicked")
+
+// LRUCache - least recent used cache bounded by the total cost of its entries
+type LRUCache[K comparable, V any] struct {
+	items    *list.List
+	table    map[K]*list.Element
+	capacity int64
+	cost     int64
+	ttl      time.Duration
+	stats    Stats
+	inflight map[K]*call[V]
+	mutex    *sync.Mutex
+	// budget - cost and recency shared with the other shards of a ShardedCache, nil if not sharded
+	budget *budget
+}
+
+// budget - total cost of the shards of a ShardedCache, and the clock of the recency of their entries
+type budget struct {
+	capacity int64
+	cost     atomic.Int64
+	clock    atomic.Uint64
+}
+
+// call - in-flight load of a key
+type call[V any] struct {
+	done        chan struct{}
+	value       V
+	err         error
+	invalidated bool
+}
+
+// Stats - cache metrics
+type Stats struct {
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64
+	Expirations uint64
+	Entries     int
+	Cost        int64
 }
 
-// KVP - key value pair
-type KVP struct {
-	key   uint32
-	value interface{}
+// entry - cached key value pair
+type entry[K comparable, V any] struct {
+	key     K
+	value   V
+	cost    int64
+	expires time.Time
+	// used - clock of the budget when the entry was last put or read, to find the least recent entry of all shards
+	used uint64
 }
 
-// New - Create a new LRU cache
-func New(capacity int) LRUCache {
-	var cache LRUCache
+// New - Create a new LRU cache with the capacity in cost units (e.g. bytes), entries expire after ttl unless it is 0
+func New[K comparable, V any](capacity int64, ttl time.Duration) *LRUCache[K, V] {
+	var cache LRUCache[K, V]
 	cache.items = list.New()
-	cache.table = make(map[uint32]*list.Element)
-	cache.cap = capacity
-	cache.mutex = &sync.RWMutex{}
-	return cache
+	cache.table = make(map[K]*list.Element)
+	cache.inflight = make(map[K]*call[V])
+	cache.capacity = capacity
+	cache.ttl = ttl
+	cache.mutex = &sync.Mutex{}
+	return &cache
 }
 
 // Get - get a value from the cache
-func (cache *LRUCache) Get(key uint32) (result interface{}, ok bool) {
-	cache.mutex.RLock()
-	defer cache.mutex.RUnlock()
-	if el, ok := cache.table[key]; ok {
-		v := el.Value.(KVP).value
-		if el != cache.items.Back() {
-			cache.items.Remove(el)
-			el2 := cache.items.PushBack(KVP{key: key, value: v})
-			cache.table[key] = el2
+func (cache *LRUCache[K, V]) Get(key K) (result V, ok bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.get(key)
+}
+
+// GetOrLoad - get a value from the cache, or load and cache it; concurrent misses of a key share one load
+func (cache *LRUCache[K, V]) GetOrLoad(key K, load func() (V, int64, error)) (V, error) {
+	cache.mutex.Lock()
+	if value, ok := cache.get(key); ok {
+		cache.mutex.Unlock()
+		return value, nil
+	}
+	if c, ok := cache.inflight[key]; ok {
+		cache.mutex.Unlock()
+		<-c.done
+		return c.value, c.err
+	}
+	c := &call[V]{done: make(chan struct{})}
+	cache.inflight[key] = c
+	cache.mutex.Unlock()
+
+	var cost int64
+	loaded := false
+	defer func() {
+		cache.mutex.Lock()
+		delete(cache.inflight, key)
+		if !loaded {
+			// The load panicked, the panic goes on in this caller and the waiters get an error
+			c.err = ErrLoadPanicked
+		} else if c.err == nil && !c.invalidated {
+			// A value invalidated while loading may be stale, so it is returned but not cached
+			cache.put(key, c.value, cost)
 		}
-		result = el.Value.(KVP).value
-		ok = true
-	} else {
+		cache.mutex.Unlock()
+		close(c.done)
+	}()
+	c.value, cost, c.err = load()
+	loaded = true
+	return c.value, c.err
+}
+
+func (cache *LRUCache[K, V]) get(key K) (result V, ok bool) {
+	el, ok := cache.table[key]
+	if !ok {
+		cache.stats.Misses++
+		return
+	}
+	e := el.Value.(*entry[K, V])
+	if cache.ttl > 0 && time.Now().After(e.expires) {
+		cache.remove(el)
+		cache.stats.Expirations++
+		cache.stats.Misses++
 		ok = false
+		return
 	}
+	cache.items.MoveToBack(el)
+	e.used = cache.tick()
+	cache.stats.Hits++
+	result = e.value
 	return
 }
 
-// Put - ppsert a value in the cache
-func (cache *LRUCache) Put(key uint32, value interface{}) {
+// Put - upsert a value with its cost in the cache, values costing more than the capacity are not cached
+func (cache *LRUCache[K, V]) Put(key K, value V, cost int64) {
 	cache.mutex.Lock()
 	defer cache.mutex.Unlock()
+	cache.put(key, value, cost)
+}
+
+func (cache *LRUCache[K, V]) put(key K, value V, cost int64) {
 	if el, ok := cache.table[key]; ok {
-		cache.items.Remove(el)
-		el2 := cache.items.PushBack(KVP{key: key, value: value})
-		cache.table[key] = el2
-	} else if cache.items.Len() <= cache.cap {
-		if cache.items.Len() == cache.cap {
-			first := cache.items.Front()
-			kvp := first.Value.(KVP)
-			delete(cache.table, kvp.key)
-			cache.items.Remove(first)
-		}
-		el2 := cache.items.PushBack(KVP{key: key, value: value})
-		cache.table[key] = el2
+		cache.remove(el)
+	}
+	if cost > cache.capacity {
+		return
+	}
+	// Evict least recent used entries until the value fits
+	for cache.cost+cost > cache.capacity {
+		cache.remove(cache.items.Front())
+		cache.stats.Evictions++
+	}
+	e := &entry[K, V]{key: key, value: value, cost: cost, used: cache.tick()}
+	if cache.ttl > 0 {
+		e.expires = time.Now().Add(cache.ttl)
+	}
+	cache.table[key] = cache.items.PushBack(e)
+	cache.addCost(cost)
+}
+
+// tick - the next clock of the budget, 0 if not sharded
+func (cache *LRUCache[K, V]) tick() uint64 {
+	if cache.budget == nil {
+		return 0
+	}
+	return cache.budget.clock.Add(1)
+}
+
+// addCost - add to the cost of the cache and its budget
+func (cache *LRUCache[K, V]) addCost(cost int64) {
+	cache.cost += cost
+	if cache.budget != nil {
+		cache.budget.cost.Add(cost)
+	}
+}
+
+// oldest - when the least recent entry was used, false if the cache is empty
+func (cache *LRUCache[K, V]) oldest() (uint64, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.items.Len() == 0 {
+		return 0, false
+	}
+	return cache.items.Front().Value.(*entry[K, V]).used, true
+}
+
+// evictOldest - evict the least recent entry, false if the cache is empty
+func (cache *LRUCache[K, V]) evictOldest() bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.items.Len() == 0 {
+		return false
+	}
+	cache.remove(cache.items.Front())
+	cache.stats.Evictions++
+	return true
+}
+
+// Invalidate - remove a key from the cache
+func (cache *LRUCache[K, V]) Invalidate(key K) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if c, ok := cache.inflight[key]; ok {
+		c.invalidated = true
+	}
+	if el, ok := cache.table[key]; ok {
+		cache.remove(el)
+	}
+}
+
+// Purge - remove all entries
+func (cache *LRUCache[K, V]) Purge() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for _, c := range cache.inflight {
+		c.invalidated = true
 	}
+	cache.items.Init()
+	cache.table = make(map[K]*list.Element)
+	cache.addCost(-cache.cost)
+}
+
+// Stats - get a snapshot of the cache metrics
+func (cache *LRUCache[K, V]) Stats() (stats Stats) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	stats = cache.stats
+	stats.Entries = cache.items.Len()
+	stats.Cost = cache.cost
+	return
+}
+
+func (cache *LRUCache[K, V]) remove(el *list.Element) {
+	e := cache.items.Remove(el).(*entry[K, V])
+	delete(cache.table, e.key)
+	cache.addCost(-e.cost)
 }
@@ -0,0 +1,306 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEviction(t *testing.T) {
+	type put struct {
+		key  uint32
+		cost int64
+	}
+	tests := []struct {
+		name     string
+		capacity int64
+		puts     []put
+		gets     []uint32
+		present  []uint32
+		absent   []uint32
+	}{
+		{"fits", 10, []put{{1, 5}, {2, 5}}, nil, []uint32{1, 2}, nil},
+		{"evicts oldest", 10, []put{{1, 5}, {2, 5}, {3, 5}}, nil, []uint32{2, 3}, []uint32{1}},
+		{"evicts several", 10, []put{{1, 3}, {2, 3}, {3, 3}, {4, 9}}, nil, []uint32{4}, []uint32{1, 2, 3}},
+		{"too costly", 10, []put{{1, 5}, {2, 11}}, nil, []uint32{1}, []uint32{2}},
+		{"update cost", 10, []put{{1, 5}, {2, 5}, {1, 2}, {3, 3}}, nil, []uint32{1, 2, 3}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := New[uint32, int](test.capacity, 0)
+			for _, p := range test.puts {
+				cache.Put(p.key, int(p.key), p.cost)
+			}
+			for _, key := range test.gets {
+				cache.Get(key)
+			}
+			for _, key := range test.present {
+				if v, ok := cache.Get(key); !ok || v != int(key) {
+					t.Errorf("key %d: got %d, %v", key, v, ok)
+				}
+			}
+			for _, key := range test.absent {
+				if _, ok := cache.Get(key); ok {
+					t.Errorf("key %d should have been evicted", key)
+				}
+			}
+			if stats := cache.Stats(); stats.Cost > test.capacity {
+				t.Errorf("cost %d exceeds capacity %d", stats.Cost, test.capacity)
+			}
+		})
+	}
+}
+
+func TestGetRefreshesRecency(t *testing.T) {
+	cache := New[uint32, int](10, 0)
+	cache.Put(1, 1, 5)
+	cache.Put(2, 2, 5)
+	cache.Get(1)
+	cache.Put(3, 3, 5)
+	if _, ok := cache.Get(1); !ok {
+		t.Error("recently used key 1 was evicted")
+	}
+	if _, ok := cache.Get(2); ok {
+		t.Error("least recently used key 2 was not evicted")
+	}
+}
+
+func TestTTL(t *testing.T) {
+	cache := New[string, int](10, 10*time.Millisecond)
+	cache.Put("a", 1, 1)
+	if _, ok := cache.Get("a"); !ok {
+		t.Fatal("entry expired too early")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := cache.Get("a"); ok {
+		t.Fatal("entry did not expire")
+	}
+	stats := cache.Stats()
+	if stats.Expirations != 1 || stats.Entries != 0 || stats.Cost != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestStats(t *testing.T) {
+	cache := New[uint32, int](2, 0)
+	cache.Put(1, 1, 1)
+	cache.Put(2, 2, 1)
+	cache.Put(3, 3, 1)
+	cache.Get(1)
+	cache.Get(3)
+	want := Stats{Hits: 1, Misses: 1, Evictions: 1, Entries: 2, Cost: 2}
+	if stats := cache.Stats(); stats != want {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+}
+
+func TestInvalidateAndPurge(t *testing.T) {
+	cache := New[uint32, int](10, 0)
+	cache.Put(1, 1, 1)
+	cache.Put(2, 2, 1)
+	cache.Invalidate(1)
+	if _, ok := cache.Get(1); ok {
+		t.Error("invalidated key is still cached")
+	}
+	cache.Purge()
+	if stats := cache.Stats(); stats.Entries != 0 || stats.Cost != 0 {
+		t.Errorf("purged cache is not empty: %+v", stats)
+	}
+}
+
+func TestGetOrLoadCoalesces(t *testing.T) {
+	cache := New[uint32, int](100, 0)
+	var loads int32
+	release := make(chan struct{})
+	load := func() (int, int64, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return 42, 1, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := cache.GetOrLoad(7, load); err != nil || v != 42 {
+				t.Errorf("got %d, %v", v, err)
+			}
+		}()
+	}
+	// Let the goroutines queue on the in-flight load
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if loads != 1 {
+		t.Errorf("loaded %d times, want 1", loads)
+	}
+	if v, ok := cache.Get(7); !ok || v != 42 {
+		t.Errorf("loaded value not cached: %d, %v", v, ok)
+	}
+}
+
+func TestGetOrLoadError(t *testing.T) {
+	cache := New[uint32, int](100, 0)
+	failure := errors.New("store unavailable")
+	if _, err := cache.GetOrLoad(1, func() (int, int64, error) { return 0, 1, failure }); err != failure {
+		t.Fatalf("got %v, want %v", err, failure)
+	}
+	if _, ok := cache.Get(1); ok {
+		t.Error("failed load was cached")
+	}
+	if v, err := cache.GetOrLoad(1, func() (int, int64, error) { return 1, 1, nil }); err != nil || v != 1 {
+		t.Errorf("retry got %d, %v", v, err)
+	}
+}
+
+func TestGetOrLoadPanic(t *testing.T) {
+	cache := New[uint32, int](100, 0)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	recovered := make(chan interface{})
+	go func() {
+		defer func() { recovered <- recover() }()
+		cache.GetOrLoad(1, func() (int, int64, error) {
+			close(started)
+			<-release
+			panic("corrupt document")
+		})
+	}()
+	<-started
+	waiter := make(chan error)
+	go func() {
+		_, err := cache.GetOrLoad(1, func() (int, int64, error) { return 2, 1, nil })
+		waiter <- err
+	}()
+	// Let the waiter join the in-flight load before it panics
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	if r := <-recovered; r != "corrupt document" {
+		t.Errorf("got panic %v in the loading caller", r)
+	}
+	select {
+	case err := <-waiter:
+		if err != ErrLoadPanicked && err != nil {
+			t.Errorf("waiter got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter blocked after the load panicked")
+	}
+	// The key is not stuck in flight
+	if v, err := cache.GetOrLoad(1, func() (int, int64, error) { return 3, 1, nil }); err != nil || v == 0 {
+		t.Errorf("got %d, %v after the panic", v, err)
+	}
+}
+
+func TestInvalidateDuringLoad(t *testing.T) {
+	cache := New[uint32, int](100, 0)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		cache.GetOrLoad(1, func() (int, int64, error) {
+			close(started)
+			<-release
+			return 1, 1, nil
+		})
+		close(done)
+	}()
+	<-started
+	cache.Invalidate(1)
+	close(release)
+	<-done
+	if _, ok := cache.Get(1); ok {
+		t.Error("value invalidated while loading was cached")
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	cache := New[uint32, int](64, 0)
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				key := uint32((g*31 + i) % 100)
+				switch i % 4 {
+				case 0:
+					cache.Put(key, int(key), int64(key%4+1))
+				case 1:
+					if v, ok := cache.Get(key); ok && v != int(key) {
+						t.Errorf("key %d has value %d", key, v)
+					}
+				case 2:
+					v, _ := cache.GetOrLoad(key, func() (int, int64, error) { return int(key), 1, nil })
+					if v != int(key) {
+						t.Errorf("key %d loaded value %d", key, v)
+					}
+				case 3:
+					cache.Invalidate(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	stats := cache.Stats()
+	if stats.Cost > 64 || stats.Entries > 64 {
+		t.Errorf("capacity exceeded: %+v", stats)
+	}
+}
+
+func TestShardedCache(t *testing.T) {
+	cache := NewSharded[uint32, int](4, 40, 0, func(key uint32) uint32 { return key })
+	for key := uint32(0); key < 8; key++ {
+		cache.Put(key, int(key), 5)
+	}
+	for key := uint32(0); key < 8; key++ {
+		if v, ok := cache.Get(key); !ok || v != int(key) {
+			t.Errorf("key %d: got %d, %v", key, v, ok)
+		}
+	}
+	// The shards share the capacity, so a ninth key evicts the least recent key of all shards
+	cache.Put(8, 8, 5)
+	if _, ok := cache.Get(0); ok {
+		t.Error("key 0 should have been evicted")
+	}
+	if _, ok := cache.Get(1); !ok {
+		t.Error("key 1 in another shard was evicted")
+	}
+	cache.Invalidate(8)
+	if _, ok := cache.Get(8); ok {
+		t.Error("invalidated key is still cached")
+	}
+	stats := cache.Stats()
+	if stats.Entries != 7 || stats.Cost != 35 || stats.Evictions != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestShardedCacheLargeEntry(t *testing.T) {
+	cache := NewSharded[uint32, int](4, 40, 0, func(key uint32) uint32 { return key })
+	cache.Put(1, 1, 10)
+	cache.Put(2, 2, 10)
+	// A value costing more than a quarter of the capacity is cached, evicting the least recent keys of other shards
+	cache.Put(0, 0, 30)
+	if _, ok := cache.Get(0); !ok {
+		t.Error("large key is not cached")
+	}
+	if _, ok := cache.Get(1); ok {
+		t.Error("key 1 should have been evicted")
+	}
+	if _, ok := cache.Get(2); !ok {
+		t.Error("key 2 was evicted")
+	}
+	if stats := cache.Stats(); stats.Cost != 40 || stats.Entries != 2 || stats.Evictions != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	// Values costing more than the whole capacity are not cached
+	cache.Put(5, 5, 50)
+	if _, ok := cache.Get(5); ok {
+		t.Error("key costing more than the capacity is cached")
+	}
+}
@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"time"
+)
+
+// ShardedCache - LRU cache partitioned into shards with separate locks
+type ShardedCache[K comparable, V any] struct {
+	shards []*LRUCache[K, V]
+	hash   func(K) uint32
+	budget *budget
+}
+
+// NewSharded - create a sharded cache of the shards selected by hash of the key
+//
+// The shards share the capacity, so a single value may cost up to all of it; once a put exceeds the capacity the
+// least recent entries of all shards are evicted until the cache fits again.
+func NewSharded[K comparable, V any](shards int, capacity int64, ttl time.Duration, hash func(K) uint32) *ShardedCache[K, V] {
+	if shards < 1 {
+		shards = 1
+	}
+	var cache ShardedCache[K, V]
+	cache.budget = &budget{capacity: capacity}
+	cache.shards = make([]*LRUCache[K, V], shards)
+	for i := range cache.shards {
+		cache.shards[i] = New[K, V](capacity, ttl)
+		cache.shards[i].budget = cache.budget
+	}
+	cache.hash = hash
+	return &cache
+}
+
+// Get - get a value from the cache
+func (cache *ShardedCache[K, V]) Get(key K) (V, bool) {
+	return cache.shard(key).Get(key)
+}
+
+// GetOrLoad - get a value from the cache, or load and cache it; concurrent misses of a key share one load
+func (cache *ShardedCache[K, V]) GetOrLoad(key K, load func() (V, int64, error)) (V, error) {
+	value, e := cache.shard(key).GetOrLoad(key, load)
+	cache.fit()
+	return value, e
+}
+
+// Put - upsert a value with its cost in the cache
+func (cache *ShardedCache[K, V]) Put(key K, value V, cost int64) {
+	cache.shard(key).Put(key, value, cost)
+	cache.fit()
+}
+
+// fit - evict the least recent entries of all shards until their total cost is within the capacity
+//
+// Shards are locked one at a time, so concurrent puts may exceed the capacity by their values until they fit.
+func (cache *ShardedCache[K, V]) fit() {
+	for cache.budget.cost.Load() > cache.budget.capacity {
+		var oldest *LRUCache[K, V]
+		var used uint64
+		for _, shard := range cache.shards {
+			if u, ok := shard.oldest(); ok && (oldest == nil || u < used) {
+				oldest, used = shard, u
+			}
+		}
+		if oldest == nil || !oldest.evictOldest() {
+			return
+		}
+	}
+}
+
+// Invalidate - remove a key from the cache
+func (cache *ShardedCache[K, V]) Invalidate(key K) {
+	cache.shard(key).Invalidate(key)
+}
+
+// Purge - remove all entries
+func (cache *ShardedCache[K, V]) Purge() {
+	for _, shard := range cache.shards {
+		shard.Purge()
+	}
+}
+
+// Stats - get the metrics summed over all shards
+func (cache *ShardedCache[K, V]) Stats() (stats Stats) {
+	for _, shard := range cache.shards {
+		s := shard.Stats()
+		stats.Hits += s.Hits
+		stats.Misses += s.Misses
+		stats.Evictions += s.Evictions
+		stats.Expirations += s.Expirations
+		stats.Entries += s.Entries
+		stats.Cost += s.Cost
+	}
+	return
+}
+
+func (cache *ShardedCache[K, V]) shard(key K) *LRUCache[K, V] {
+	return cache.shards[cache.hash(key)%uint32(len(cache.shards))]
+}
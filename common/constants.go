@@ -1,7 +1,28 @@
 package util
 
-// TxBufferSize - transaction buffer size for writing
-const TxBufferSize uint32 = 1024 * 1024 * 4
+// TxBatchSize - default transactions per bulk write of a transaction file
+const TxBatchSize int = 10000
 
-// LRUSize - default size for Tx LRU cache
-const LRUCacheSize int = 128
+// LRUCacheBytes - default memory bound of the Tx LRU cache
+const LRUCacheBytes int64 = 1024 * 1024 * 1024 * 4
+
+// LRUCacheShards - default number of Tx LRU cache shards
+const LRUCacheShards int = 16
+
+// BloomCacheBytes - default memory bound of the Tx bloom filter cache
+const BloomCacheBytes int64 = 1024 * 1024 * 256
+
+// DefaultGroupCurrency - group currency used when none is configured
+const DefaultGroupCurrency string = "USD"
+
+// DefaultDataDB - database of activities, transactions and enrichment state used when none is configured
+const DefaultDataDB string = "db-data"
+
+// DefaultDADB - database of DA used when none is configured
+const DefaultDADB string = "db-da"
+
+// DefaultDBMode - consistency mode of the database session used when none is configured
+const DefaultDBMode string = "Monotonic"
+
+// DefaultConnStr - database server used when none is configured
+const DefaultConnStr string = "localhost:27017"
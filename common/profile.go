@@ -0,0 +1,160 @@
+package util
+
+import (
+	"strings"
+	"time"
+
+	"../logger"
+)
+
+// Pairing policies of advice files
+const (
+	// PairingPaired - AAC files are processed only with the SAC file of the same batch
+	PairingPaired = "Paired"
+	// PairingAACOnly - AAC files without a SAC file are processed too
+	PairingAACOnly = "AACOnly"
+)
+
+// Matching strategies of submissions to transactions
+const (
+	// MatchMRNAndType - match transactions with the same MRN and type
+	MatchMRNAndType = "MRNAndType"
+	// MatchMRN - match transactions with the same MRN and any registered type
+	MatchMRN = "MRN"
+	// MatchNone - submissions are not enriched
+	MatchNone = "None"
+)
+
+// Amount sign conventions of advices
+const (
+	// SignByType - apply the sign convention of the transaction type
+	SignByType = "ByType"
+	// SignAsProvided - keep amounts as provided
+	SignAsProvided = "AsProvided"
+	// SignInverted - negate amounts, then apply the sign convention of the transaction type
+	SignInverted = "Inverted"
+)
+
+// PairingPolicies, MatchingStrategies, AmountSigns - values accepted by profiles, the first is the default
+var (
+	PairingPolicies    = []string{PairingPaired, PairingAACOnly}
+	MatchingStrategies = []string{MatchMRNAndType, MatchMRN, MatchNone}
+	AmountSigns        = []string{SignByType, SignAsProvided, SignInverted}
+)
+
+// builtinProfile - settings of providers without a profile when no Default profile is configured
+var builtinProfile = ProviderProfile{Pairing: PairingPaired, Matching: MatchMRNAndType, AmountSign: SignByType}
+
+// DefaultProfile - key of the profile whose settings apply to providers without their own
+const DefaultProfile = "Default"
+
+// ProviderProfile - advice conventions of a provider, empty settings use the defaults
+type ProviderProfile struct {
+	// TimeFormats - layouts of advice timestamps, tried before the built-in formats
+	TimeFormats []string `json:"TimeFormats"`
+	// TimeZone - IANA zone of advice timestamps without an offset, UTC if empty
+	TimeZone   string `json:"TimeZone"`
+	Pairing    string `json:"Pairing"`
+	Matching   string `json:"Matching"`
+	AmountSign string `json:"AmountSign"`
+	// location - the loaded TimeZone, nil for UTC
+	location *time.Location
+}
+
+// ParseTime - parse an advice timestamp with the formats of the profile, then the built-in formats
+func (profile ProviderProfile) ParseTime(str string) (time.Time, error) {
+	return ParseTimeIn(str, profile.TimeFormats, profile.location)
+}
+
+// ProviderAmount - the amount of an advice in the common sign convention, before the type's convention
+func (profile ProviderProfile) ProviderAmount(amount float32) float32 {
+	if profile.AmountSign == SignInverted {
+		return -amount
+	}
+	return amount
+}
+
+// TypeSign - the sign convention of transaction types applies to the provider's amounts
+func (profile ProviderProfile) TypeSign() bool {
+	return profile.AmountSign != SignAsProvided
+}
+
+// inherit - the profile with its empty settings taken from the parent
+func (profile ProviderProfile) inherit(parent ProviderProfile) ProviderProfile {
+	if len(profile.TimeFormats) == 0 {
+		profile.TimeFormats = parent.TimeFormats
+	}
+	if len(profile.TimeZone) == 0 {
+		profile.TimeZone = parent.TimeZone
+		profile.location = parent.location
+	}
+	if len(profile.Pairing) == 0 {
+		profile.Pairing = parent.Pairing
+	}
+	if len(profile.Matching) == 0 {
+		profile.Matching = parent.Matching
+	}
+	if len(profile.AmountSign) == 0 {
+		profile.AmountSign = parent.AmountSign
+	}
+	return profile
+}
+
+// canonical - the profile with its settings in the case of the defined values and its time zone loaded
+func (profile ProviderProfile) canonical() ProviderProfile {
+	if len(profile.TimeZone) > 0 {
+		location, e := time.LoadLocation(profile.TimeZone)
+		if e != nil {
+			logger.Warn("Unknown time zone of provider profile, using UTC", "timezone", profile.TimeZone, logger.KeyError, e)
+		}
+		profile.location = location
+	}
+	match := func(values []string, value string) string {
+		for _, v := range values {
+			if strings.EqualFold(v, value) {
+				return v
+			}
+		}
+		return value
+	}
+	profile.Pairing = match(PairingPolicies, profile.Pairing)
+	profile.Matching = match(MatchingStrategies, profile.Matching)
+	profile.AmountSign = match(AmountSigns, profile.AmountSign)
+	return profile
+}
+
+// ProfileRegistry - provider profiles by advice provider, case insensitive
+type ProfileRegistry struct {
+	byProvider map[string]ProviderProfile
+	fallback   ProviderProfile
+}
+
+// NewProfileRegistry - create a registry from profiles keyed by provider, the Default profile applies to other providers
+// and to the empty settings of provider profiles
+func NewProfileRegistry(profiles map[string]ProviderProfile) *ProfileRegistry {
+	var registry ProfileRegistry
+	registry.fallback = builtinProfile
+	registry.byProvider = make(map[string]ProviderProfile)
+	for provider, profile := range profiles {
+		if strings.EqualFold(provider, DefaultProfile) {
+			registry.fallback = profile.canonical().inherit(builtinProfile)
+		}
+	}
+	for provider, profile := range profiles {
+		if !strings.EqualFold(provider, DefaultProfile) {
+			registry.byProvider[strings.ToLower(provider)] = profile.canonical().inherit(registry.fallback)
+		}
+	}
+	return &registry
+}
+
+// Get - get the profile of a provider, the default profile if the registry is nil or has none for the provider
+func (registry *ProfileRegistry) Get(provider string) ProviderProfile {
+	if registry == nil {
+		return builtinProfile
+	}
+	if profile, ok := registry.byProvider[strings.ToLower(provider)]; ok {
+		return profile
+	}
+	return registry.fallback
+}
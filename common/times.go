@@ -0,0 +1,118 @@
+package util
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeLayouts - built-in layouts of advice timestamps, tried in order after any configured layouts
+var TimeLayouts = []string{
+	"2006-01-02T15:04:05.000-07:00",
+	"2006-01-02T15:04:05.0000000-07:00",
+	"2006-01-02T15:04:05.0000000",
+	"2006-01-02T15:04:05-07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04:05Z07:00",
+}
+
+// TimeError - a timestamp matches none of the layouts
+type TimeError struct {
+	Value   string
+	Layouts []string
+}
+
+func (e *TimeError) Error() string {
+	return "cannot parse time " + strconv.Quote(e.Value) + " with layouts " + strings.Join(e.Layouts, ", ")
+}
+
+// ParseTime - parse a timestamp with the built-in layouts, timestamps without an offset are UTC
+func ParseTime(str string) (time.Time, error) {
+	return ParseTimeIn(str, nil, nil)
+}
+
+// ParseTimeIn - parse a timestamp with the layouts, then the built-in layouts; timestamps without an offset
+// are in the location, UTC if nil
+//
+// A layout of a zoned timestamp must match its zone with Z07:00 or -07:00, a literal Z would read it as a wall
+// clock time in the location.
+func ParseTimeIn(str string, layouts []string, location *time.Location) (time.Time, error) {
+	if location == nil {
+		location = time.UTC
+	}
+	for _, layout := range layouts {
+		if t, e := time.ParseInLocation(layout, str, location); e == nil {
+			return t, nil
+		}
+	}
+	for _, layout := range TimeLayouts {
+		if t, e := time.ParseInLocation(layout, str, location); e == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, &TimeError{Value: str, Layouts: append(append([]string{}, layouts...), TimeLayouts...)}
+}
+
+// BusinessDay - calendar of the dates activities and transactions are bucketed by; a business day starts at the
+// cutoff in its time zone, so activities after the cutoff belong to the next date
+type BusinessDay struct {
+	location *time.Location
+	cutoff   time.Duration
+}
+
+// NewBusinessDay - create a calendar of days in the time zone, UTC if empty, starting at the cutoff given as HH:MM,
+// midnight if empty
+func NewBusinessDay(zone string, cutoff string) (*BusinessDay, error) {
+	var day BusinessDay
+	day.location = time.UTC
+	if len(zone) > 0 {
+		location, e := time.LoadLocation(zone)
+		if e != nil {
+			return nil, e
+		}
+		day.location = location
+	}
+	if len(cutoff) > 0 {
+		t, e := time.Parse("15:04", cutoff)
+		if e != nil {
+			return nil, errors.New("invalid cutoff " + strconv.Quote(cutoff) + ", expected HH:MM")
+		}
+		day.cutoff = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return &day, nil
+}
+
+// Date - the unix date of the business day of the time; a nil calendar has UTC days like GetDate
+func (day *BusinessDay) Date(t time.Time) uint32 {
+	if day == nil {
+		return GetDate(t)
+	}
+	y, m, d := day.date(t)
+	return GetDate(time.Date(y, m, d, 0, 0, 0, 0, time.UTC))
+}
+
+// Start - the start of the business day of the time
+func (day *BusinessDay) Start(t time.Time) time.Time {
+	if day == nil {
+		return time.Unix(int64(GetDate(t))*86400, 0).UTC()
+	}
+	y, m, d := day.date(t)
+	if day.cutoff > 0 {
+		// The day starts at the cutoff of the previous date
+		d--
+	}
+	return time.Date(y, m, d, int(day.cutoff/time.Hour), int(day.cutoff%time.Hour/time.Minute), 0, 0, day.location)
+}
+
+// date - the calendar date of the business day of the time, the next date if its local clock is at or after the cutoff
+func (day *BusinessDay) date(t time.Time) (int, time.Month, int) {
+	local := t.In(day.location)
+	y, m, d := local.Date()
+	clock := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute + time.Duration(local.Second())*time.Second
+	if day.cutoff > 0 && clock >= day.cutoff {
+		// Normalized by time.Date to the first day of the next month
+		d++
+	}
+	return y, m, d
+}
@@ -0,0 +1,112 @@
+package util
+
+import (
+	"strings"
+	"sync"
+)
+
+// TransactionType - transaction type definition
+type TransactionType struct {
+	ID   uint16 `json:"ID"`
+	Name string `json:"Name"`
+	// Aliases - names used by each advice provider for this type
+	Aliases map[string][]string `json:"Aliases"`
+	// Sign - 1 or -1 to normalize the sign of amounts, 0 to keep them as provided
+	Sign int `json:"Sign"`
+}
+
+// TypeRegistry - registry of known transaction types
+type TypeRegistry struct {
+	byID    map[uint16]TransactionType
+	byName  map[string]uint16
+	byAlias map[string]uint16
+	names   []string
+	unknown map[string]int
+	mutex   *sync.Mutex
+}
+
+// DefaultTransactionTypes - transaction types used when none are configured
+func DefaultTransactionTypes() []TransactionType {
+	return []TransactionType{
+		{ID: 0, Name: "Charge"},
+		{ID: 1, Name: "Refund"},
+		{ID: 2, Name: "Chargeback"},
+		{ID: 3, Name: "ReverseChargeback"},
+		{ID: 4, Name: "Credit"},
+	}
+}
+
+// NewTypeRegistry - create a registry from type definitions
+func NewTypeRegistry(types []TransactionType) *TypeRegistry {
+	var registry TypeRegistry
+	if len(types) == 0 {
+		types = DefaultTransactionTypes()
+	}
+	registry.byID = make(map[uint16]TransactionType)
+	registry.byName = make(map[string]uint16)
+	registry.byAlias = make(map[string]uint16)
+	registry.unknown = make(map[string]int)
+	registry.mutex = &sync.Mutex{}
+	for _, t := range types {
+		registry.byID[t.ID] = t
+		registry.names = append(registry.names, t.Name)
+		registry.byName[t.Name] = t.ID
+		for provider, aliases := range t.Aliases {
+			for _, alias := range aliases {
+				registry.byAlias[aliasKey(provider, alias)] = t.ID
+			}
+		}
+	}
+	return &registry
+}
+
+// ByID - get a type by its id
+func (registry *TypeRegistry) ByID(id uint16) (t TransactionType, ok bool) {
+	t, ok = registry.byID[id]
+	return
+}
+
+// ByName - get a type by a provider's name for it, trying provider aliases before canonical names
+func (registry *TypeRegistry) ByName(provider string, name string) (t TransactionType, ok bool) {
+	id, ok := registry.byAlias[aliasKey(provider, name)]
+	if !ok {
+		id, ok = registry.byName[name]
+	}
+	if ok {
+		t = registry.byID[id]
+	}
+	return
+}
+
+// Names - canonical names of the registered types
+func (registry *TypeRegistry) Names() []string {
+	return registry.names
+}
+
+// ReportUnknown - record an unknown type seen from a source
+func (registry *TypeRegistry) ReportUnknown(source string, name string) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.unknown[source+"|"+name]++
+}
+
+// Unknown - get and reset the counts of unknown types by source|name
+func (registry *TypeRegistry) Unknown() (unknown map[string]int) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	unknown = registry.unknown
+	registry.unknown = make(map[string]int)
+	return
+}
+
+// NormalizeAmount - apply the sign convention of the type
+func (t TransactionType) NormalizeAmount(amount float32) float32 {
+	if t.Sign > 0 && amount < 0 || t.Sign < 0 && amount > 0 {
+		return -amount
+	}
+	return amount
+}
+
+func aliasKey(provider string, alias string) string {
+	return strings.ToLower(provider) + "|" + alias
+}
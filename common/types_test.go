@@ -0,0 +1,83 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTypeRegistryDefaults(t *testing.T) {
+	registry := NewTypeRegistry(nil)
+	if got, want := registry.Names(), []string{"Charge", "Refund", "Chargeback", "ReverseChargeback", "Credit"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if tt, ok := registry.ByID(2); !ok || tt.Name != "Chargeback" {
+		t.Errorf("got %+v, %v", tt, ok)
+	}
+	if _, ok := registry.ByID(99); ok {
+		t.Error("found an unregistered id")
+	}
+}
+
+func TestTypeRegistryByName(t *testing.T) {
+	registry := NewTypeRegistry([]TransactionType{
+		{ID: 0, Name: "Charge", Aliases: map[string][]string{"Paypal": {"Sale", "Capture"}}},
+		{ID: 1, Name: "Refund", Sign: -1, Aliases: map[string][]string{"Paypal": {"Charge"}}},
+		{ID: 7, Name: "Payout"},
+	})
+	tests := []struct {
+		provider string
+		name     string
+		want     string
+		ok       bool
+	}{
+		{"Paypal", "Sale", "Charge", true},
+		{"PAYPAL", "Capture", "Charge", true},
+		{"Adyen", "Payout", "Payout", true},
+		// Provider aliases take precedence over canonical names
+		{"Paypal", "Charge", "Refund", true},
+		{"Adyen", "Charge", "Charge", true},
+		// Aliases apply to their provider only, and names are case sensitive
+		{"Adyen", "Sale", "", false},
+		{"Adyen", "charge", "", false},
+	}
+	for _, test := range tests {
+		tt, ok := registry.ByName(test.provider, test.name)
+		if ok != test.ok || tt.Name != test.want {
+			t.Errorf("ByName(%q, %q) = %q, %v, want %q, %v", test.provider, test.name, tt.Name, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestNormalizeAmount(t *testing.T) {
+	tests := []struct {
+		sign   int
+		amount float32
+		want   float32
+	}{
+		{1, -5, 5},
+		{1, 5, 5},
+		{-1, 5, -5},
+		{-1, -5, -5},
+		{0, -5, -5},
+		{0, 5, 5},
+	}
+	for _, test := range tests {
+		if got := (TransactionType{Sign: test.sign}).NormalizeAmount(test.amount); got != test.want {
+			t.Errorf("sign %d: NormalizeAmount(%v) = %v, want %v", test.sign, test.amount, got, test.want)
+		}
+	}
+}
+
+func TestReportUnknown(t *testing.T) {
+	registry := NewTypeRegistry(nil)
+	registry.ReportUnknown("Paypal", "Adjustment")
+	registry.ReportUnknown("Paypal", "Adjustment")
+	registry.ReportUnknown("tx.csv", "Payout")
+	if got, want := registry.Unknown(), map[string]int{"Paypal|Adjustment": 2, "tx.csv|Payout": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The counts are reset once reported
+	if got := registry.Unknown(); len(got) != 0 {
+		t.Errorf("got %v after reporting", got)
+	}
+}
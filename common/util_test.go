@@ -0,0 +1,157 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"2017-03-01T10:20:30.123-08:00", time.Date(2017, 3, 1, 18, 20, 30, 123000000, time.UTC)},
+		{"2017-03-01T10:20:30.1234567-08:00", time.Date(2017, 3, 1, 18, 20, 30, 123456700, time.UTC)},
+		{"2017-03-01T10:20:30.1234567", time.Date(2017, 3, 1, 10, 20, 30, 123456700, time.UTC)},
+		{"2017-03-01T10:20:30+02:00", time.Date(2017, 3, 1, 8, 20, 30, 0, time.UTC)},
+		{"2017-03-01T10:20:30", time.Date(2017, 3, 1, 10, 20, 30, 0, time.UTC)},
+		{"2017-03-01T10:20:30Z", time.Date(2017, 3, 1, 10, 20, 30, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		if got, err := ParseTime(test.value); err != nil || !got.Equal(test.want) {
+			t.Errorf("ParseTime(%q) = %v, %v, want %v", test.value, got, err, test.want)
+		}
+	}
+	if _, err := ParseTime("01/03/2017"); err == nil {
+		t.Error("no error for an unknown layout")
+	} else if te, ok := err.(*TimeError); !ok || te.Value != "01/03/2017" {
+		t.Errorf("got %#v", err)
+	}
+}
+
+func TestParseTimeIn(t *testing.T) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		// Timestamps without an offset are in the location, with daylight saving time
+		{"01/03/2017 10:00", time.Date(2017, 3, 1, 18, 0, 0, 0, time.UTC)},
+		{"2017-07-01T10:00:00", time.Date(2017, 7, 1, 17, 0, 0, 0, time.UTC)},
+		{"2017-07-01T10:00:00+02:00", time.Date(2017, 7, 1, 8, 0, 0, 0, time.UTC)},
+		// UTC timestamps are not in the location
+		{"2017-03-01T10:00:00Z", time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC)},
+		{"2017-03-01T10:00:00.250Z", time.Date(2017, 3, 1, 10, 0, 0, 250*int(time.Millisecond), time.UTC)},
+	}
+	for _, test := range tests {
+		if got, err := ParseTimeIn(test.value, []string{"02/01/2006 15:04"}, la); err != nil || !got.Equal(test.want) {
+			t.Errorf("ParseTimeIn(%q) = %v, %v, want %v", test.value, got, err, test.want)
+		}
+	}
+}
+
+func TestBusinessDay(t *testing.T) {
+	day, err := NewBusinessDay("America/Los_Angeles", "18:00")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	march1 := GetDate(time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC))
+	tests := []struct {
+		time  time.Time
+		date  uint32
+		start time.Time
+	}{
+		// 17:59 PST on March 1st is before the cutoff
+		{time.Date(2017, 3, 2, 1, 59, 0, 0, time.UTC), march1, time.Date(2017, 3, 1, 2, 0, 0, 0, time.UTC)},
+		// 18:00 PST starts the business day of March 2nd
+		{time.Date(2017, 3, 2, 2, 0, 0, 0, time.UTC), march1 + 1, time.Date(2017, 3, 2, 2, 0, 0, 0, time.UTC)},
+		// The last day of a month after the cutoff belongs to the first day of the next month
+		{time.Date(2017, 3, 1, 3, 0, 0, 0, time.UTC), march1, time.Date(2017, 3, 1, 2, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		if got := day.Date(test.time); got != test.date {
+			t.Errorf("Date(%v) = %d, want %d", test.time, got, test.date)
+		}
+		if got := day.Start(test.time); !got.Equal(test.start) {
+			t.Errorf("Start(%v) = %v, want %v", test.time, got, test.start)
+		}
+	}
+
+	var utc *BusinessDay
+	if got := utc.Date(time.Date(2017, 3, 1, 23, 0, 0, 0, time.UTC)); got != march1 {
+		t.Errorf("nil calendar: got %d, want %d", got, march1)
+	}
+	for _, cutoff := range []string{"25:00", "6pm"} {
+		if _, err := NewBusinessDay("", cutoff); err == nil {
+			t.Errorf("no error for cutoff %q", cutoff)
+		}
+	}
+	if _, err := NewBusinessDay("Mars/Olympus", ""); err == nil {
+		t.Error("no error for an unknown time zone")
+	}
+}
+
+func TestGetDate(t *testing.T) {
+	tests := []struct {
+		time time.Time
+		want uint32
+	}{
+		{time.Date(1970, 1, 1, 23, 59, 59, 0, time.UTC), 0},
+		{time.Date(1970, 1, 2, 0, 0, 0, 0, time.UTC), 1},
+		{time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC), 17226},
+		// The date is the UTC date
+		{time.Date(2017, 3, 1, 20, 0, 0, 0, time.FixedZone("PST", -8*3600)), 17227},
+	}
+	for _, test := range tests {
+		if got := GetDate(test.time); got != test.want {
+			t.Errorf("GetDate(%v) = %d, want %d", test.time, got, test.want)
+		}
+	}
+}
+
+func TestProfileRegistry(t *testing.T) {
+	registry := NewProfileRegistry(map[string]ProviderProfile{
+		"default": {Matching: "mrn"},
+		"Paypal":  {Pairing: PairingAACOnly, TimeFormats: []string{"02/01/2006"}},
+		"Stripe":  {Matching: MatchNone, AmountSign: SignInverted},
+	})
+	tests := []struct {
+		provider string
+		want     ProviderProfile
+	}{
+		{"PAYPAL", ProviderProfile{TimeFormats: []string{"02/01/2006"}, Pairing: PairingAACOnly, Matching: MatchMRN, AmountSign: SignByType}},
+		{"Stripe", ProviderProfile{Pairing: PairingPaired, Matching: MatchNone, AmountSign: SignInverted}},
+		{"Other", ProviderProfile{Pairing: PairingPaired, Matching: MatchMRN, AmountSign: SignByType}},
+	}
+	for _, test := range tests {
+		if got := registry.Get(test.provider); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.provider, got, test.want)
+		}
+	}
+	var none *ProfileRegistry
+	if got := none.Get("Paypal"); got.Matching != MatchMRNAndType {
+		t.Errorf("nil registry: got %+v", got)
+	}
+
+	profile := registry.Get("Paypal")
+	if got, _ := profile.ParseTime("01/03/2017"); !got.Equal(time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("got %v for a profile time format", got)
+	}
+	if got, _ := profile.ParseTime("2017-03-01T10:00:00Z"); !got.Equal(time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("got %v for a built-in time format", got)
+	}
+	if _, err := time.LoadLocation("America/New_York"); err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	zoned := NewProfileRegistry(map[string]ProviderProfile{"Paypal": {TimeZone: "America/New_York"}}).Get("Paypal")
+	if got, _ := zoned.ParseTime("2017-03-01T10:00:00Z"); !got.Equal(time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("got %v for a UTC time of a zoned profile", got)
+	}
+	if got, _ := zoned.ParseTime("2017-03-01T10:00:00"); !got.Equal(time.Date(2017, 3, 1, 15, 0, 0, 0, time.UTC)) {
+		t.Errorf("got %v for a local time of a zoned profile", got)
+	}
+}
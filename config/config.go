@@ -1,16 +1,47 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"../common"
+	"../logger"
+	"gopkg.in/mgo.v2"
 )
 
 // ServiceConfig - service configuration model
 type ServiceConfig struct {
-	IO       IOType       `json:"IO"`
-	Database DatabaseType `json:"Database"`
-	Routines int          `json:"Routines"`
+	IO        IOType        `json:"IO"`
+	Database  DatabaseType  `json:"Database"`
+	Currency  CurrencyType  `json:"Currency"`
+	Reference ReferenceType `json:"Reference"`
+	// Enrichment - matching of submissions to transactions
+	Enrichment EnrichmentType `json:"Enrichment"`
+	// Cache - transaction cache bounds
+	Cache CacheType `json:"Cache"`
+	// BusinessDay - calendar of the dates submissions are matched to transactions on
+	BusinessDay BusinessDayType `json:"BusinessDay"`
+	// Diff - comparison of batch versions
+	Diff     DiffType `json:"Diff"`
+	Routines int      `json:"Routines"`
+	// PollInterval - seconds between rounds of processing the input dirs
+	PollInterval int `json:"PollIntervalSeconds"`
+	// TransactionFile - column mapping of tx csv files, the legacy positional layout is used if empty
+	TransactionFile TransactionFileType `json:"TransactionFile"`
+	// TransactionTypes - registered transaction types, the built-in types are used if empty
+	TransactionTypes []util.TransactionType `json:"TransactionTypes"`
+	// Providers - advice conventions by AdviceProvider, the Default profile applies to other providers
+	Providers map[string]util.ProviderProfile `json:"Providers"`
+	// Log - level, format and output of the service log
+	Log LogType `json:"Log"`
 }
 
 // IOType - IO config
@@ -18,19 +49,420 @@ type IOType struct {
 	EPADIR    string `json:"EPADIR"`
 	TxDIR     string `json:"TxDIR"`
 	OutputDIR string `json:"OutputDIR"`
+	FxDIR     string `json:"FxDIR"`
+	RejectDIR string `json:"RejectDIR"`
 }
 
 // DatabaseType - DB config
 type DatabaseType struct {
 	ConnStr string `json:"ConnectionString"`
+	// DataDB - database of activities, transactions and enrichment state, a default is used if empty
+	DataDB string `json:"DataDatabase"`
+	// DADB - database of DA, a default is used if empty
+	DADB string `json:"DADatabase"`
+	// Collections - collection names, defaults are used for empty names
+	Collections CollectionsType `json:"Collections"`
+	// Mode - session consistency or read preference: Strong, Monotonic (default), Eventual, Primary,
+	// PrimaryPreferred, Secondary, SecondaryPreferred or Nearest
+	Mode string `json:"Mode"`
+	// Writes - bulk writes of activities and DA
+	Writes WritesType `json:"Writes"`
+}
+
+// CollectionsType - collection names config, activity and DA collections share names in their databases
+type CollectionsType struct {
+	Account     string `json:"Account"`
+	Submission  string `json:"Submission"`
+	Transaction string `json:"Transaction"`
+	Enrichment  string `json:"Enrichment"`
+	Pending     string `json:"Pending"`
+}
+
+// WritesType - bulk write config
+type WritesType struct {
+	// BatchSize - documents per bulk write, a default is used if 0
+	BatchSize int `json:"BatchSize"`
+	// Retries - retries of a bulk write failing with a transient error
+	Retries int `json:"Retries"`
+	// RetryIntervalMs - milliseconds before the first retry, doubled for each next one
+	RetryIntervalMs int `json:"RetryIntervalMs"`
+}
+
+// CurrencyType - currency conversion config
+type CurrencyType struct {
+	GroupCurrency string `json:"GroupCurrency"`
+	// MerchantCurrencyFile - deprecated, MerchantId,Currency records used as Reference.MerchantFile if that is empty
+	MerchantCurrencyFile string `json:"MerchantCurrencyFile"`
+}
+
+// ReferenceType - reference data config
+type ReferenceType struct {
+	MerchantFile   string `json:"MerchantFile"`
+	ReloadInterval int    `json:"ReloadIntervalMinutes"`
+}
+
+// TransactionFileType - tx csv schema config
+type TransactionFileType struct {
+	Header        bool              `json:"Header"`
+	Columns       map[string]string `json:"Columns"`
+	SelfReference string            `json:"SelfReference"`
+	// UpdatePolicy - LastWriterWins (default) or Version
+	UpdatePolicy string `json:"UpdatePolicy"`
+	// BatchSize - transactions per bulk write, a default is used if 0
+	BatchSize int `json:"BatchSize"`
+}
+
+// EnrichmentType - submission enrichment config
+type EnrichmentType struct {
+	// DateWindow - days before and after the activity date to search for transactions, 0 to search the activity date
+	// only, a day if unset
+	DateWindow *uint32 `json:"DateWindow"`
+	// IndexedLookupThreshold - batches with at most this many submissions query transactions by MRN, 0 to disable
+	IndexedLookupThreshold int `json:"IndexedLookupThreshold"`
+	// BloomFilter - pre-check indexed lookups against per-date bloom filters
+	BloomFilter bool `json:"BloomFilter"`
+	// BloomFalsePositiveRate - target false positive rate of the bloom filters
+	BloomFalsePositiveRate float64 `json:"BloomFalsePositiveRate"`
+}
+
+// BusinessDayType - business day config
+type BusinessDayType struct {
+	// TimeZone - IANA zone of business days, UTC if empty; stored transactions and pending submissions keep the
+	// dates of the zone they were loaded with, so a change applies to data loaded after it only
+	TimeZone string `json:"TimeZone"`
+	// Cutoff - local time as HH:MM when a business day starts, midnight if empty
+	Cutoff string `json:"Cutoff"`
+}
+
+// DiffType - batch version comparison config
+type DiffType struct {
+	// StreamThreshold - batches with at least this many records are compared by streaming both versions from the store
+	// in key order instead of loading the last version in memory, 0 to disable; the records of the file are still
+	// loaded in memory once to be stored
+	StreamThreshold int `json:"StreamThreshold"`
+}
+
+// CacheType - transaction cache config
+type CacheType struct {
+	// MaxBytes - memory bound of cached transactions, a default is used if 0
+	MaxBytes int64 `json:"MaxBytes"`
+	// TTLMinutes - minutes before cached transactions of a date are reloaded, 0 to never expire
+	TTLMinutes int `json:"TTLMinutes"`
+	// Shards - number of independently locked cache shards, a default is used if 0
+	Shards int `json:"Shards"`
+}
+
+// LogType - log config
+type LogType struct {
+	// Level - debug, info (default), warn or error
+	Level string `json:"Level"`
+	// Format - logfmt (default) or json
+	Format string `json:"Format"`
+	// Output - stderr (default), stdout or a file path which entries are appended to
+	Output string `json:"Output"`
+}
+
+// DBModes - session modes accepted by Database.Mode by their names, case insensitive
+var DBModes = map[string]mgo.Mode{
+	"Strong":             mgo.Strong,
+	"Monotonic":          mgo.Monotonic,
+	"Eventual":           mgo.Eventual,
+	"Primary":            mgo.Primary,
+	"PrimaryPreferred":   mgo.PrimaryPreferred,
+	"Secondary":          mgo.Secondary,
+	"SecondaryPreferred": mgo.SecondaryPreferred,
+	"Nearest":            mgo.Nearest,
+}
+
+// DBMode - the session mode of a Database.Mode name, case insensitive
+func DBMode(name string) (mgo.Mode, bool) {
+	for n, mode := range DBModes {
+		if strings.EqualFold(n, name) {
+			return mode, true
+		}
+	}
+	return 0, false
+}
+
+// dbModeNames - names of DBModes in order
+func dbModeNames() []string {
+	names := make([]string, 0, len(DBModes))
+	for name := range DBModes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// UpdatePolicies - update policies accepted by TransactionFile.UpdatePolicy
+var UpdatePolicies = []string{"LastWriterWins", "Version"}
+
+// Load - load the config file, apply environment and command line overrides and defaults, then validate
+//
+// args are the command line arguments without the program name: an optional config file, default
+// ./config/service.json, and overrides of any field as -Path=value, e.g. -Database.Writes.BatchSize=500.
+// env overrides fields with DAGEN_ variables named by the upper case path, e.g. DAGEN_IO_EPADIR.
+// Flags take precedence over the environment, and both over the file.
+func Load(args []string, env []string) (config ServiceConfig, e error) {
+	file, flags := parseArgs(args)
+	if e = config.LoadConfig(file); e != nil {
+		return
+	}
+	if e = config.ApplyEnv(env); e != nil {
+		return
+	}
+	if e = config.ApplyFlags(flags); e != nil {
+		return
+	}
+	config.ApplyDefaults()
+	e = config.Validate()
+	return
+}
+
+// DefaultFile - config file used when none is given
+const DefaultFile = "./config/service.json"
+
+// parseArgs - the config file and override flags of the command line arguments
+func parseArgs(args []string) (file string, flags []string) {
+	file = DefaultFile
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			flags = append(flags, arg)
+		} else {
+			file = arg
+		}
+	}
+	return
+}
+
+// LoadError - the config file cannot be read or parsed
+type LoadError struct {
+	File string
+	// Line - line of a syntax or type error, 0 if unknown
+	Line int
+	Err  error
+}
+
+func (e *LoadError) Error() string {
+	if e.Line > 0 {
+		return e.File + ":" + strconv.Itoa(e.Line) + ": " + e.Err.Error()
+	}
+	return e.File + ": " + e.Err.Error()
+}
+
+// FieldError - a field has an invalid value
+type FieldError struct {
+	// Field - path of the field, e.g. Database.Writes.BatchSize
+	Field   string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// FieldErrors - fields with invalid values
+type FieldErrors []*FieldError
+
+func (e FieldErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, f := range e {
+		messages[i] = f.Error()
+	}
+	return "invalid config: " + strings.Join(messages, "; ")
 }
 
 // LoadConfig - loads configurations
-func (config *ServiceConfig) LoadConfig(file string) {
+func (config *ServiceConfig) LoadConfig(file string) error {
 	content, e := ioutil.ReadFile(file)
 	if e != nil {
-		println("File error:" + e.Error())
-		os.Exit(3)
+		return &LoadError{File: file, Err: e}
+	}
+	if e = json.Unmarshal(content, config); e != nil {
+		var offset int64
+		switch err := e.(type) {
+		case *json.SyntaxError:
+			offset = err.Offset
+		case *json.UnmarshalTypeError:
+			offset = err.Offset
+		}
+		line := 0
+		if offset > 0 {
+			line = 1 + bytes.Count(content[:offset], []byte("\n"))
+		}
+		return &LoadError{File: file, Line: line, Err: e}
+	}
+	return nil
+}
+
+// ApplyDefaults - set unset fields to their defaults
+//
+// Routines defaults to the number of CPUs, PollInterval to 5 seconds, Database to a local server with the db-data and db-da databases
+// in Monotonic mode, the group currency to USD, the merchant file to the deprecated Currency.MerchantCurrencyFile, the enrichment date
+// window to a day, the transaction cache to util.LRUCacheBytes in util.LRUCacheShards shards and the log to info entries in
+// logfmt on stderr.
+func (config *ServiceConfig) ApplyDefaults() {
+	setDefault := func(value *string, def string) {
+		if len(*value) == 0 {
+			*value = def
+		}
+	}
+	if config.Routines == 0 {
+		config.Routines = runtime.NumCPU()
+	}
+	if config.PollInterval == 0 {
+		config.PollInterval = 5
+	}
+	db := &config.Database
+	setDefault(&db.ConnStr, util.DefaultConnStr)
+	setDefault(&db.DataDB, util.DefaultDataDB)
+	setDefault(&db.DADB, util.DefaultDADB)
+	setDefault(&db.Mode, util.DefaultDBMode)
+	setDefault(&db.Collections.Account, "account")
+	setDefault(&db.Collections.Submission, "submission")
+	setDefault(&db.Collections.Transaction, "transaction")
+	setDefault(&db.Collections.Enrichment, "enrichment")
+	setDefault(&db.Collections.Pending, "pending")
+	setDefault(&config.Currency.GroupCurrency, util.DefaultGroupCurrency)
+	setDefault(&config.Reference.MerchantFile, config.Currency.MerchantCurrencyFile)
+	if config.Enrichment.DateWindow == nil {
+		window := uint32(1)
+		config.Enrichment.DateWindow = &window
+	}
+	if config.Enrichment.BloomFilter && config.Enrichment.BloomFalsePositiveRate == 0 {
+		config.Enrichment.BloomFalsePositiveRate = 0.01
+	}
+	if config.Cache.MaxBytes == 0 {
+		config.Cache.MaxBytes = util.LRUCacheBytes
+	}
+	if config.Cache.Shards == 0 {
+		config.Cache.Shards = util.LRUCacheShards
+	}
+	setDefault(&config.TransactionFile.UpdatePolicy, UpdatePolicies[0])
+	setDefault(&config.Log.Level, "info")
+	setDefault(&config.Log.Format, logger.Formats[0])
+	setDefault(&config.Log.Output, logger.OutputStderr)
+}
+
+// Validate - check required paths and value ranges, returning a FieldErrors of all invalid fields
+func (config *ServiceConfig) Validate() error {
+	var errs FieldErrors
+	fail := func(field string, message string) {
+		errs = append(errs, &FieldError{Field: field, Message: message})
+	}
+	for field, dir := range map[string]string{"IO.EPADIR": config.IO.EPADIR, "IO.TxDIR": config.IO.TxDIR} {
+		if len(dir) == 0 {
+			fail(field, "required")
+		} else if info, e := os.Stat(dir); e != nil || !info.IsDir() {
+			fail(field, "directory "+dir+" does not exist")
+		}
+	}
+	// Rates are optional, activities are left unconverted without them
+	if dir := config.IO.FxDIR; len(dir) > 0 {
+		if info, e := os.Stat(dir); e != nil || !info.IsDir() {
+			fail("IO.FxDIR", "directory "+dir+" does not exist")
+		}
+	}
+	if dir := config.IO.RejectDIR; len(dir) > 0 {
+		if info, e := os.Stat(dir); e == nil && !info.IsDir() {
+			fail("IO.RejectDIR", dir+" is not a directory")
+		}
+	}
+	if config.Routines < 1 || config.Routines > 1024 {
+		fail("Routines", "must be between 1 and 1024")
+	}
+	if config.PollInterval < 1 {
+		fail("PollIntervalSeconds", "must be at least 1")
+	}
+	if len(config.Database.ConnStr) == 0 {
+		fail("Database.ConnectionString", "required")
+	}
+	if _, ok := DBMode(config.Database.Mode); !ok {
+		fail("Database.Mode", "must be one of "+strings.Join(dbModeNames(), ", "))
+	}
+	if config.TransactionFile.BatchSize < 0 {
+		fail("TransactionFile.BatchSize", "must not be negative")
+	}
+	writes := config.Database.Writes
+	if writes.BatchSize < 0 {
+		fail("Database.Writes.BatchSize", "must not be negative")
+	}
+	if writes.Retries < 0 {
+		fail("Database.Writes.Retries", "must not be negative")
+	}
+	if writes.RetryIntervalMs < 0 {
+		fail("Database.Writes.RetryIntervalMs", "must not be negative")
+	}
+	if len(config.Currency.GroupCurrency) != 3 {
+		fail("Currency.GroupCurrency", "must be a 3 letter currency code")
+	}
+	if config.Reference.ReloadInterval < 0 {
+		fail("Reference.ReloadIntervalMinutes", "must not be negative")
+	}
+	enrichment := config.Enrichment
+	if enrichment.IndexedLookupThreshold < 0 {
+		fail("Enrichment.IndexedLookupThreshold", "must not be negative")
+	}
+	if enrichment.BloomFilter && (enrichment.BloomFalsePositiveRate <= 0 || enrichment.BloomFalsePositiveRate >= 1) {
+		fail("Enrichment.BloomFalsePositiveRate", "must be between 0 and 1")
+	}
+	if _, e := util.NewBusinessDay(config.BusinessDay.TimeZone, config.BusinessDay.Cutoff); e != nil {
+		fail("BusinessDay", e.Error())
+	}
+	if config.Cache.MaxBytes < 0 {
+		fail("Cache.MaxBytes", "must not be negative")
+	}
+	if config.Cache.TTLMinutes < 0 {
+		fail("Cache.TTLMinutes", "must not be negative")
+	}
+	if config.Cache.Shards < 0 {
+		fail("Cache.Shards", "must not be negative")
+	}
+	if config.Diff.StreamThreshold < 0 {
+		fail("Diff.StreamThreshold", "must not be negative")
+	}
+	if policy := config.TransactionFile.UpdatePolicy; len(policy) > 0 && !contains(UpdatePolicies, policy) {
+		fail("TransactionFile.UpdatePolicy", "must be one of "+strings.Join(UpdatePolicies, ", "))
+	}
+	for provider, profile := range config.Providers {
+		field := "Providers." + provider
+		if len(profile.Pairing) > 0 && !contains(util.PairingPolicies, profile.Pairing) {
+			fail(field+".Pairing", "must be one of "+strings.Join(util.PairingPolicies, ", "))
+		}
+		if len(profile.Matching) > 0 && !contains(util.MatchingStrategies, profile.Matching) {
+			fail(field+".Matching", "must be one of "+strings.Join(util.MatchingStrategies, ", "))
+		}
+		if len(profile.AmountSign) > 0 && !contains(util.AmountSigns, profile.AmountSign) {
+			fail(field+".AmountSign", "must be one of "+strings.Join(util.AmountSigns, ", "))
+		}
+		if _, e := time.LoadLocation(profile.TimeZone); e != nil {
+			fail(field+".TimeZone", e.Error())
+		}
+	}
+	if _, e := logger.ParseLevel(config.Log.Level); e != nil {
+		fail("Log.Level", e.Error())
+	}
+	if !contains(logger.Formats, config.Log.Format) {
+		fail("Log.Format", "must be one of "+strings.Join(logger.Formats, ", "))
+	}
+	if output := config.Log.Output; output != logger.OutputStderr && output != logger.OutputStdout {
+		if info, e := os.Stat(filepath.Dir(output)); e != nil || !info.IsDir() {
+			fail("Log.Output", "directory of "+output+" does not exist")
+		}
+	}
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+		return errs
+	}
+	return nil
+}
+
+// contains - the values contain the value, case insensitive
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
 	}
-	json.Unmarshal(content, config)
+	return false
 }
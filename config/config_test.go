@@ -0,0 +1,202 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writeConfig - write a config file to a temp dir
+func writeConfig(t *testing.T, content string) string {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "service.json")
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// validIO - IO section with existing dirs
+func validIO(t *testing.T) string {
+	dir := t.TempDir()
+	return `"IO": {"EPADIR": "` + dir + `", "TxDIR": "` + dir + `", "FxDIR": "` + dir + `"}`
+}
+
+func TestLoadDefaults(t *testing.T) {
+	file := writeConfig(t, `{`+validIO(t)+`}`)
+	config, err := Load([]string{file}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Routines != runtime.NumCPU() || config.Database.ConnStr != "localhost:27017" || config.Database.DataDB != "db-data" ||
+		config.Database.Collections.Pending != "pending" || config.Database.Mode != "Monotonic" || config.Currency.GroupCurrency != "USD" ||
+		config.Log.Level != "info" || config.Log.Format != "logfmt" || config.Log.Output != "stderr" {
+		t.Errorf("defaults not applied: %+v", config)
+	}
+}
+
+func TestLoadOptional(t *testing.T) {
+	// Rates are optional and a date window of 0 matches the activity date only
+	dir := t.TempDir()
+	file := writeConfig(t, `{"IO": {"EPADIR": "`+dir+`", "TxDIR": "`+dir+`"}, "Enrichment": {"DateWindow": 0}}`)
+	config, err := Load([]string{file}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Enrichment.DateWindow == nil || *config.Enrichment.DateWindow != 0 {
+		t.Errorf("got date window %v, want 0", config.Enrichment.DateWindow)
+	}
+	file = writeConfig(t, `{"IO": {"EPADIR": "`+dir+`", "TxDIR": "`+dir+`"}}`)
+	if config, err = Load([]string{file}, nil); err != nil || *config.Enrichment.DateWindow != 1 {
+		t.Errorf("got date window %v, %v, want 1", config.Enrichment.DateWindow, err)
+	}
+}
+
+func TestLoadOverrides(t *testing.T) {
+	file := writeConfig(t, `{`+validIO(t)+`, "Routines": 4, "Database": {"DataDatabase": "file"}, "Cache": {"TTLMinutes": 5}}`)
+	env := []string{"PATH=/bin", "DAGEN_ROUTINES=8", "DAGEN_DATABASE_DATADATABASE=env", "DAGEN_DATABASE_WRITES_BATCHSIZE=50"}
+	flags := []string{"-Routines=2", "--Enrichment.BloomFilter", "-TransactionTypes=[{\"ID\":0,\"Name\":\"Charge\"}]", file}
+	config, err := Load(flags, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Routines != 2 || config.Database.DataDB != "env" || config.Database.Writes.BatchSize != 50 || config.Cache.TTLMinutes != 5 {
+		t.Errorf("overrides not applied: %+v", config)
+	}
+	if !config.Enrichment.BloomFilter || config.Enrichment.BloomFalsePositiveRate != 0.01 {
+		t.Errorf("bloom filter not enabled with default rate: %+v", config.Enrichment)
+	}
+	if len(config.TransactionTypes) != 1 || config.TransactionTypes[0].Name != "Charge" {
+		t.Errorf("got transaction types %+v", config.TransactionTypes)
+	}
+}
+
+func TestLoadMerchantCurrencyFile(t *testing.T) {
+	// Configs of the merchant currency file keep working as the merchant master file
+	file := writeConfig(t, `{`+validIO(t)+`, "Currency": {"MerchantCurrencyFile": "currencies.csv"}}`)
+	config, err := Load([]string{file}, nil)
+	if err != nil || config.Reference.MerchantFile != "currencies.csv" {
+		t.Errorf("got %+v, %v", config.Reference, err)
+	}
+	file = writeConfig(t, `{`+validIO(t)+`, "Currency": {"MerchantCurrencyFile": "currencies.csv"}, "Reference": {"MerchantFile": "merchants.csv"}}`)
+	if config, _ = Load([]string{file}, nil); config.Reference.MerchantFile != "merchants.csv" {
+		t.Errorf("got %+v", config.Reference)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.json")
+	if _, err := Load([]string{missing}, nil); err == nil {
+		t.Error("no error for a missing file")
+	} else if le, ok := err.(*LoadError); !ok || !os.IsNotExist(le.Err) {
+		t.Errorf("got %#v", err)
+	}
+
+	file := writeConfig(t, "{\n  \"Routines\": 1,\n  \"IO\": {\"EPADIR\": 1}\n}")
+	if _, err := Load([]string{file}, nil); err == nil {
+		t.Error("no error for a mistyped field")
+	} else if le, ok := err.(*LoadError); !ok || le.Line != 3 {
+		t.Errorf("got %#v", err)
+	}
+
+	file = writeConfig(t, `{`+validIO(t)+`}`)
+	_, err := Load([]string{file, "-Routines=many", "-Unknown=1"}, []string{"DAGEN_IO_NOPE=x"})
+	got, ok := err.(FieldErrors)
+	if !ok || len(got) != 1 || got[0].Field != "IO.NOPE" {
+		t.Errorf("got %v for environment overrides", err)
+	}
+	_, err = Load([]string{file, "-Routines=many", "-Unknown=1"}, nil)
+	got, _ = err.(FieldErrors)
+	if len(got) != 2 || got[0].Field != "Routines" || got[1].Field != "Unknown" {
+		t.Errorf("got %v for flag overrides", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	config := ServiceConfig{Routines: -1}
+	config.IO.EPADIR = filepath.Join(t.TempDir(), "missing")
+	config.IO.FxDIR = filepath.Join(t.TempDir(), "missing")
+	config.Database.Mode = "Fastest"
+	config.Enrichment.BloomFilter = true
+	config.Enrichment.BloomFalsePositiveRate = 2
+	config.TransactionFile.UpdatePolicy = "FirstWins"
+	config.Log.Level = "verbose"
+	config.Log.Output = filepath.Join(t.TempDir(), "missing", "dagen.log")
+	config.ApplyDefaults()
+	err := config.Validate()
+	var fields []string
+	if errs, ok := err.(FieldErrors); ok {
+		for _, e := range errs {
+			fields = append(fields, e.Field)
+		}
+	}
+	want := []string{"Database.Mode", "Enrichment.BloomFalsePositiveRate", "IO.EPADIR", "IO.FxDIR", "IO.TxDIR", "Log.Level", "Log.Output", "Routines", "TransactionFile.UpdatePolicy"}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("got invalid fields %v, want %v", fields, want)
+	}
+}
+
+func TestWatcherReload(t *testing.T) {
+	file := writeConfig(t, `{`+validIO(t)+`, "Routines": 2}`)
+	w := NewWatcher([]string{file, "-PollIntervalSeconds=7"}, func() []string { return nil })
+	defer w.Stop()
+	if config, err := w.Reload(); config != nil || err != nil {
+		t.Fatalf("reloaded an unchanged file: %v, %v", config, err)
+	}
+
+	later := time.Now().Add(time.Minute)
+	if err := ioutil.WriteFile(file, []byte(`{`+validIO(t)+`, "Routines": 3}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(file, later, later)
+	config, err := w.Reload()
+	if err != nil || config == nil || config.Routines != 3 || config.PollInterval != 7 {
+		t.Fatalf("got %+v, %v", config, err)
+	}
+
+	// An invalid change is reported once and not reloaded again until the file changes
+	later = later.Add(time.Minute)
+	ioutil.WriteFile(file, []byte(`{"Routines": 3`), 0644)
+	os.Chtimes(file, later, later)
+	if _, err = w.Reload(); err == nil {
+		t.Error("no error for an invalid config")
+	}
+	if config, err = w.Reload(); config != nil || err != nil {
+		t.Errorf("reloaded an unchanged file: %v, %v", config, err)
+	}
+}
+
+func TestWatcherWait(t *testing.T) {
+	file := writeConfig(t, `{`+validIO(t)+`}`)
+	w := NewWatcher([]string{file}, func() []string { return nil })
+	defer w.Stop()
+	hangup := func() {
+		if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hangup()
+	start := time.Now()
+	w.Wait(time.Minute)
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("SIGHUP did not end the wait")
+	}
+	// Another SIGHUP before the reload neither blocks nor is reloaded twice
+	hangup()
+	for deadline := time.Now().Add(10 * time.Second); len(w.hangup) == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	w.Wait(time.Minute)
+	if config, err := w.Reload(); config == nil || err != nil {
+		t.Fatalf("no reload after SIGHUP: %v, %v", config, err)
+	}
+	if config, err := w.Reload(); config != nil || err != nil {
+		t.Errorf("reloaded again: %v, %v", config, err)
+	}
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// EnvPrefix - prefix of environment variables overriding config fields
+const EnvPrefix = "DAGEN_"
+
+// ApplyEnv - override fields with the DAGEN_ variables of env, given as KEY=value
+//
+// Variables are named by the upper case path of the field with _ between its parts, e.g. DAGEN_CACHE_TTLMINUTES.
+func (config *ServiceConfig) ApplyEnv(env []string) error {
+	var errs FieldErrors
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, EnvPrefix) {
+			continue
+		}
+		key, value := splitAssignment(kv[len(EnvPrefix):])
+		if e := config.Set(strings.Split(key, "_"), value); e != nil {
+			errs = append(errs, e)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ApplyFlags - override fields with flags given as -Path=value or --Path=value, e.g. -IO.EPADIR=/data/epa;
+// a flag without a value sets a boolean field to true
+func (config *ServiceConfig) ApplyFlags(flags []string) error {
+	var errs FieldErrors
+	for _, flag := range flags {
+		key, value := splitAssignment(strings.TrimLeft(flag, "-"))
+		if !strings.Contains(flag, "=") {
+			value = "true"
+		}
+		if e := config.Set(strings.Split(key, "."), value); e != nil {
+			errs = append(errs, e)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Set - set the field at the path, matched case insensitively to JSON or Go field names
+//
+// Strings are set as given, other values are parsed as JSON, e.g. numbers, true or a list of transaction types.
+func (config *ServiceConfig) Set(path []string, value string) *FieldError {
+	field := reflect.ValueOf(config).Elem()
+	names := make([]string, 0, len(path))
+	for _, part := range path {
+		if field.Kind() != reflect.Struct {
+			return &FieldError{Field: strings.Join(path, "."), Message: "unknown field"}
+		}
+		name, i := fieldByName(field.Type(), part)
+		if i < 0 {
+			return &FieldError{Field: strings.Join(path, "."), Message: "unknown field"}
+		}
+		names = append(names, name)
+		field = field.Field(i)
+	}
+	if field.Kind() == reflect.Struct {
+		return &FieldError{Field: strings.Join(names, "."), Message: "not a value"}
+	}
+	if field.Kind() == reflect.String {
+		field.SetString(value)
+		return nil
+	}
+	parsed := reflect.New(field.Type())
+	if e := json.Unmarshal([]byte(value), parsed.Interface()); e != nil {
+		return &FieldError{Field: strings.Join(names, "."), Message: "invalid value " + value + ": " + e.Error()}
+	}
+	field.Set(parsed.Elem())
+	return nil
+}
+
+// fieldByName - the JSON name and index of the struct field with the name, -1 if none
+func fieldByName(t reflect.Type, name string) (string, int) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if len(tag) == 0 {
+			tag = f.Name
+		}
+		if strings.EqualFold(tag, name) || strings.EqualFold(f.Name, name) {
+			return tag, i
+		}
+	}
+	return "", -1
+}
+
+// splitAssignment - the key and value of key=value
+func splitAssignment(s string) (key string, value string) {
+	if i := strings.IndexByte(s, '='); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
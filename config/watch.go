@@ -0,0 +1,82 @@
+package config
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"../logger"
+)
+
+// Watcher - reload the config when its file changes or the process receives SIGHUP
+type Watcher struct {
+	file    string
+	args    []string
+	env     func() []string
+	modTime time.Time
+	hangup  chan os.Signal
+	// pending - a SIGHUP received by Wait which the next Reload applies
+	pending bool
+}
+
+// NewWatcher - watch the config file of the command line arguments, env is read again on each reload
+func NewWatcher(args []string, env func() []string) *Watcher {
+	var w Watcher
+	w.file, _ = parseArgs(args)
+	w.args = args
+	w.env = env
+	if info, e := os.Stat(w.file); e == nil {
+		w.modTime = info.ModTime()
+	}
+	w.hangup = make(chan os.Signal, 1)
+	signal.Notify(w.hangup, syscall.SIGHUP)
+	return &w
+}
+
+// Wait - sleep for the interval, returning early on SIGHUP so the next Reload applies it
+func (w *Watcher) Wait(interval time.Duration) {
+	if w.pending {
+		return
+	}
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-w.hangup:
+		w.pending = true
+	}
+}
+
+// Reload - load and validate the config if its file changed or SIGHUP was received since the last call,
+// nil if neither happened
+func (w *Watcher) Reload() (*ServiceConfig, error) {
+	changed := w.pending
+	w.pending = false
+	select {
+	case <-w.hangup:
+		changed = true
+	default:
+	}
+	if changed {
+		logger.Debug("Received SIGHUP", logger.KeyFile, w.file)
+	}
+	if info, e := os.Stat(w.file); e == nil && !info.ModTime().Equal(w.modTime) {
+		logger.Debug("Config file changed", logger.KeyFile, w.file, "modtime", info.ModTime())
+		w.modTime = info.ModTime()
+		changed = true
+	}
+	if !changed {
+		return nil, nil
+	}
+	config, e := Load(w.args, w.env())
+	if e != nil {
+		return nil, e
+	}
+	return &config, nil
+}
+
+// Stop - stop receiving SIGHUP
+func (w *Watcher) Stop() {
+	signal.Stop(w.hangup)
+}
@@ -2,13 +2,14 @@ package fs
 
 import (
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+
+	"../logger"
 )
 
 const (
@@ -26,7 +27,7 @@ type ByName []os.FileInfo
 func LoadFilesByTime(dir string) (files ByDate) {
 	files, e := ioutil.ReadDir(dir)
 	if e != nil {
-		println("Load DIR error:" + e.Error())
+		logger.Error("Load DIR error", "dir", dir, logger.KeyError, e)
 	}
 
 	sort.Sort(files)
@@ -37,7 +38,7 @@ func LoadFilesByTime(dir string) (files ByDate) {
 func LoadFilesByName(dir string) (files ByName) {
 	files, e := ioutil.ReadDir(dir)
 	if e != nil {
-		println("Load DIR error:" + e.Error())
+		logger.Error("Load DIR error", "dir", dir, logger.KeyError, e)
 	}
 
 	sort.Sort(files)
@@ -48,7 +49,7 @@ func LoadFilesByName(dir string) (files ByName) {
 func LoadFilesWithSuffixByTime(dir string, suffix string) (files ByDate) {
 	all, e := ioutil.ReadDir(dir)
 	if e != nil {
-		println("Load DIR error:" + e.Error())
+		logger.Error("Load DIR error", "dir", dir, logger.KeyError, e)
 	}
 
 	for _, f := range all {
@@ -84,10 +85,10 @@ func (files ByName) Less(i, j int) bool {
 	num1, e1 := strconv.ParseUint(TrimExt(files[i].Name()), 10, 32)
 	num2, e2 := strconv.ParseUint(TrimExt(files[j].Name()), 10, 32)
 	if e1 != nil {
-		log.Fatal(e1)
+		logger.Fatal("File name is not a number", logger.KeyFile, files[i].Name(), logger.KeyError, e1)
 	}
 	if e2 != nil {
-		log.Fatal(e2)
+		logger.Fatal("File name is not a number", logger.KeyFile, files[j].Name(), logger.KeyError, e2)
 	}
 	return num1 < num2
 }
@@ -104,14 +105,33 @@ func DeleteFiles(dir string, files []os.FileInfo) {
 	for _, f := range files {
 		var err = os.Remove(path.Join(dir, f.Name()))
 		if err != nil {
-			println("Failed to delete", f.Name())
-			log.Fatal(err)
+			logger.Fatal("Failed to delete file", logger.KeyFile, f.Name(), logger.KeyError, err)
 		} else {
-			println("Deleted file", f.Name())
+			logger.Info("Deleted file", logger.KeyFile, f.Name())
 		}
 	}
 }
 
+// MoveFile - move a file into a dir, creating the dir if needed
+func MoveFile(file string, dir string) error {
+	if e := os.MkdirAll(dir, 0755); e != nil {
+		return e
+	}
+	target := path.Join(dir, filepath.Base(file))
+	if e := os.Rename(file, target); e == nil {
+		return nil
+	}
+	// The dir may be on another device
+	content, e := ioutil.ReadFile(file)
+	if e != nil {
+		return e
+	}
+	if e = ioutil.WriteFile(target, content, 0644); e != nil {
+		return e
+	}
+	return os.Remove(file)
+}
+
 // DeleteFilesWithSuffix - delete all files with a suffix in a dir
 func DeleteFilesWithSuffix(dir string, suffix string) {
 	files := LoadFilesWithSuffixByTime(dir, suffix)
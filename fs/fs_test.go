@@ -0,0 +1,130 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeFiles(t *testing.T, names ...string) string {
+	dir := t.TempDir()
+	now := time.Now()
+	for i, name := range names {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Files are written in order one minute apart
+		mtime := now.Add(time.Duration(i-len(names)) * time.Minute)
+		if err := os.Chtimes(file, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func names(files []os.FileInfo) (result []string) {
+	for _, f := range files {
+		result = append(result, f.Name())
+	}
+	return
+}
+
+func equal(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestLoadFilesByName(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  []string
+	}{
+		{"numeric not lexical", []string{"10.aac", "9.aac", "100.aac"}, []string{"9.aac", "10.aac", "100.aac"}},
+		{"ignores extension", []string{"3.sac", "1.aac", "2.csv"}, []string{"1.aac", "2.csv", "3.sac"}},
+		{"empty", nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := names(LoadFilesByName(writeFiles(t, test.files...)))
+			if !equal(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadFilesByTime(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  []string
+		suffix string
+		want   []string
+	}{
+		{"oldest first", []string{"3.aac", "1.aac", "2.aac"}, "", []string{"3.aac", "1.aac", "2.aac"}},
+		{"suffix", []string{"3.aac", "1.sac", "2.aac"}, ".aac", []string{"3.aac", "2.aac"}},
+		{"no match", []string{"1.aac"}, ".csv", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeFiles(t, test.files...)
+			var got []string
+			if test.suffix == "" {
+				got = names(LoadFilesByTime(dir))
+			} else {
+				got = names(LoadFilesWithSuffixByTime(dir, test.suffix))
+			}
+			if !equal(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTrimExt(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{"1001.aac", "1001"},
+		{"1001", "1001"},
+		{"rates.2017.csv", "rates.2017"},
+	}
+	for _, test := range tests {
+		if got := TrimExt(test.filename); got != test.want {
+			t.Errorf("TrimExt(%q) = %q, want %q", test.filename, got, test.want)
+		}
+	}
+}
+
+func TestDeleteFilesWithSuffix(t *testing.T) {
+	dir := writeFiles(t, "1.aac", "1.sac", "2.aac")
+	DeleteFilesWithSuffix(dir, ".aac")
+	if got := names(LoadFilesByTime(dir)); !equal(got, []string{"1.sac"}) {
+		t.Errorf("got %v, want [1.sac]", got)
+	}
+}
+
+func TestMoveFile(t *testing.T) {
+	dir := writeFiles(t, "1.csv")
+	target := filepath.Join(t.TempDir(), "rejected")
+	if err := MoveFile(filepath.Join(dir, "1.csv"), target); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(target, "1.csv")); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "1.csv")); !os.IsNotExist(err) {
+		t.Errorf("source kept: %v", err)
+	}
+}
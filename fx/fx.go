@@ -0,0 +1,157 @@
+package fx
+
+import (
+	"bufio"
+	"encoding/csv"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"../common"
+	"../fs"
+	"../logger"
+)
+
+// RateTable - daily exchange rates against the group currency
+type RateTable struct {
+	GroupCurrency string
+	rates         map[uint32]map[string]float64
+	dates         []uint32
+	loaded        map[string]time.Time
+	mutex         *sync.RWMutex
+}
+
+// New - create an empty rate table
+func New(groupCurrency string) *RateTable {
+	var table RateTable
+	if len(groupCurrency) == 0 {
+		groupCurrency = util.DefaultGroupCurrency
+	}
+	// Currencies of rate files are upper case
+	table.GroupCurrency = strings.ToUpper(strings.TrimSpace(groupCurrency))
+	table.rates = make(map[uint32]map[string]float64)
+	table.loaded = make(map[string]time.Time)
+	table.mutex = &sync.RWMutex{}
+	return &table
+}
+
+// LoadRateFiles - load rate files from a dir which are new or modified since the last call
+func (table *RateTable) LoadRateFiles(dir string) (count int) {
+	if len(dir) == 0 {
+		return
+	}
+	files := fs.LoadFilesWithSuffixByTime(dir, ".csv")
+	for _, file := range files {
+		if t, ok := table.loaded[file.Name()]; ok && !file.ModTime().After(t) {
+			continue
+		}
+		n, e := table.LoadRateFile(path.Join(dir, file.Name()))
+		if e != nil {
+			logger.Error("Failed to load rate file", logger.KeyFile, file.Name(), logger.KeyError, e)
+			continue
+		}
+		table.loaded[file.Name()] = file.ModTime()
+		count += n
+	}
+	return
+}
+
+// LoadRateFile - load a daily rate file with records of Date(yyyy-mm-dd),Currency,Rate
+// where Rate is the value of one unit of Currency in group currency
+//
+// The whole file is read before any rate is applied, so a file failing to load leaves the table unchanged.
+func (table *RateTable) LoadRateFile(filename string) (count int, e error) {
+	f, e := os.Open(filename)
+	if e != nil {
+		return
+	}
+	defer f.Close()
+	r := csv.NewReader(bufio.NewReader(f))
+	r.FieldsPerRecord = 3
+	type rateRecord struct {
+		date     uint32
+		currency string
+		rate     float64
+	}
+	var records []rateRecord
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			e = err
+			return
+		}
+		t, err := time.Parse("2006-01-02", strings.TrimSpace(record[0]))
+		if err != nil {
+			// Skip header or malformed date
+			continue
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
+		if err != nil || rate <= 0 {
+			continue
+		}
+		records = append(records, rateRecord{util.GetDate(t), strings.ToUpper(strings.TrimSpace(record[1])), rate})
+	}
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	for _, record := range records {
+		table.put(record.date, record.currency, record.rate)
+	}
+	count = len(records)
+	return
+}
+
+// Rate - get the conversion rate between two currencies using the latest rates on or before the date
+func (table *RateTable) Rate(date uint32, from string, to string) (rate float32, ok bool) {
+	from = strings.ToUpper(from)
+	to = strings.ToUpper(to)
+	if from == to {
+		return 1, true
+	}
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	fromRate, ok := table.groupRate(date, from)
+	if !ok {
+		return
+	}
+	toRate, ok := table.groupRate(date, to)
+	if !ok {
+		return
+	}
+	rate = float32(fromRate / toRate)
+	return
+}
+
+func (table *RateTable) groupRate(date uint32, currency string) (rate float64, ok bool) {
+	if currency == table.GroupCurrency {
+		return 1, true
+	}
+	// Index of the first date after the requested date
+	i := sort.Search(len(table.dates), func(i int) bool { return table.dates[i] > date })
+	for ; i > 0; i-- {
+		if rate, ok = table.rates[table.dates[i-1]][currency]; ok {
+			return
+		}
+	}
+	return
+}
+
+func (table *RateTable) put(date uint32, currency string, rate float64) {
+	daily, ok := table.rates[date]
+	if !ok {
+		daily = make(map[string]float64)
+		table.rates[date] = daily
+		i := sort.Search(len(table.dates), func(i int) bool { return table.dates[i] >= date })
+		table.dates = append(table.dates, 0)
+		copy(table.dates[i+1:], table.dates[i:])
+		table.dates[i] = date
+	}
+	daily[currency] = rate
+}
@@ -0,0 +1,117 @@
+package fx
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"../common"
+)
+
+// writeRates - write a rate file to the dir
+func writeRates(t *testing.T, dir string, name string, lines ...string) string {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	if e := os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	return file
+}
+
+func date(s string) uint32 {
+	t, _ := time.Parse("2006-01-02", s)
+	return util.GetDate(t)
+}
+
+func TestLoadRateFile(t *testing.T) {
+	table := New("USD")
+	file := writeRates(t, t.TempDir(), "rates.csv",
+		"Date,Currency,Rate",
+		"2017-03-01,eur,1.05",
+		"2017-03-01,GBP,-1",
+		"2017-03-01,JPY,abc",
+		"2017-03-02,EUR,1.10")
+	count, err := table.LoadRateFile(file)
+	// The header and records with invalid rates are skipped
+	if err != nil || count != 2 {
+		t.Errorf("got %d rates, %v, want 2", count, err)
+	}
+
+	bad := writeRates(t, t.TempDir(), "bad.csv", "2017-03-05,EUR,1.20", "2017-03-01,EUR")
+	if _, err = table.LoadRateFile(bad); err == nil {
+		t.Error("no error for a record with missing columns")
+	}
+	// The rates before the bad record are not applied
+	if rate, _ := table.Rate(date("2017-03-05"), "EUR", "USD"); rate != 1.10 {
+		t.Errorf("got rate %v of a failed file, want 1.10", rate)
+	}
+}
+
+func TestRate(t *testing.T) {
+	table := New("USD")
+	table.LoadRateFile(writeRates(t, t.TempDir(), "rates.csv",
+		"2017-03-01,EUR,1.05",
+		"2017-03-01,GBP,1.25",
+		"2017-03-03,EUR,1.10"))
+	tests := []struct {
+		name     string
+		date     string
+		from, to string
+		rate     float32
+		ok       bool
+	}{
+		{"same currency", "2017-01-01", "XXX", "xxx", 1, true},
+		{"to group", "2017-03-01", "EUR", "USD", 1.05, true},
+		{"from group", "2017-03-01", "usd", "GBP", 0.8, true},
+		{"cross", "2017-03-01", "GBP", "EUR", float32(1.25 / 1.05), true},
+		{"latest before the date", "2017-03-02", "EUR", "USD", 1.05, true},
+		{"latest on the date", "2017-03-05", "EUR", "USD", 1.10, true},
+		{"older rate of another currency", "2017-03-05", "GBP", "USD", 1.25, true},
+		{"before the first rate", "2017-02-28", "EUR", "USD", 0, false},
+		{"unknown currency", "2017-03-01", "CHF", "USD", 0, false},
+		{"unknown target", "2017-03-01", "EUR", "CHF", 0, false},
+	}
+	for _, test := range tests {
+		rate, ok := table.Rate(date(test.date), test.from, test.to)
+		if ok != test.ok || rate != test.rate {
+			t.Errorf("%s: got %v, %v, want %v, %v", test.name, rate, ok, test.rate, test.ok)
+		}
+	}
+}
+
+func TestLoadRateFiles(t *testing.T) {
+	dir := t.TempDir()
+	table := New("")
+	if table.GroupCurrency != util.DefaultGroupCurrency {
+		t.Errorf("got group currency %q", table.GroupCurrency)
+	}
+	// A lower case group currency matches the upper case currencies of rate files
+	lower := New("usd")
+	lower.LoadRateFile(writeRates(t, dir, "lower.txt", "2017-03-01,EUR,1.05"))
+	if rate, ok := lower.Rate(date("2017-03-01"), "EUR", "USD"); !ok || rate != 1.05 {
+		t.Errorf("got %v, %v to a lower case group currency", rate, ok)
+	}
+	if count := table.LoadRateFiles(""); count != 0 {
+		t.Errorf("loaded %d rates without a dir", count)
+	}
+	file := writeRates(t, dir, "1.csv", "2017-03-01,EUR,1.05")
+	writeRates(t, dir, "readme.txt", "2017-03-01,GBP,1.25")
+	if count := table.LoadRateFiles(dir); count != 1 {
+		t.Errorf("got %d rates, want 1", count)
+	}
+	// Unchanged files are not loaded again, modified ones are
+	if count := table.LoadRateFiles(dir); count != 0 {
+		t.Errorf("reloaded %d rates of an unchanged file", count)
+	}
+	writeRates(t, dir, "1.csv", "2017-03-01,EUR,1.07")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(file, later, later)
+	if count := table.LoadRateFiles(dir); count != 1 {
+		t.Errorf("got %d rates of a modified file, want 1", count)
+	}
+	if rate, _ := table.Rate(date("2017-03-01"), "EUR", "USD"); rate != 1.07 {
+		t.Errorf("got rate %v, want the reloaded 1.07", rate)
+	}
+}
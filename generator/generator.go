@@ -0,0 +1,470 @@
+// Command generator - write synthetic advice and transaction files for load and golden tests
+//
+// The output dir has the layout of a golden scenario: a numbered dir per advice version holding
+// epa/<batch>.aac and epa/<batch>.sac, tx/tx.csv and fx/rates.csv, plus merchants.csv and
+// expected-da.json with the derivative activities DAGen is expected to produce. Transaction and rate dates are
+// business days, so -timezone and -cutoff must match the BusinessDay config of the DAGen run.
+//
+//	go run ./generator -out /tmp/scenario -providers Paypal,Adyen -files 10 -records 1000 -versions 3
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"../common"
+	"../logger"
+	"../model"
+)
+
+// options - generator settings from the command line
+type options struct {
+	Out           string
+	Providers     []string
+	Merchants     int
+	Currencies    []string
+	GroupCurrency string
+	Files         int
+	Records       int
+	Versions      int
+	Days          int
+	AddRate       float64
+	ChangeRate    float64
+	RemoveRate    float64
+	MissingTxRate float64
+	LateTxRate    float64
+	Start         time.Time
+	Seed          int64
+	// Day - calendar of the business days DAGen buckets activities, transactions and rates by
+	Day *util.BusinessDay
+}
+
+// validate - check the counts and rates of the options
+func (opts options) validate() error {
+	if len(opts.Providers) == 0 || len(opts.Currencies) == 0 {
+		return errors.New("providers and currencies must not be empty")
+	}
+	counts := []struct {
+		name  string
+		value int
+	}{{"merchants", opts.Merchants}, {"files", opts.Files}, {"records", opts.Records}, {"versions", opts.Versions}, {"days", opts.Days}}
+	for _, count := range counts {
+		if count.value < 1 {
+			return errors.New(count.name + " must be at least 1")
+		}
+	}
+	rates := []struct {
+		name  string
+		value float64
+	}{{"add", opts.AddRate}, {"change + remove", opts.ChangeRate + opts.RemoveRate}, {"missing-tx + late-tx", opts.MissingTxRate + opts.LateTxRate}}
+	for _, rate := range rates {
+		if rate.value < 0 || rate.value > 1 {
+			return errors.New(rate.name + " must be between 0 and 1")
+		}
+	}
+	if opts.ChangeRate < 0 || opts.RemoveRate < 0 || opts.MissingTxRate < 0 || opts.LateTxRate < 0 {
+		return errors.New("rates must not be negative")
+	}
+	return nil
+}
+
+// advice - a record of an advice file
+type advice struct {
+	Kind        string
+	MRN         string
+	Type        string
+	Time        time.Time
+	MerchantID  string
+	Currency    string
+	Amount      float32
+	InternalMRN string
+	SOR         string
+	Partner     string
+	// TxVersion - version in which the transaction of a submission arrives, 0 if it never does
+	TxVersion uint32
+}
+
+// ExpectedDA - derivative activity expected for a record, in document currency
+type ExpectedDA struct {
+	Kind                    string
+	BatchName               string
+	AdviceProvider          string
+	VersionNumber           uint32
+	ActivityType            string
+	Time                    time.Time
+	MerchantID              string
+	Currency                string
+	Amount                  float32
+	MerchantReferenceNumber string `json:",omitempty"`
+	InternalMRN             string `json:",omitempty"`
+}
+
+// generator - state of a run
+type generator struct {
+	opts     options
+	rand     *rand.Rand
+	counter  int
+	expected []ExpectedDA
+	tx       map[uint32][][]string
+}
+
+var aacTypes = []string{"Fee", "Payout", "Adjustment", "Reserve"}
+
+var countries = map[string]string{"USD": "US", "EUR": "DE", "GBP": "GB", "JPY": "JP", "CAD": "CA", "AUD": "AU"}
+
+var regions = map[string]string{"US": "NA", "CA": "NA", "DE": "EMEA", "GB": "EMEA", "JP": "APAC", "AU": "APAC"}
+
+func main() {
+	var opts options
+	var providers, currencies, start, zone, cutoff string
+	flag.StringVar(&opts.Out, "out", "generated", "output dir")
+	flag.StringVar(&providers, "providers", "Paypal,Adyen", "comma separated advice providers")
+	flag.IntVar(&opts.Merchants, "merchants", 20, "number of merchants")
+	flag.StringVar(&currencies, "currencies", "USD,EUR,GBP", "comma separated document currencies")
+	flag.StringVar(&opts.GroupCurrency, "group", util.DefaultGroupCurrency, "group currency of the fx rates")
+	flag.IntVar(&opts.Files, "files", 5, "advice files per provider")
+	flag.IntVar(&opts.Records, "records", 100, "records per advice file in the first version")
+	flag.IntVar(&opts.Versions, "versions", 3, "versions of each advice file")
+	flag.IntVar(&opts.Days, "days", 1, "days spanned by the activities of a file")
+	flag.Float64Var(&opts.AddRate, "add", 0.1, "rate of records added in each later version")
+	flag.Float64Var(&opts.ChangeRate, "change", 0.1, "rate of records changing amount in each later version")
+	flag.Float64Var(&opts.RemoveRate, "remove", 0.05, "rate of records removed in each later version")
+	flag.Float64Var(&opts.MissingTxRate, "missing-tx", 0.01, "rate of submissions which never get a transaction")
+	flag.Float64Var(&opts.LateTxRate, "late-tx", 0.05, "rate of submissions whose transaction arrives with the next version")
+	flag.StringVar(&start, "start", "2017-03-01", "date of the first activities, yyyy-mm-dd")
+	flag.Int64Var(&opts.Seed, "seed", 1, "random seed")
+	flag.StringVar(&zone, "timezone", "", "IANA zone of business days as BusinessDay.TimeZone of the config, UTC if empty")
+	flag.StringVar(&cutoff, "cutoff", "", "local time as HH:MM when a business day starts as BusinessDay.Cutoff of the config")
+	flag.Parse()
+
+	opts.Providers = split(providers)
+	opts.Currencies = split(currencies)
+	var e error
+	opts.Start, e = time.Parse("2006-01-02", start)
+	if e != nil {
+		logger.Error("Invalid start date", "start", start, logger.KeyError, e)
+		os.Exit(2)
+	}
+	if opts.Day, e = util.NewBusinessDay(zone, cutoff); e != nil {
+		logger.Error("Invalid business day", "timezone", zone, "cutoff", cutoff, logger.KeyError, e)
+		os.Exit(2)
+	}
+	if e = opts.validate(); e != nil {
+		logger.Error("Invalid options", logger.KeyError, e)
+		os.Exit(2)
+	}
+
+	if e = generate(opts); e != nil {
+		logger.Fatal("Failed to generate", "out", opts.Out, logger.KeyError, e)
+	}
+	logger.Info("Generated advice files", "versions", opts.Versions, "pairs", len(opts.Providers)*opts.Files, "out", opts.Out)
+}
+
+func split(s string) (values []string) {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			values = append(values, v)
+		}
+	}
+	return
+}
+
+// generate - write all versions of the advice files with their transactions, reference data and expected DA
+func generate(opts options) (e error) {
+	g := generator{opts: opts, rand: rand.New(rand.NewSource(opts.Seed)), tx: make(map[uint32][][]string)}
+	if e = g.writeMerchants(); e != nil {
+		return
+	}
+	if e = g.writeRates(); e != nil {
+		return
+	}
+	batch := 1000
+	for _, provider := range opts.Providers {
+		for f := 0; f < opts.Files; f++ {
+			batch++
+			if e = g.writeBatch(strconv.Itoa(batch), provider); e != nil {
+				return
+			}
+		}
+	}
+	for v := uint32(1); v <= uint32(opts.Versions); v++ {
+		if e = writeCSV(filepath.Join(g.versionDir(v), "tx", "tx.csv"), g.tx[v]); e != nil {
+			return
+		}
+	}
+	return g.writeExpected()
+}
+
+func (g *generator) versionDir(version uint32) string {
+	return filepath.Join(g.opts.Out, strconv.FormatUint(uint64(version), 10))
+}
+
+// writeMerchants - write the merchant master with a local currency from the document currencies
+func (g *generator) writeMerchants() error {
+	records := [][]string{{"MerchantId", "LegalEntity", "Country", "LocalCurrency", "Region"}}
+	for i := 1; i <= g.opts.Merchants; i++ {
+		currency := g.opts.Currencies[g.rand.Intn(len(g.opts.Currencies))]
+		country, ok := countries[currency]
+		if !ok {
+			country = currency[:2]
+		}
+		region, ok := regions[country]
+		if !ok {
+			region = "GLOBAL"
+		}
+		id := "M" + strconv.Itoa(i)
+		records = append(records, []string{id, "Entity " + id, country, currency, region})
+	}
+	return writeCSV(filepath.Join(g.opts.Out, "merchants.csv"), records)
+}
+
+// writeRates - write daily rates of the document currencies to the group currency, for the first version
+//
+// Rates are looked up by business day, so they are written for the business days of the activities.
+func (g *generator) writeRates() error {
+	first := g.opts.Day.Date(g.opts.Start)
+	last := g.opts.Day.Date(g.opts.Start.AddDate(0, 0, g.opts.Days).Add(-time.Nanosecond))
+	var records [][]string
+	for _, currency := range g.opts.Currencies {
+		if currency == g.opts.GroupCurrency {
+			continue
+		}
+		rate := 0.5 + g.rand.Float64()*1.5
+		for d := first; d <= last; d++ {
+			date := time.Unix(int64(d)*86400, 0).UTC().Format("2006-01-02")
+			records = append(records, []string{date, currency, strconv.FormatFloat(rate, 'f', 4, 64)})
+			rate *= 0.99 + g.rand.Float64()*0.02
+		}
+	}
+	return writeCSV(filepath.Join(g.versionDir(1), "fx", "rates.csv"), records)
+}
+
+// writeBatch - write all versions of an advice file pair and record the DA expected from each
+func (g *generator) writeBatch(batch string, provider string) (e error) {
+	var last map[string]*advice
+	current := make(map[string]*advice)
+	for i := 0; i < g.opts.Records; i++ {
+		g.add(current, "aac", batch, 1)
+		g.add(current, "sac", batch, 1)
+	}
+	for v := uint32(1); v <= uint32(g.opts.Versions); v++ {
+		if v > 1 {
+			last = current
+			current = g.revise(last, batch, v)
+		}
+		if e = g.writeAdvice(batch, provider, v, current); e != nil {
+			return
+		}
+		g.expect(batch, provider, v, last, current)
+	}
+	return
+}
+
+// add - add a new record with a unique key to the version
+func (g *generator) add(records map[string]*advice, kind string, batch string, version uint32) {
+	g.counter++
+	a := advice{Kind: kind}
+	a.Time = g.opts.Start.Add(time.Duration(g.rand.Intn(g.opts.Days)*86400+g.counter%86400) * time.Second)
+	a.MerchantID = "M" + strconv.Itoa(1+g.rand.Intn(g.opts.Merchants))
+	a.Currency = g.opts.Currencies[g.rand.Intn(len(g.opts.Currencies))]
+	a.Amount = float32(1+g.rand.Intn(100000)) / 100
+	if kind == "aac" {
+		a.Type = aacTypes[g.rand.Intn(len(aacTypes))]
+		if a.Type == "Payout" {
+			a.Amount = -a.Amount
+		}
+	} else {
+		types := util.DefaultTransactionTypes()
+		a.Type = types[g.rand.Intn(len(types))].Name
+		a.MRN = batch + "-" + strconv.Itoa(g.counter)
+		g.transaction(&a, version)
+	}
+	records[a.key()] = &a
+}
+
+// transaction - decide when the transaction of a submission arrives and add it to that version's tx file
+func (g *generator) transaction(a *advice, version uint32) {
+	r := g.rand.Float64()
+	switch {
+	case r < g.opts.MissingTxRate:
+		return
+	case r < g.opts.MissingTxRate+g.opts.LateTxRate:
+		if version == uint32(g.opts.Versions) {
+			return
+		}
+		a.TxVersion = version + 1
+	default:
+		a.TxVersion = version
+	}
+	internalMRN := "#"
+	a.InternalMRN = a.MRN
+	if g.rand.Intn(2) == 0 {
+		internalMRN = "I" + a.MRN
+		a.InternalMRN = internalMRN
+	}
+	a.SOR = "SOR" + strconv.Itoa(1+g.rand.Intn(3))
+	a.Partner = "P" + strconv.Itoa(1+g.rand.Intn(3))
+	// Submissions are matched to transactions of their business day
+	date := strconv.FormatUint(uint64(g.opts.Day.Date(a.Time)), 10)
+	g.tx[a.TxVersion] = append(g.tx[a.TxVersion], []string{a.MRN, a.Type, internalMRN, a.SOR, a.Partner, date})
+}
+
+// revise - next version of the records with removals, amount changes and additions
+func (g *generator) revise(last map[string]*advice, batch string, version uint32) map[string]*advice {
+	next := make(map[string]*advice)
+	keys := sortedKeys(last)
+	for _, k := range keys {
+		a := *last[k]
+		r := g.rand.Float64()
+		if r < g.opts.RemoveRate {
+			continue
+		}
+		if r < g.opts.RemoveRate+g.opts.ChangeRate {
+			a.Amount = float32(1+g.rand.Intn(100000)) / 100
+			if a.Type == "Payout" {
+				a.Amount = -a.Amount
+			}
+		}
+		next[k] = &a
+	}
+	for i := 0; i < len(keys); i++ {
+		if g.rand.Float64() < g.opts.AddRate {
+			kind := "aac"
+			if g.rand.Intn(2) == 0 {
+				kind = "sac"
+			}
+			g.add(next, kind, batch, version)
+		}
+	}
+	return next
+}
+
+// writeAdvice - write the AAC and SAC files of a version
+func (g *generator) writeAdvice(batch string, provider string, version uint32, records map[string]*advice) (e error) {
+	dir := filepath.Join(g.versionDir(version), "epa")
+	if e = os.MkdirAll(dir, 0755); e != nil {
+		return
+	}
+	aac, e := os.Create(filepath.Join(dir, batch+".aac"))
+	if e != nil {
+		return
+	}
+	defer aac.Close()
+	sac, e := os.Create(filepath.Join(dir, batch+".sac"))
+	if e != nil {
+		return
+	}
+	defer sac.Close()
+
+	downloaded := g.opts.Start.AddDate(0, 0, int(version)).Format(time.RFC3339)
+	aacEncoder := json.NewEncoder(aac)
+	sacEncoder := json.NewEncoder(sac)
+	for _, k := range sortedKeys(records) {
+		a := records[k]
+		timestamp := a.Time.Format(time.RFC3339)
+		if a.Kind == "aac" {
+			e = aacEncoder.Encode(model.AAC{AdviceFileName: batch, AdviceProvider: provider, Version: version, ActivityType: a.Type, DownloadedTime: downloaded, ActivityTime: timestamp, MerchantID: a.MerchantID, Currency: a.Currency, Amount: a.Amount})
+		} else {
+			e = sacEncoder.Encode(model.SAC{AdviceFileName: batch, AdviceProvider: provider, Version: version, ActivityType: a.Type, DownloadedTime: downloaded, ActivityTime: timestamp, MerchantID: a.MerchantID, Currency: a.Currency, Amount: a.Amount, MerchantReferenceNumber: a.MRN})
+		}
+		if e != nil {
+			return
+		}
+	}
+	return
+}
+
+// expect - record the DA of a version compared to the last one, the same way DAGen derives it
+func (g *generator) expect(batch string, provider string, version uint32, last map[string]*advice, current map[string]*advice) {
+	for _, k := range sortedKeys(current) {
+		a := current[k]
+		// Submissions whose transaction arrives with the next version are reversed and added again enriched
+		if a.Kind == "sac" && a.TxVersion == version+1 && (last == nil || last[k] == nil) {
+			g.expected = append(g.expected, a.da(batch, provider, version, a.Amount, false))
+			g.expected = append(g.expected, a.da(batch, provider, version, -a.Amount, false))
+			g.expected = append(g.expected, a.da(batch, provider, version, a.Amount, true))
+			continue
+		}
+		o, ok := last[k]
+		if !ok {
+			g.expected = append(g.expected, a.da(batch, provider, version, a.Amount, a.TxVersion == version))
+		} else if diff := a.Amount - o.Amount; diff != 0 {
+			g.expected = append(g.expected, a.da(batch, provider, version, diff, a.TxVersion > 0))
+		}
+	}
+	for _, k := range sortedKeys(last) {
+		if _, ok := current[k]; !ok {
+			o := last[k]
+			g.expected = append(g.expected, o.da(batch, provider, version-1, -o.Amount, o.TxVersion > 0))
+		}
+	}
+}
+
+func (a *advice) da(batch string, provider string, version uint32, amount float32, enriched bool) (da ExpectedDA) {
+	da.Kind = a.Kind
+	da.BatchName = batch
+	da.AdviceProvider = provider
+	da.VersionNumber = version
+	da.ActivityType = a.Type
+	da.Time = a.Time
+	da.MerchantID = a.MerchantID
+	da.Currency = a.Currency
+	da.Amount = amount
+	da.MerchantReferenceNumber = a.MRN
+	if enriched {
+		da.InternalMRN = a.InternalMRN
+	}
+	return
+}
+
+// key - the fields of the record's hash code in DAGen
+func (a *advice) key() string {
+	return a.Kind + "-" + a.MRN + "-" + a.MerchantID + "-" + a.Type + "-" + strconv.FormatInt(a.Time.Unix(), 10) + "-" + a.Currency
+}
+
+// writeExpected - write the expected DA as JSON lines
+func (g *generator) writeExpected() error {
+	f, e := os.Create(filepath.Join(g.opts.Out, "expected-da.json"))
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	encoder := json.NewEncoder(f)
+	for _, da := range g.expected {
+		if e = encoder.Encode(da); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func writeCSV(file string, records [][]string) error {
+	if e := os.MkdirAll(filepath.Dir(file), 0755); e != nil {
+		return e
+	}
+	f, e := os.Create(file)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.WriteAll(records)
+	return w.Error()
+}
+
+func sortedKeys(records map[string]*advice) (keys []string) {
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
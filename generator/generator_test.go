@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"../common"
+)
+
+func testOptions(t *testing.T) options {
+	return options{Out: t.TempDir(), Providers: []string{"Paypal"}, Merchants: 2, Currencies: []string{"EUR"}, GroupCurrency: "USD",
+		Files: 1, Records: 5, Versions: 1, Days: 1, Start: time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC), Seed: 1}
+}
+
+func TestValidate(t *testing.T) {
+	opts := testOptions(t)
+	if e := opts.validate(); e != nil {
+		t.Fatal(e)
+	}
+	opts.Days = 0
+	if e := opts.validate(); e == nil || !strings.Contains(e.Error(), "days") {
+		t.Errorf("got %v for 0 days", e)
+	}
+	opts = testOptions(t)
+	opts.MissingTxRate, opts.LateTxRate = 0.6, 0.6
+	if e := opts.validate(); e == nil {
+		t.Error("no error for tx rates adding up to more than 1")
+	}
+}
+
+func TestBusinessDayDates(t *testing.T) {
+	opts := testOptions(t)
+	day, e := util.NewBusinessDay("America/Los_Angeles", "")
+	if e != nil {
+		t.Fatal(e)
+	}
+	opts.Day = day
+	if e = generate(opts); e != nil {
+		t.Fatal(e)
+	}
+	// The activities of the first UTC minutes of the start date are on the previous business day in Los Angeles
+	want := strconv.FormatUint(uint64(day.Date(opts.Start)), 10)
+	tx, e := os.ReadFile(filepath.Join(opts.Out, "1", "tx", "tx.csv"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(tx)), "\n") {
+		if !strings.HasSuffix(line, ","+want) {
+			t.Errorf("got tx %s, want date %s", line, want)
+		}
+	}
+	rates, e := os.ReadFile(filepath.Join(opts.Out, "1", "fx", "rates.csv"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !strings.HasPrefix(string(rates), "2017-02-28,EUR,") {
+		t.Errorf("got rates\n%s", rates)
+	}
+}
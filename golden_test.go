@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"./config"
+	"./store"
+)
+
+var update = flag.Bool("update", false, "update the golden files of the end-to-end scenarios")
+
+// volatile - fields set at processing time, left out of golden files
+var volatile = []string{"_id", "lastmodifiedtime", "processingtime"}
+
+// TestGolden - run each scenario of testdata/golden through the pipeline and compare the stores with its golden files
+//
+// A scenario dir holds numbered step dirs, each with optional epa, tx and fx dirs copied to the pipeline's input dirs
+// before a round, an optional merchants.csv and config.json, and the golden files db-data.json and db-da.json.
+// Scenarios written by the generator command also hold expected-da.json, which the DA must match.
+func TestGolden(t *testing.T) {
+	scenarios, err := ioutil.ReadDir(filepath.Join("testdata", "golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, scenario := range scenarios {
+		if !scenario.IsDir() {
+			continue
+		}
+		dir := filepath.Join("testdata", "golden", scenario.Name())
+		t.Run(scenario.Name(), func(t *testing.T) {
+			cols := newMemoryCollections()
+			runScenario(t, dir, cols)
+			compareGolden(t, filepath.Join(dir, "db-data.json"), map[string]store.Collection{"account": cols.acc, "submission": cols.sub, "transaction": cols.tx, "enrichment": cols.stats, "pending": cols.pending})
+			compareGolden(t, filepath.Join(dir, "db-da.json"), map[string]store.Collection{"account": cols.accDA, "submission": cols.subDA})
+			if _, err := os.Stat(filepath.Join(dir, "expected-da.json")); err == nil {
+				compareExpected(t, filepath.Join(dir, "expected-da.json"), cols)
+			}
+		})
+	}
+}
+
+func newMemoryCollections() (cols collections) {
+	cols.acc = store.NewMemory()
+	cols.accDA = store.NewMemory()
+	cols.sub = store.NewMemory()
+	cols.subDA = store.NewMemory()
+	cols.tx = store.NewMemory()
+	cols.stats = store.NewMemory()
+	cols.pending = store.NewMemory()
+	return
+}
+
+func runScenario(t *testing.T, dir string, cols collections) {
+	var cfg config.ServiceConfig
+	cfg.Routines = 1
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "config.json")); err == nil {
+		if err = json.Unmarshal(data, &cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	work := t.TempDir()
+	cfg.IO.EPADIR = filepath.Join(work, "epa")
+	cfg.IO.TxDIR = filepath.Join(work, "tx")
+	cfg.IO.FxDIR = filepath.Join(work, "fx")
+	cfg.IO.RejectDIR = filepath.Join(work, "rejected")
+	if _, err := os.Stat(filepath.Join(dir, "merchants.csv")); err == nil {
+		cfg.Reference.MerchantFile = filepath.Join(dir, "merchants.csv")
+	}
+	cfg.ApplyDefaults()
+
+	p := newPipeline(cfg, cols)
+	steps, err := filepath.Glob(filepath.Join(dir, "[0-9]*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(steps)
+	for _, step := range steps {
+		for _, input := range []string{"epa", "tx", "fx"} {
+			copyDir(t, filepath.Join(step, input), filepath.Join(work, input))
+		}
+		p.run()
+	}
+}
+
+func copyDir(t *testing.T, src string, dst string) {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(filepath.Join(src, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(dst, f.Name()), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// dump - documents of each collection without volatile fields, in a stable order
+func dump(cols map[string]store.Collection) ([]byte, error) {
+	result := make(map[string][]json.RawMessage)
+	for name, col := range cols {
+		var docs []bson.M
+		if err := col.Find(nil).All(&docs); err != nil {
+			return nil, err
+		}
+		encoded := []json.RawMessage{}
+		for _, doc := range docs {
+			for _, field := range volatile {
+				delete(doc, field)
+			}
+			for k, v := range doc {
+				if tm, ok := v.(time.Time); ok {
+					doc[k] = tm.UTC()
+				}
+			}
+			data, err := json.Marshal(doc)
+			if err != nil {
+				return nil, err
+			}
+			encoded = append(encoded, data)
+		}
+		sort.Slice(encoded, func(i, j int) bool { return bytes.Compare(encoded[i], encoded[j]) < 0 })
+		result[name] = encoded
+	}
+	data, err := json.MarshalIndent(result, "", "  ")
+	return append(data, '\n'), err
+}
+
+func compareGolden(t *testing.T, file string, cols map[string]store.Collection) {
+	got, err := dump(cols)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *update {
+		if err = ioutil.WriteFile(file, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("%v, run go test -update to create it", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the golden file, run go test -update to accept\ngot:\n%s", file, got)
+	}
+}
+
+// expectedDA - the fields of a DA record the generator predicts
+type expectedDA struct {
+	Kind                    string
+	BatchName               string
+	AdviceProvider          string
+	VersionNumber           uint32
+	ActivityType            string
+	Time                    time.Time
+	MerchantID              string
+	Currency                string
+	Amount                  float32
+	MerchantReferenceNumber string `json:",omitempty"`
+	InternalMRN             string `json:",omitempty"`
+}
+
+func compareExpected(t *testing.T, file string, cols collections) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var da expectedDA
+		if err = json.Unmarshal(line, &da); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, da.String())
+	}
+
+	var got []string
+	for kind, col := range map[string]store.Collection{"aac": cols.accDA, "sac": cols.subDA} {
+		var docs []expectedDA
+		if err = col.Find(nil).All(&docs); err != nil {
+			t.Fatal(err)
+		}
+		for _, da := range docs {
+			da.Kind = kind
+			got = append(got, da.String())
+		}
+	}
+	sort.Strings(want)
+	sort.Strings(got)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("DA differs from %s\ngot:\n%s\nwant:\n%s", file, strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func (da expectedDA) String() string {
+	return fmt.Sprintf("%s %s %s v%d %s %s %s %s %s %v %s", da.Kind, da.BatchName, da.AdviceProvider, da.VersionNumber, da.MerchantReferenceNumber, da.ActivityType, da.Time.UTC().Format(time.RFC3339), da.MerchantID, da.Currency, da.Amount, da.InternalMRN)
+}
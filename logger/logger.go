@@ -0,0 +1,318 @@
+package logger
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level - severity of a log entry, a slog.Level
+type Level int
+
+// Levels of log entries, entries below the level of a logger are dropped
+const (
+	LevelDebug = Level(slog.LevelDebug)
+	LevelInfo  = Level(slog.LevelInfo)
+	LevelWarn  = Level(slog.LevelWarn)
+	LevelError = Level(slog.LevelError)
+)
+
+// levels - levels accepted by ParseLevel
+var levels = []Level{LevelDebug, LevelInfo, LevelWarn, LevelError}
+
+func (level Level) String() string {
+	return strings.ToLower(slog.Level(level).String())
+}
+
+// ParseLevel - the level of a name, case insensitive
+func ParseLevel(name string) (Level, error) {
+	names := make([]string, len(levels))
+	for i, level := range levels {
+		if strings.EqualFold(level.String(), name) {
+			return level, nil
+		}
+		names[i] = level.String()
+	}
+	return LevelInfo, errors.New("unknown log level " + strconv.Quote(name) + ", expected one of " + strings.Join(names, ", "))
+}
+
+// Formats of log entries
+const (
+	// FormatLogfmt - one line of key=value pairs per entry
+	FormatLogfmt = "logfmt"
+	// FormatJSON - one JSON object per entry
+	FormatJSON = "json"
+)
+
+// Formats - formats accepted by Configure, the first is the default
+var Formats = []string{FormatLogfmt, FormatJSON}
+
+// Outputs of Configure besides file paths
+const (
+	OutputStderr = "stderr"
+	OutputStdout = "stdout"
+)
+
+// Keys of the fields every entry starts with, and of the fields used across the service
+const (
+	KeyTime      = slog.TimeKey
+	KeyLevel     = slog.LevelKey
+	KeyMessage   = slog.MessageKey
+	KeyError     = "error"
+	KeyShard     = "shard"
+	KeyFile      = "file"
+	KeyBatchName = "batchname"
+	KeyProvider  = "provider"
+	KeyVersion   = "version"
+	KeyCount     = "count"
+)
+
+// sink - output shared by a logger and the loggers derived from it, so reconfiguring applies to all of them
+type sink struct {
+	mutex sync.Mutex
+	// handler - slog text or JSON handler writing to the output
+	handler slog.Handler
+	// generation - incremented when Configure replaces the handler
+	generation int
+	level      slog.LevelVar
+	out        io.Writer
+	// file - the output file opened by Configure, closed when the output changes
+	file     *os.File
+	filename string
+	// now - clock of the entry times, replaced by tests
+	now func() time.Time
+}
+
+// newHandler - slog handler writing entries of the format to out
+func newHandler(out io.Writer, format string, level slog.Leveler) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: replaceAttr}
+	if format == FormatJSON {
+		return slog.NewJSONHandler(out, opts)
+	}
+	return slog.NewTextHandler(out, opts)
+}
+
+// replaceAttr - write levels in lower case, and times in UTC and durations as text in both formats
+func replaceAttr(groups []string, a slog.Attr) slog.Attr {
+	switch a.Value.Kind() {
+	case slog.KindTime:
+		return slog.String(a.Key, a.Value.Time().UTC().Format(time.RFC3339Nano))
+	case slog.KindDuration:
+		return slog.String(a.Key, a.Value.Duration().String())
+	}
+	if level, ok := a.Value.Any().(slog.Level); ok && len(groups) == 0 && a.Key == slog.LevelKey {
+		return slog.String(a.Key, Level(level).String())
+	}
+	return a
+}
+
+// handler - slog.Handler writing to the current handler of a sink with the attributes and groups of a logger
+type handler struct {
+	sink *sink
+	// with - WithAttrs and WithGroup calls applied to the handler of the sink
+	with []func(slog.Handler) slog.Handler
+	// derived - the handler of the sink with the calls applied, rebuilt when its generation changes
+	derived    slog.Handler
+	generation int
+}
+
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.sink.level.Level()
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	s := h.sink
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if h.derived == nil || h.generation != s.generation {
+		h.derived = s.handler
+		for _, with := range h.with {
+			h.derived = with(h.derived)
+		}
+		h.generation = s.generation
+	}
+	return h.derived.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.extend(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.extend(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+// extend - a handler of the sink with another call
+func (h *handler) extend(with func(slog.Handler) slog.Handler) *handler {
+	all := make([]func(slog.Handler) slog.Handler, 0, len(h.with)+1)
+	return &handler{sink: h.sink, with: append(append(all, h.with...), with)}
+}
+
+// Logger - leveled logger writing entries with the fields of the logger followed by the fields of the entry
+type Logger struct {
+	handler *handler
+}
+
+// New - create a logger writing entries at or above the level to out in the format
+func New(out io.Writer, level Level, format string) *Logger {
+	s := &sink{out: out, now: time.Now}
+	s.level.Set(slog.Level(level))
+	s.handler = newHandler(out, format, &s.level)
+	return &Logger{handler: &handler{sink: s}}
+}
+
+// std - the logger of the package functions
+var std = New(os.Stderr, LevelInfo, FormatLogfmt)
+
+// Default - the logger of the package functions
+func Default() *Logger {
+	return std
+}
+
+// Configure - set the level, format and output of the default logger and the loggers derived from it; the output is
+// stderr, stdout or a file which entries are appended to
+func Configure(level string, format string, output string) error {
+	l, e := ParseLevel(level)
+	if e != nil {
+		return e
+	}
+	format = strings.ToLower(format)
+	if !validFormat(format) {
+		return errors.New("unknown log format " + strconv.Quote(format) + ", expected one of " + strings.Join(Formats, ", "))
+	}
+	s := std.handler.sink
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if output != s.filename {
+		var out io.Writer
+		var file *os.File
+		switch output {
+		case "", OutputStderr:
+			out = os.Stderr
+		case OutputStdout:
+			out = os.Stdout
+		default:
+			if file, e = os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); e != nil {
+				return e
+			}
+			out = file
+		}
+		if s.file != nil {
+			s.file.Close()
+		}
+		s.out, s.file, s.filename = out, file, output
+	}
+	s.level.Set(slog.Level(l))
+	s.handler = newHandler(s.out, format, &s.level)
+	s.generation++
+	return nil
+}
+
+// validFormat - the format is one of Formats, empty for the default
+func validFormat(format string) bool {
+	if len(format) == 0 {
+		return true
+	}
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler - the slog.Handler of the logger, e.g. for slog.New
+func (l *Logger) Handler() slog.Handler {
+	return l.handler
+}
+
+// With - a logger adding the key value pairs to each entry
+func (l *Logger) With(fields ...interface{}) *Logger {
+	// A record turns the pairs into attributes like slog.Logger.With, a value without a key gets a placeholder key
+	var r slog.Record
+	r.Add(fields...)
+	attrs := make([]slog.Attr, 0, r.NumAttrs())
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	return &Logger{handler: l.handler.WithAttrs(attrs).(*handler)}
+}
+
+// Enabled - entries of the level are written
+func (l *Logger) Enabled(level Level) bool {
+	return l.handler.Enabled(context.Background(), slog.Level(level))
+}
+
+// Debug - write a debug entry with the key value pairs
+func (l *Logger) Debug(msg string, fields ...interface{}) {
+	l.write(LevelDebug, msg, fields)
+}
+
+// Info - write an info entry with the key value pairs
+func (l *Logger) Info(msg string, fields ...interface{}) {
+	l.write(LevelInfo, msg, fields)
+}
+
+// Warn - write a warning entry with the key value pairs
+func (l *Logger) Warn(msg string, fields ...interface{}) {
+	l.write(LevelWarn, msg, fields)
+}
+
+// Error - write an error entry with the key value pairs
+func (l *Logger) Error(msg string, fields ...interface{}) {
+	l.write(LevelError, msg, fields)
+}
+
+// Fatal - write an error entry with the key value pairs and exit with status 1
+func (l *Logger) Fatal(msg string, fields ...interface{}) {
+	l.write(LevelError, msg, fields)
+	os.Exit(1)
+}
+
+// write - hand an entry with the key value pairs to the handler if its level is enabled
+func (l *Logger) write(level Level, msg string, fields []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	r := slog.NewRecord(l.handler.sink.now(), slog.Level(level), msg, 0)
+	r.Add(fields...)
+	l.handler.Handle(context.Background(), r)
+}
+
+// With - a logger adding the key value pairs to the entries of the default logger
+func With(fields ...interface{}) *Logger {
+	return std.With(fields...)
+}
+
+// Debug - write a debug entry with the default logger
+func Debug(msg string, fields ...interface{}) {
+	std.write(LevelDebug, msg, fields)
+}
+
+// Info - write an info entry with the default logger
+func Info(msg string, fields ...interface{}) {
+	std.write(LevelInfo, msg, fields)
+}
+
+// Warn - write a warning entry with the default logger
+func Warn(msg string, fields ...interface{}) {
+	std.write(LevelWarn, msg, fields)
+}
+
+// Error - write an error entry with the default logger
+func Error(msg string, fields ...interface{}) {
+	std.write(LevelError, msg, fields)
+}
+
+// Fatal - write an error entry with the default logger and exit with status 1
+func Fatal(msg string, fields ...interface{}) {
+	std.write(LevelError, msg, fields)
+	os.Exit(1)
+}
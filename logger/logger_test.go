@@ -0,0 +1,95 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestLogger - logger with a fixed clock writing to a buffer
+func newTestLogger(level Level, format string) (*Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	l := New(&buf, level, format)
+	l.handler.sink.now = func() time.Time { return time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC) }
+	return l, &buf
+}
+
+func TestLogfmt(t *testing.T) {
+	l, buf := newTestLogger(LevelInfo, FormatLogfmt)
+	shard := l.With(KeyShard, 1)
+	shard.Info("Loaded file", KeyFile, "1001.sac", KeyCount, 3)
+	shard.Warn("Skipped line", KeyError, errors.New(`bad "time"`), "elapsed", 1500*time.Millisecond, "empty", "")
+	shard.Debug("Dropped")
+	want := `time=2017-03-01T10:00:00Z level=info msg="Loaded file" shard=1 file=1001.sac count=3` + "\n" +
+		`time=2017-03-01T10:00:00Z level=warn msg="Skipped line" shard=1 error="bad \"time\"" elapsed=1.5s empty=""` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	l, buf := newTestLogger(LevelDebug, FormatJSON)
+	l.With(KeyBatchName, "1001", KeyProvider, "Paypal").Debug("Enriched", KeyVersion, uint32(2), "matched", 5, "odd")
+	want := `{"time":"2017-03-01T10:00:00Z","level":"debug","msg":"Enriched","batchname":"1001","provider":"Paypal","version":2,"matched":5,"!BADKEY":"odd"}`
+	got := strings.TrimSuffix(buf.String(), "\n")
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if !json.Valid([]byte(got)) {
+		t.Error("invalid JSON")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	l, buf := newTestLogger(LevelInfo, FormatJSON)
+	// Entries of slog loggers on the handler have the fields of the logger
+	s := slog.New(l.With(KeyShard, 1).Handler()).WithGroup("batch")
+	s.Info("Loaded", KeyCount, 3)
+	s.Debug("Dropped")
+	got := strings.TrimSuffix(buf.String(), "\n")
+	if want := `"level":"info","msg":"Loaded","shard":1,"batch":{"count":3}}`; !strings.HasSuffix(got, want) {
+		t.Errorf("got\n%s\nwant suffix\n%s", got, want)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	if level, err := ParseLevel("WARN"); err != nil || level != LevelWarn {
+		t.Errorf("got %v, %v", level, err)
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("no error for an unknown level")
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	defer Configure("info", FormatLogfmt, OutputStderr)
+	file := filepath.Join(t.TempDir(), "dagen.log")
+	child := With(KeyShard, 0)
+	if err := Configure("warn", FormatJSON, file); err != nil {
+		t.Fatal(err)
+	}
+	// Loggers derived before the change follow the new settings
+	child.Info("Dropped")
+	child.Error("Failed")
+	if err := Configure("info", FormatLogfmt, OutputStderr); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], `"msg":"Failed","shard":0`) {
+		t.Errorf("got %q", content)
+	}
+
+	if err := Configure("info", "xml", OutputStderr); err == nil {
+		t.Error("no error for an unknown format")
+	}
+}
@@ -0,0 +1,124 @@
+package merchant
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Merchant - merchant reference data
+type Merchant struct {
+	MerchantID    string
+	LegalEntity   string
+	Country       string
+	LocalCurrency string
+	Region        string
+}
+
+// Master - merchant master loaded from a reference file
+type Master struct {
+	file       string
+	interval   time.Duration
+	merchants  map[string]Merchant
+	modTime    time.Time
+	lastReload time.Time
+	mutex      *sync.RWMutex
+}
+
+// New - create a merchant master for a reference file, reloaded at most once per interval
+func New(file string, interval time.Duration) *Master {
+	var master Master
+	master.file = file
+	master.interval = interval
+	master.merchants = make(map[string]Merchant)
+	master.mutex = &sync.RWMutex{}
+	return &master
+}
+
+// Get - get the reference data of a merchant
+func (master *Master) Get(merchantID string) (m Merchant, ok bool) {
+	master.mutex.RLock()
+	defer master.mutex.RUnlock()
+	m, ok = master.merchants[merchantID]
+	return
+}
+
+// Count - number of merchants loaded
+func (master *Master) Count() int {
+	master.mutex.RLock()
+	defer master.mutex.RUnlock()
+	return len(master.merchants)
+}
+
+// Reload - reload the reference file if the interval has elapsed and the file has changed
+func (master *Master) Reload() (reloaded bool, e error) {
+	if len(master.file) == 0 || time.Since(master.lastReload) < master.interval {
+		return
+	}
+	master.lastReload = time.Now()
+	info, e := os.Stat(master.file)
+	if e != nil {
+		return
+	}
+	if !info.ModTime().After(master.modTime) {
+		return
+	}
+	merchants, e := loadFile(master.file)
+	if e != nil {
+		return
+	}
+	master.mutex.Lock()
+	master.merchants = merchants
+	master.modTime = info.ModTime()
+	master.mutex.Unlock()
+	reloaded = true
+	return
+}
+
+// loadFile - read records of MerchantId,LegalEntity,Country,LocalCurrency,Region, or MerchantId,Currency records of
+// the merchant currency files used before the merchant master
+func loadFile(file string) (merchants map[string]Merchant, e error) {
+	f, e := os.Open(file)
+	if e != nil {
+		return
+	}
+	defer f.Close()
+	r := csv.NewReader(bufio.NewReader(f))
+	r.FieldsPerRecord = -1
+	merchants = make(map[string]Merchant)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) != 5 && len(record) != 2 {
+			return nil, errors.New("expected 5 fields, or 2 of a merchant currency file, got " + strconv.Itoa(len(record)))
+		}
+		id := strings.TrimSpace(record[0])
+		// Skip header
+		if id == "MerchantId" {
+			continue
+		}
+		if len(record) == 2 {
+			merchants[id] = Merchant{MerchantID: id, LocalCurrency: strings.ToUpper(strings.TrimSpace(record[1]))}
+			continue
+		}
+		merchants[id] = Merchant{
+			MerchantID:    id,
+			LegalEntity:   strings.TrimSpace(record[1]),
+			Country:       strings.ToUpper(strings.TrimSpace(record[2])),
+			LocalCurrency: strings.ToUpper(strings.TrimSpace(record[3])),
+			Region:        strings.TrimSpace(record[4]),
+		}
+	}
+	return
+}
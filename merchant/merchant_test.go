@@ -0,0 +1,98 @@
+package merchant
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeMerchants - write a reference file with the lines and a modification time
+func writeMerchants(t *testing.T, file string, modTime time.Time, lines ...string) {
+	t.Helper()
+	if e := os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	os.Chtimes(file, modTime, modTime)
+}
+
+func TestReloadAndGet(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "merchants.csv")
+	now := time.Now()
+	writeMerchants(t, file, now.Add(-time.Hour),
+		"MerchantId,LegalEntity,Country,LocalCurrency,Region",
+		"M1, Acme GmbH ,de,eur,EMEA")
+	master := New(file, 0)
+	if reloaded, err := master.Reload(); !reloaded || err != nil {
+		t.Fatalf("got %v, %v", reloaded, err)
+	}
+	m, ok := master.Get("M1")
+	if want := (Merchant{MerchantID: "M1", LegalEntity: "Acme GmbH", Country: "DE", LocalCurrency: "EUR", Region: "EMEA"}); !ok || m != want {
+		t.Errorf("got %+v, want %+v", m, want)
+	}
+	if _, ok = master.Get("MerchantId"); ok || master.Count() != 1 {
+		t.Errorf("header loaded as a merchant, count %d", master.Count())
+	}
+
+	// An unchanged file is not reloaded, a changed one replaces the merchants
+	if reloaded, _ := master.Reload(); reloaded {
+		t.Error("reloaded an unchanged file")
+	}
+	writeMerchants(t, file, now, "M2,Acme Inc,US,USD,AMER")
+	if reloaded, _ := master.Reload(); !reloaded || master.Count() != 1 {
+		t.Fatalf("got %v with %d merchants", reloaded, master.Count())
+	}
+	if _, ok = master.Get("M1"); ok {
+		t.Error("merchant of the previous file kept")
+	}
+}
+
+func TestReloadInterval(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "merchants.csv")
+	writeMerchants(t, file, time.Now().Add(-time.Hour), "M1,Acme GmbH,DE,EUR,EMEA")
+	master := New(file, time.Hour)
+	master.Reload()
+	writeMerchants(t, file, time.Now(), "M2,Acme Inc,US,USD,AMER")
+	if reloaded, _ := master.Reload(); reloaded {
+		t.Error("reloaded before the interval elapsed")
+	}
+	if _, ok := master.Get("M1"); !ok {
+		t.Error("merchants lost")
+	}
+}
+
+func TestReloadErrors(t *testing.T) {
+	dir := t.TempDir()
+	if reloaded, err := New("", 0).Reload(); reloaded || err != nil {
+		t.Errorf("got %v, %v without a file", reloaded, err)
+	}
+	if _, err := New(filepath.Join(dir, "missing.csv"), 0).Reload(); err == nil {
+		t.Error("no error for a missing file")
+	}
+
+	// A malformed file keeps the loaded merchants
+	file := filepath.Join(dir, "merchants.csv")
+	writeMerchants(t, file, time.Now().Add(-time.Hour), "M1,Acme GmbH,DE,EUR,EMEA")
+	master := New(file, 0)
+	master.Reload()
+	writeMerchants(t, file, time.Now(), "M2,Acme Inc,US")
+	if reloaded, err := master.Reload(); reloaded || err == nil {
+		t.Errorf("got %v, %v for a malformed file", reloaded, err)
+	}
+	if _, ok := master.Get("M1"); !ok {
+		t.Error("merchants lost")
+	}
+}
+
+func TestMerchantCurrencyFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "merchant_currency.csv")
+	writeMerchants(t, file, time.Now(), "M1,eur", "M2,GBP")
+	master := New(file, 0)
+	if _, err := master.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := master.Get("M1"); !ok || m.LocalCurrency != "EUR" || m.LegalEntity != "" {
+		t.Errorf("got %+v", m)
+	}
+}
@@ -5,7 +5,8 @@ package model
 import (
 	"time"
 
-	mgo "gopkg.in/mgo.v2"
+	"../logger"
+	"../store"
 )
 
 // IActivity - Data activity
@@ -28,16 +29,28 @@ type IActivity interface {
 
 // IActivityBatch - Activity batch
 type IActivityBatch interface {
-	LoadDataFile(file string) int
+	LoadDataFile(file string) (int, error)
 	Count() int
 	Clear()
 	GetKeys() (string, string, uint32)
-	GetAndCompareLastBatch(string, string, uint32, uint32, *mgo.Collection, *mgo.Collection)
-	LoadAdditionalProperties(*mgo.Collection)
-	InsertToStore(*mgo.Collection)
+	GetAndCompareLastBatch(string, string, uint32, uint32, store.Collection, store.Collection)
+	LoadAdditionalProperties(store.Collection)
+	InsertToStore(store.Collection)
+	TrackEnrichment(store.Collection, store.Collection)
 }
 
 // IActivityOperation - operations for IActivity
 type IActivityOperation interface {
-	GetLastVersion(*mgo.Query) uint32
+	GetLastVersion(store.Query) uint32
+}
+
+// batchKeys - batch identified by its name, provider and version
+type batchKeys interface {
+	GetKeys() (string, string, uint32)
+}
+
+// batchLogger - logger adding the keys of the batch to its entries
+func batchLogger(batch batchKeys) *logger.Logger {
+	batchname, provider, version := batch.GetKeys()
+	return logger.With(logger.KeyBatchName, batchname, logger.KeyProvider, provider, logger.KeyVersion, version)
 }
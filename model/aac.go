@@ -1,17 +1,18 @@
 package model
 
 import (
-	"bufio"
-	"encoding/json"
-	"log"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
-	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
 	"../common"
+	"../fx"
+	"../logger"
+	"../merchant"
+	"../store"
 )
 
 // AAC file syntax
@@ -42,11 +43,32 @@ type AccountActivity struct {
 	Amount           float32
 	DownloadedTime   time.Time
 	LastModifiedTime time.Time
+	LegalEntity      string
+	Country          string
+	Region           string
+	LocalCurrency    string
+	GroupCurrency    string
+	LocalRate        float32
+	GroupRate        float32
+	// Unconverted - a rate was missing at activity time, so LocAmount and GrpAmount are 0 rather than converted
+	Unconverted bool
+	// ID - _id of the document, set by the writer on each insert
+	ID bson.ObjectId `bson:"_id,omitempty"`
 }
 
 // AccountActivityBatch - slice of AccountActivity
 type AccountActivityBatch struct {
-	Batch map[uint32]AccountActivity
+	Batch     map[uint32]AccountActivity
+	Rates     *fx.RateTable
+	Merchants *merchant.Master
+	// StreamThreshold - batches with at least this many records are compared by streaming both versions from the store, 0 to disable
+	StreamThreshold int
+	// Writes - bulk writes of records and DA
+	Writes store.WriteConfig
+	// Profiles - advice conventions by provider, the built-in profile applies if nil
+	Profiles *util.ProfileRegistry
+	// BusinessDay - calendar of the dates of FX rates, UTC days if nil
+	BusinessDay *util.BusinessDay
 }
 
 // AccountActivityOperation - operations for AccountActivity
@@ -54,48 +76,65 @@ type AccountActivityOperation struct {
 }
 
 // GetLastVersion - get last version for the key
-func (op AccountActivityOperation) GetLastVersion(query *mgo.Query) uint32 {
+func (op AccountActivityOperation) GetLastVersion(query store.Query) uint32 {
 	var last AccountActivity
 	err := query.One(&last)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal("Failed to read last version", logger.KeyError, err)
 	}
 	return last.VersionNumber
 }
 
 // InsertToStore - insert records to store
-func (batch AccountActivityBatch) InsertToStore(col *mgo.Collection) {
+func (batch AccountActivityBatch) InsertToStore(col store.Collection) {
+	w := store.NewWriter(col, batch.Writes)
 	for _, v := range batch.Batch {
-		err := col.Insert(&v)
+		// The writer keeps the document until it flushes, so each needs its own copy
+		v := v
+		err := w.Insert(&v)
 		if err != nil {
-			log.Fatal(err)
+			batchLogger(batch).Fatal("Failed to write activities", logger.KeyError, err)
 		}
 	}
+	if err := w.Flush(); err != nil {
+		batchLogger(batch).Fatal("Failed to write activities", logger.KeyError, err)
+	}
+}
+
+func (batch *AccountActivityBatch) LoadAdditionalProperties(col store.Collection) {
+	// Place holder
 }
 
-func (batch *AccountActivityBatch) LoadAdditionalProperties(col *mgo.Collection) {
+// TrackEnrichment - account activities are not enriched
+func (batch AccountActivityBatch) TrackEnrichment(cStats store.Collection, cPending store.Collection) {
 	// Place holder
 }
 
 // GetAndCompareLastBatch - get and compare last batch with current batch
-func (batch *AccountActivityBatch) GetAndCompareLastBatch(batchid string, provider string, version uint32, lastVer uint32, cData *mgo.Collection, cDA *mgo.Collection) {
+func (batch *AccountActivityBatch) GetAndCompareLastBatch(batchid string, provider string, version uint32, lastVer uint32, cData store.Collection, cDA store.Collection) {
+	if batch.StreamThreshold > 0 && len(batch.Batch) >= batch.StreamThreshold {
+		batch.streamCompareLastBatch(batchid, provider, version, lastVer, cData, cDA)
+		return
+	}
 	now := time.Now().UTC()
+	w := store.NewWriter(cDA, batch.Writes)
 	var lastRecords []AccountActivity
 	err := cData.Find(bson.M{"batchname": batchid, "adviceprovider": provider, "versionnumber": lastVer}).All(&lastRecords)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal("Failed to read last version", logger.KeyBatchName, batchid, logger.KeyProvider, provider, logger.KeyVersion, lastVer, logger.KeyError, err)
 	}
 
-	for _, o := range lastRecords {
+	for i := range lastRecords {
+		o := &lastRecords[i]
 		hash := o.GetHashCode()
 		// If record with same key exists
 		if v, ok := batch.Batch[hash]; ok {
 			diff := v.DocAmount() - o.DocAmount()
 			if diff != 0 {
 				v.SetDocAmount(diff)
-				err = cDA.Insert(&v)
+				err = w.Insert(&v)
 				if err != nil {
-					log.Fatal(err)
+					logger.Fatal("Failed to write DA", logger.KeyBatchName, batchid, logger.KeyProvider, provider, logger.KeyVersion, version, logger.KeyError, err)
 				}
 			}
 			delete(batch.Batch, hash)
@@ -103,12 +142,54 @@ func (batch *AccountActivityBatch) GetAndCompareLastBatch(batchid string, provid
 			// If record has been removed
 			o.SetDocAmount(-o.DocAmount())
 			o.SetProcessingTime(now)
-			err = cDA.Insert(&o)
+			err = w.Insert(o)
 			if err != nil {
-				log.Fatal(err)
+				logger.Fatal("Failed to write DA", logger.KeyBatchName, batchid, logger.KeyProvider, provider, logger.KeyVersion, version, logger.KeyError, err)
 			}
 		}
 	}
+	if err = w.Flush(); err != nil {
+		logger.Fatal("Failed to write DA", logger.KeyBatchName, batchid, logger.KeyProvider, provider, logger.KeyVersion, version, logger.KeyError, err)
+	}
+}
+
+// streamCompareLastBatch - compare the last and current versions stored in data store in key order and add DA for
+// changed, removed and added records; the batch is left empty as all DA is added
+//
+// The loaded batch is released before the compare, which then holds a run of records sharing the key up to the
+// time second of each version and the pending DA writes. Loading the file still holds the whole batch, once.
+func (batch *AccountActivityBatch) streamCompareLastBatch(batchid string, provider string, version uint32, lastVer uint32, cData store.Collection, cDA store.Collection) {
+	now := time.Now().UTC()
+	w := store.NewWriter(cDA, batch.Writes)
+	insert := func(act *AccountActivity) {
+		if err := w.Insert(act); err != nil {
+			logger.Fatal("Failed to write DA", logger.KeyBatchName, batchid, logger.KeyProvider, provider, logger.KeyVersion, version, logger.KeyError, err)
+		}
+	}
+	// The current version is stored, its records are read back in key order
+	batch.Batch = make(map[uint32]AccountActivity)
+	err := mergeVersions(versionIter(cData, batchid, provider, lastVer, aacKeyFields), versionIter(cData, batchid, provider, version, aacKeyFields), compareAccountRuns, compareAccountActivities,
+		func(o *AccountActivity, v *AccountActivity) {
+			// If record with same key exists
+			diff := v.DocAmount() - o.DocAmount()
+			if diff != 0 {
+				v.SetDocAmount(diff)
+				insert(v)
+			}
+		},
+		func(o *AccountActivity) {
+			// If record has been removed
+			o.SetDocAmount(-o.DocAmount())
+			o.SetProcessingTime(now)
+			insert(o)
+		},
+		insert)
+	if err != nil {
+		logger.Fatal("Failed to compare versions", logger.KeyBatchName, batchid, logger.KeyProvider, provider, logger.KeyVersion, version, logger.KeyError, err)
+	}
+	if err = w.Flush(); err != nil {
+		logger.Fatal("Failed to write DA", logger.KeyBatchName, batchid, logger.KeyProvider, provider, logger.KeyVersion, version, logger.KeyError, err)
+	}
 }
 
 // Count - get length of map
@@ -148,23 +229,91 @@ func (act *AccountActivity) GetHashCode() uint32 {
 }
 
 // LoadData - converts AAC to AccountActivity
-func (act *AccountActivity) LoadData(aac AAC) {
+func (act *AccountActivity) LoadData(aac AAC) (e error) {
 	act.BatchName = aac.AdviceFileName
 	act.AdviceProvider = aac.AdviceProvider
 	act.VersionNumber = aac.Version
 	act.ActivityType = aac.ActivityType
-	if len(aac.ActivityTime) > 0 {
-		act.Time = util.ParseTime(aac.ActivityTime)
-	} else {
-		act.Time = util.ParseTime(aac.DownloadedTime)
-	}
 	act.MerchantID = aac.MerchantID
 	act.Currency = aac.Currency
 	act.Amount = aac.Amount
-	act.DownloadedTime = util.ParseTime(aac.DownloadedTime)
+	if act.DownloadedTime, e = util.ParseTime(aac.DownloadedTime); e != nil {
+		return
+	}
+	act.Time = act.DownloadedTime
+	if len(aac.ActivityTime) > 0 {
+		if act.Time, e = util.ParseTime(aac.ActivityTime); e != nil {
+			return
+		}
+	}
 	act.LastModifiedTime = time.Now().UTC()
+	return
 }
 
+// decode - converts the AAC on the current line of the decoder to AccountActivity
+func (act *AccountActivity) decode(d *adviceDecoder) error {
+	var times adviceTimes
+	e := d.Fields(func(key []byte, value []byte) error {
+		ok, e := act.setField(d, string(key), value, &times)
+		if !ok && e == nil {
+			// Keys match the syntax case-insensitively, like encoding/json
+			if name, found := aacFieldNames[strings.ToLower(string(key))]; found {
+				_, e = act.setField(d, name, value, &times)
+			}
+		}
+		return e
+	})
+	if e != nil {
+		return e
+	}
+	profile := d.Profile(act.AdviceProvider)
+	if act.DownloadedTime, e = d.ParseTime(times.downloaded); e != nil {
+		return e
+	}
+	act.Time = act.DownloadedTime
+	if len(times.activity) > 0 {
+		if act.Time, e = profile.ParseTime(times.activity); e != nil {
+			return e
+		}
+	}
+	act.Amount = profile.ProviderAmount(act.Amount)
+	act.LastModifiedTime = time.Now().UTC()
+	return nil
+}
+
+// setField - set the field of a key of the AAC syntax, ok is false for unknown keys
+func (act *AccountActivity) setField(d *adviceDecoder, key string, value []byte, times *adviceTimes) (ok bool, e error) {
+	ok = true
+	switch key {
+	case "AdviceFileName":
+		act.BatchName = d.String(value)
+	case "AdviceProvider":
+		act.AdviceProvider = d.String(value)
+	case "Version":
+		act.VersionNumber, e = parseVersion(value)
+	case "AccountActivityType":
+		act.ActivityType = d.String(value)
+	case "DownloadedTime":
+		times.downloaded = d.String(value)
+	case "TimeStamp":
+		times.activity = string(value)
+	case "MerchantId":
+		act.MerchantID = d.String(value)
+	case "Currency":
+		act.Currency = d.String(value)
+	case "Amount":
+		act.Amount, e = parseAmount(value)
+	case "CorrelationId", "AdditionalData", "RecordId":
+		// Not used
+	default:
+		ok = false
+	}
+	return
+}
+
+// aacFieldNames - decoded AAC keys by their lower case
+var aacFieldNames = map[string]string{"advicefilename": "AdviceFileName", "adviceprovider": "AdviceProvider", "version": "Version", "accountactivitytype": "AccountActivityType", "downloadedtime": "DownloadedTime", "timestamp": "TimeStamp", "merchantid": "MerchantId", "currency": "Currency", "amount": "Amount"}
+
 // BatchID - get file name or batch name
 func (act AccountActivity) BatchID() string {
 	return act.BatchName
@@ -202,14 +351,12 @@ func (act *AccountActivity) SetDocAmount(amount float32) {
 
 // LocAmount - amount in local currency
 func (act AccountActivity) LocAmount() float32 {
-	// To do
-	return 0
+	return act.Amount * act.LocalRate
 }
 
 // GrpAmount - amount in group currency
 func (act AccountActivity) GrpAmount() float32 {
-	// To do
-	return 0
+	return act.Amount * act.GroupRate
 }
 
 // DocCurrency - document currency
@@ -219,12 +366,39 @@ func (act AccountActivity) DocCurrency() string {
 
 // LocCurrency - local currency
 func (act AccountActivity) LocCurrency() string {
-	return act.Currency
+	if len(act.LocalCurrency) == 0 {
+		return act.Currency
+	}
+	return act.LocalCurrency
 }
 
 // GrpCurrency - group currency
 func (act AccountActivity) GrpCurrency() string {
-	return "USD"
+	if len(act.GroupCurrency) == 0 {
+		return util.DefaultGroupCurrency
+	}
+	return act.GroupCurrency
+}
+
+// LoadMerchant - enrich with merchant reference data
+func (act *AccountActivity) LoadMerchant(master *merchant.Master) {
+	if m, ok := master.Get(act.MerchantID); ok {
+		act.LegalEntity = m.LegalEntity
+		act.Country = m.Country
+		act.Region = m.Region
+		act.LocalCurrency = m.LocalCurrency
+	}
+}
+
+// ConvertCurrency - set group currency and the rates of the business day of the activity, false if a rate is missing
+func (act *AccountActivity) ConvertCurrency(rates *fx.RateTable, day *util.BusinessDay) bool {
+	date := day.Date(act.Time)
+	act.GroupCurrency = rates.GroupCurrency
+	var localOK, groupOK bool
+	act.LocalRate, localOK = rates.Rate(date, act.Currency, act.LocCurrency())
+	act.GroupRate, groupOK = rates.Rate(date, act.Currency, act.GroupCurrency)
+	act.Unconverted = !localOK || !groupOK
+	return !act.Unconverted
 }
 
 // Type - type of underling activity
@@ -237,31 +411,52 @@ func (act AccountActivity) ProcessingTime() time.Time {
 	return act.LastModifiedTime
 }
 
+// SetID - set the _id of the document
+func (act *AccountActivity) SetID(id bson.ObjectId) {
+	act.ID = id
+}
+
 // SetProcessingTime - set last modified time
 func (act *AccountActivity) SetProcessingTime(time time.Time) {
 	act.LastModifiedTime = time
 }
 
-// LoadDataFile - loads AAC file into data model
-func (batch *AccountActivityBatch) LoadDataFile(filename string) (count int) {
+// LoadDataFile - loads AAC file into data model, a line which cannot be decoded fails the file with a LineError
+func (batch *AccountActivityBatch) LoadDataFile(filename string) (count int, e error) {
 	file, e := os.Open(filename)
 	if e != nil {
-		log.Fatal("File error:" + e.Error())
-		os.Exit(3)
+		return 0, e
 	}
 	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		buffer := scanner.Bytes()
-		var aac AAC
-		json.Unmarshal(buffer, &aac)
+	decoder := newAdviceDecoder(file)
+	decoder.profiles = batch.Profiles
+	unconverted := 0
+	for decoder.Next() {
 		var activity AccountActivity
-		activity.LoadData(aac)
+		if err := activity.decode(decoder); err != nil {
+			// A skipped record would be compared as removed and reversed, so the file is not loaded at all
+			batch.Clear()
+			return 0, &LineError{File: filename, Line: decoder.lineNo, Err: err}
+		}
+		if batch.Merchants != nil {
+			activity.LoadMerchant(batch.Merchants)
+		}
+		if batch.Rates != nil && !activity.ConvertCurrency(batch.Rates, batch.BusinessDay) {
+			unconverted++
+		}
 		hash := activity.GetHashCode()
 		if _, ok := batch.Batch[hash]; !ok {
 			batch.Batch[hash] = activity
 		}
 	}
+	if e = decoder.Err(); e != nil {
+		// A partly read file would remove the unread records from DA
+		batch.Clear()
+		return 0, e
+	}
+	if unconverted > 0 {
+		logger.Warn("Missing FX rates, activities are unconverted", logger.KeyFile, filename, logger.KeyCount, unconverted)
+	}
 
-	return batch.Count()
+	return batch.Count(), nil
 }
@@ -0,0 +1,176 @@
+package model
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"../common"
+	"../fx"
+	"../store"
+)
+
+// writeFile - write lines to a file in a temp dir
+func writeFile(t *testing.T, name string, lines ...string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if e := os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	return file
+}
+
+const aacLine = `{"AdviceFileName":"1001","AdviceProvider":"Paypal","Version":2,"AccountActivityType":"Fee","DownloadedTime":"2017-03-02T00:00:00Z","TimeStamp":"2017-03-01T10:00:00.000-08:00","MerchantId":"M1","Currency":"USD","Amount":10.5}`
+
+func TestAccountActivityLoadDataFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		count int
+	}{
+		{"single", []string{aacLine}, 1},
+		{"duplicate keeps first", []string{aacLine, strings.Replace(aacLine, "10.5", "3", 1)}, 1},
+		{"different merchant", []string{aacLine, strings.Replace(aacLine, `"M1"`, `"M2"`, 1)}, 2},
+		{"different type", []string{aacLine, strings.Replace(aacLine, `"Fee"`, `"Payout"`, 1)}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			batch := NewAccountActivityBatch()
+			if count, err := batch.LoadDataFile(writeFile(t, "1001.aac", test.lines...)); err != nil || count != test.count {
+				t.Errorf("got %d records, %v, want %d", count, err, test.count)
+			}
+		})
+	}
+
+	batch := NewAccountActivityBatch()
+	batch.LoadDataFile(writeFile(t, "1001.aac", aacLine, strings.Replace(aacLine, "10.5", "3", 1)))
+	batchid, provider, version := batch.GetKeys()
+	if batchid != "1001" || provider != "Paypal" || version != 2 {
+		t.Errorf("got keys %s %s %d", batchid, provider, version)
+	}
+	for _, act := range batch.Batch {
+		if act.Amount != 10.5 || act.MerchantID != "M1" || act.Currency != "USD" || act.ActivityType != "Fee" {
+			t.Errorf("unexpected activity %+v", act)
+		}
+		if act.Time.UTC().Format("2006-01-02T15:04:05") != "2017-03-01T18:00:00" {
+			t.Errorf("got time %s", act.Time.UTC())
+		}
+	}
+}
+
+func TestAccountActivityTimeFallsBackToDownloadedTime(t *testing.T) {
+	var act AccountActivity
+	act.LoadData(AAC{AdviceFileName: "1001", DownloadedTime: "2017-03-02T00:00:00Z"})
+	if !act.Time.Equal(act.DownloadedTime) {
+		t.Errorf("got time %s, want %s", act.Time, act.DownloadedTime)
+	}
+}
+
+func TestAccountActivityConvertCurrency(t *testing.T) {
+	rates := fx.New("USD")
+	rates.LoadRateFile(writeFile(t, "rates.csv", "2017-03-01,EUR,1.25", "2017-03-02,EUR,1.5"))
+	act := AccountActivity{Currency: "EUR", LocalCurrency: "EUR", Amount: 10, Time: time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC)}
+	if !act.ConvertCurrency(rates, nil) || act.Unconverted || act.LocAmount() != 10 || act.GrpAmount() != 12.5 {
+		t.Errorf("got %+v", act)
+	}
+	// A missing rate leaves the amounts at 0 and marks the activity
+	act.LocalCurrency = "GBP"
+	if act.ConvertCurrency(rates, nil) || !act.Unconverted || act.LocAmount() != 0 || act.GrpAmount() != 12.5 {
+		t.Errorf("got %+v", act)
+	}
+
+	// The rate is of the business day, not of the UTC date of the activity
+	act = AccountActivity{Currency: "EUR", LocalCurrency: "EUR", Amount: 10, Time: time.Date(2017, 3, 2, 7, 0, 0, 0, time.UTC)}
+	if !act.ConvertCurrency(rates, nil) || act.GrpAmount() != 15 {
+		t.Errorf("got %+v", act)
+	}
+	day, err := util.NewBusinessDay("America/Los_Angeles", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !act.ConvertCurrency(rates, day) || act.GrpAmount() != 12.5 {
+		t.Errorf("got %+v", act)
+	}
+}
+
+func TestAccountActivityHashCode(t *testing.T) {
+	base := AAC{AdviceFileName: "1001", AdviceProvider: "Paypal", Version: 1, ActivityType: "Fee", DownloadedTime: "2017-03-02T00:00:00Z", ActivityTime: "2017-03-01T10:00:00.000-08:00", MerchantID: "M1", Currency: "USD", Amount: 10.5}
+	var act AccountActivity
+	act.LoadData(base)
+	hash := act.GetHashCode()
+	// The hash keys records across versions stored by earlier releases, so it must not change
+	if hash != 0x54a2d00a {
+		t.Errorf("hash code changed to %#x", hash)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*AAC)
+		same   bool
+	}{
+		{"version", func(a *AAC) { a.Version = 2 }, true},
+		{"amount", func(a *AAC) { a.Amount = 1 }, true},
+		{"downloaded time", func(a *AAC) { a.DownloadedTime = "2017-03-03T00:00:00Z" }, true},
+		{"same instant in another zone", func(a *AAC) { a.ActivityTime = "2017-03-01T18:00:00Z" }, true},
+		{"merchant", func(a *AAC) { a.MerchantID = "M2" }, false},
+		{"type", func(a *AAC) { a.ActivityType = "Payout" }, false},
+		{"time", func(a *AAC) { a.ActivityTime = "2017-03-01T10:00:01.000-08:00" }, false},
+		{"currency", func(a *AAC) { a.Currency = "EUR" }, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			aac := base
+			test.modify(&aac)
+			var other AccountActivity
+			other.LoadData(aac)
+			if (other.GetHashCode() == hash) != test.same {
+				t.Errorf("same hash: %v, want %v", other.GetHashCode() == hash, test.same)
+			}
+		})
+	}
+}
+
+func TestAccountActivityGetAndCompareLastBatch(t *testing.T) {
+	record := func(merchant string, amount float32, version uint32) AccountActivity {
+		var act AccountActivity
+		act.LoadData(AAC{AdviceFileName: "1001", AdviceProvider: "Paypal", Version: version, ActivityType: "Fee", DownloadedTime: "2017-03-02T00:00:00Z", ActivityTime: "2017-03-01T10:00:00.000-08:00", MerchantID: merchant, Currency: "USD", Amount: amount})
+		return act
+	}
+	cData := store.NewMemory()
+	cDA := store.NewMemory()
+	last := NewAccountActivityBatch()
+	for _, act := range []AccountActivity{record("same", 10, 1), record("changed", 10, 1), record("removed", 10, 1)} {
+		last.Batch[act.GetHashCode()] = act
+	}
+	last.InsertToStore(cData)
+
+	batch := NewAccountActivityBatch()
+	for _, act := range []AccountActivity{record("same", 10, 2), record("changed", 15, 2), record("added", 7, 2)} {
+		batch.Batch[act.GetHashCode()] = act
+	}
+	batch.GetAndCompareLastBatch("1001", "Paypal", 2, 1, cData, cDA)
+
+	var da []AccountActivity
+	cDA.Find(nil).All(&da)
+	want := map[string]float32{"changed": 5, "removed": -10}
+	if len(da) != len(want) {
+		t.Fatalf("got %d DA records, want %d: %+v", len(da), len(want), da)
+	}
+	for _, act := range da {
+		if amount, ok := want[act.MerchantID]; !ok || act.Amount != amount {
+			t.Errorf("unexpected DA %s %v", act.MerchantID, act.Amount)
+		}
+	}
+
+	// Only added records remain to be inserted as new DA
+	if len(batch.Batch) != 1 {
+		t.Fatalf("got %d remaining records, want 1", len(batch.Batch))
+	}
+	for _, act := range batch.Batch {
+		if act.MerchantID != "added" {
+			t.Errorf("unexpected remaining record %s", act.MerchantID)
+		}
+	}
+}
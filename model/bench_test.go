@@ -0,0 +1,192 @@
+package model
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"../common"
+	"../store"
+)
+
+// benchMax - largest batch size to benchmark, the larger sizes take minutes and gigabytes to set up
+var benchMax = flag.Int("bench.max", 100000, "largest batch size of the model benchmarks, up to 10000000")
+
+var benchSizes = []int{10000, 100000, 1000000, 10000000}
+
+var benchStart = time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+
+// benchDays - days spanned by the activities of a benchmark batch
+const benchDays = 7
+
+// eachSize - run a sub benchmark for each batch size up to the max
+func eachSize(b *testing.B, bench func(b *testing.B, n int)) {
+	for _, n := range benchSizes {
+		if n > *benchMax {
+			return
+		}
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			bench(b, n)
+		})
+	}
+}
+
+// benchSubmission - the i-th submission of a generated batch, spread over benchDays
+func benchSubmission(i int, version uint32) *SubmissionActivity {
+	var act SubmissionActivity
+	act.BatchName = "1001"
+	act.AdviceProvider = "Paypal"
+	act.VersionNumber = version
+	act.ActivityType = "Charge"
+	act.Time = benchStart.Add(time.Duration(i%benchDays)*24*time.Hour + time.Duration(i)*time.Millisecond)
+	act.MerchantID = "M" + strconv.Itoa(i%100)
+	act.Currency = "USD"
+	act.Amount = float32(i%10000) / 100
+	act.MerchantReferenceNumber = "MRN" + strconv.Itoa(i)
+	return &act
+}
+
+// writeSACFile - write a SAC file of n records and return its name and size
+func writeSACFile(b *testing.B, n int) (string, int64) {
+	file := filepath.Join(b.TempDir(), "1001.sac")
+	f, e := os.Create(file)
+	if e != nil {
+		b.Fatal(e)
+	}
+	w := bufio.NewWriter(f)
+	for i := 0; i < n; i++ {
+		act := benchSubmission(i, 1)
+		fmt.Fprintf(w, `{"AdviceFileName":"1001","AdviceProvider":"Paypal","Version":1,"TransactionType":"Charge","DownloadedTime":"2017-03-09T00:00:00Z","TimeStamp":"%s","MerchantId":"%s","Currency":"USD","Amount":%v,"MerchantReferenceNumber":"%s"}`+"\n",
+			act.Time.Format("2006-01-02T15:04:05.000-07:00"), act.MerchantID, act.Amount, act.MerchantReferenceNumber)
+	}
+	if e = w.Flush(); e != nil {
+		b.Fatal(e)
+	}
+	f.Close()
+	info, _ := os.Stat(file)
+	return file, info.Size()
+}
+
+func BenchmarkSubmissionLoadDataFile(b *testing.B) {
+	eachSize(b, func(b *testing.B, n int) {
+		file, size := writeSACFile(b, n)
+		types := util.NewTypeRegistry(nil)
+		b.SetBytes(size)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			batch := NewSubmissionActivityBatch()
+			batch.Types = types
+			batch.LoadDataFile(file)
+		}
+	})
+}
+
+func BenchmarkSubmissionGetHashCode(b *testing.B) {
+	acts := make([]*SubmissionActivity, 1000)
+	for i := range acts {
+		acts[i] = benchSubmission(i, 1)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		acts[i%len(acts)].GetHashCode()
+	}
+}
+
+// benchBatch - batch of n submissions where every tenth is changed and every twentieth replaced compared to version 1
+func benchBatch(n int, version uint32) *SubmissionActivityBatch {
+	batch := NewSubmissionActivityBatch()
+	for i := 0; i < n; i++ {
+		act := benchSubmission(i, version)
+		if version > 1 && i%10 == 0 {
+			act.Amount++
+		}
+		if version > 1 && i%20 == 1 {
+			act = benchSubmission(n+i, version)
+		}
+		batch.Batch[act.GetHashCode()] = act
+	}
+	return batch
+}
+
+func BenchmarkSubmissionGetAndCompareLastBatch(b *testing.B) {
+	eachSize(b, func(b *testing.B, n int) {
+		cData := store.NewMemory()
+		benchBatch(n, 1).InsertToStore(cData)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			batch := benchBatch(n, 2)
+			cDA := store.NewMemory()
+			b.StartTimer()
+			batch.GetAndCompareLastBatch("1001", "Paypal", 2, 1, cData, cDA)
+		}
+	})
+}
+
+func BenchmarkSubmissionStreamCompareLastBatch(b *testing.B) {
+	eachSize(b, func(b *testing.B, n int) {
+		cData := store.NewMemory()
+		benchBatch(n, 1).InsertToStore(cData)
+		benchBatch(n, 2).InsertToStore(cData)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			batch := NewSubmissionActivityBatch()
+			batch.StreamThreshold = 1
+			cDA := store.NewMemory()
+			b.StartTimer()
+			batch.GetAndCompareLastBatch("1001", "Paypal", 2, 1, cData, cDA)
+		}
+	})
+}
+
+// benchTransactions - store with the transactions of the first n submissions of a generated batch
+func benchTransactions(n int) store.Collection {
+	cTx := store.NewMemory()
+	txs := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		act := benchSubmission(i, 1)
+		txs = append(txs, &Transaction{MRN: act.MerchantReferenceNumber, TransactionType: act.ActivityType, InternalMRN: "I" + act.MerchantReferenceNumber, SOR: "SOR1", Partner: "P1", Date: util.GetDate(act.Time)})
+	}
+	cTx.Insert(txs...)
+	return cTx
+}
+
+func BenchmarkLoadAdditionalProperties(b *testing.B) {
+	for _, warm := range []bool{false, true} {
+		name := "cold"
+		if warm {
+			name = "warm"
+		}
+		b.Run(name, func(b *testing.B) {
+			eachSize(b, func(b *testing.B, n int) {
+				cTx := benchTransactions(n)
+				cache := NewTxCache(util.LRUCacheShards, util.LRUCacheBytes, 0)
+				types := util.NewTypeRegistry(nil)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					batch := benchBatch(n, 1)
+					batch.Types = types
+					batch.DateWindow = 1
+					batch.Cache = cache
+					if !warm {
+						batch.Cache = NewTxCache(util.LRUCacheShards, util.LRUCacheBytes, 0)
+					}
+					b.StartTimer()
+					batch.LoadAdditionalProperties(cTx)
+				}
+			})
+		})
+	}
+}
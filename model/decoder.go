@@ -0,0 +1,387 @@
+package model
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"../common"
+)
+
+// adviceReaderSize - read buffer of advice files, lines longer than it are assembled in the line buffer
+const adviceReaderSize = 64 * 1024
+
+// internLimit - max distinct values interned by a decoder, e.g. providers, currencies and merchants
+const internLimit = 64 * 1024
+
+// adviceDecoder - streaming decoder of advice files with one flat JSON object per line
+//
+// Lines of any length are read into a reused buffer and their fields are passed to a callback as
+// byte slices valid until the next line, so records convert to activities without an intermediate struct.
+type adviceDecoder struct {
+	reader  *bufio.Reader
+	buffer  []byte
+	line    []byte
+	scratch []byte
+	strs    map[string]string
+	lineNo  int
+	err     error
+	// lastTime, lastParsed - the last time parsed by ParseTime, e.g. the downloaded time shared by a file
+	lastTime   string
+	lastParsed time.Time
+	lastErr    error
+	// profiles - provider profiles, the built-in profile applies if nil
+	profiles *util.ProfileRegistry
+	// provider, profile - the last profile returned by Profile
+	provider   string
+	profile    util.ProviderProfile
+	hasProfile bool
+}
+
+// LineError - a line of an advice file cannot be decoded, so the file is rejected as a whole
+type LineError struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return e.File + ":" + strconv.Itoa(e.Line) + ": " + e.Err.Error()
+}
+
+// adviceTimes - timestamps of a record, parsed once all its fields are read
+type adviceTimes struct {
+	activity   string
+	downloaded string
+}
+
+// newAdviceDecoder - create a decoder reading from r
+func newAdviceDecoder(r io.Reader) *adviceDecoder {
+	var d adviceDecoder
+	d.reader = bufio.NewReaderSize(r, adviceReaderSize)
+	d.strs = make(map[string]string)
+	return &d
+}
+
+// PeekProvider - the advice provider of the first record of an advice file, empty if it has none
+func PeekProvider(filename string) (provider string, e error) {
+	file, e := os.Open(filename)
+	if e != nil {
+		return
+	}
+	defer file.Close()
+	d := newAdviceDecoder(file)
+	if !d.Next() {
+		return "", d.Err()
+	}
+	e = d.Fields(func(key []byte, value []byte) error {
+		if strings.EqualFold(string(key), "AdviceProvider") {
+			provider = string(value)
+		}
+		return nil
+	})
+	return
+}
+
+// Next - read the next non-empty line, false at the end of input or on a read error
+func (d *adviceDecoder) Next() bool {
+	for d.err == nil {
+		d.buffer = d.buffer[:0]
+		for {
+			fragment, e := d.reader.ReadSlice('\n')
+			d.buffer = append(d.buffer, fragment...)
+			if e == bufio.ErrBufferFull {
+				continue
+			}
+			if e != nil && e != io.EOF {
+				d.err = e
+				return false
+			}
+			if e == io.EOF && len(d.buffer) == 0 {
+				return false
+			}
+			if e == io.EOF {
+				// Last line without a line break
+				d.err = io.EOF
+			}
+			break
+		}
+		d.lineNo++
+		d.line = trimSpace(d.buffer)
+		if len(d.line) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Err - the read error which stopped Next, if any
+func (d *adviceDecoder) Err() error {
+	if d.err == io.EOF {
+		return nil
+	}
+	return d.err
+}
+
+// Fields - call field for each key and value of the current line's object, string values are unescaped
+// and other values passed as their literal; nested objects and arrays are skipped
+func (d *adviceDecoder) Fields(field func(key []byte, value []byte) error) error {
+	s := d.line
+	i := skipSpace(s, 0)
+	if i >= len(s) || s[i] != '{' {
+		return errors.New("expected an object")
+	}
+	i = skipSpace(s, i+1)
+	if i < len(s) && s[i] == '}' {
+		return checkEnd(s, i+1)
+	}
+	for {
+		if i >= len(s) || s[i] != '"' {
+			return errors.New("expected a key at offset " + strconv.Itoa(i))
+		}
+		key, next, e := d.unquote(s, i, false)
+		if e != nil {
+			return e
+		}
+		i = skipSpace(s, next)
+		if i >= len(s) || s[i] != ':' {
+			return errors.New("expected ':' at offset " + strconv.Itoa(i))
+		}
+		i = skipSpace(s, i+1)
+		if i >= len(s) {
+			return errors.New("unexpected end of line")
+		}
+
+		var value []byte
+		switch s[i] {
+		case '"':
+			value, next, e = d.unquote(s, i, true)
+		case '{', '[':
+			next, e = skipNested(s, i)
+			value = nil
+		default:
+			next = i
+			for next < len(s) && s[next] != ',' && s[next] != '}' && !isSpace(s[next]) {
+				next++
+			}
+			value = s[i:next]
+			if string(value) == "null" {
+				value = nil
+			}
+		}
+		if e != nil {
+			return e
+		}
+		if value != nil {
+			if e = field(key, value); e != nil {
+				return errors.New(string(key) + ": " + e.Error())
+			}
+		}
+
+		i = skipSpace(s, next)
+		if i >= len(s) {
+			return errors.New("unexpected end of line")
+		}
+		if s[i] == '}' {
+			return checkEnd(s, i+1)
+		}
+		if s[i] != ',' {
+			return errors.New("expected ',' at offset " + strconv.Itoa(i))
+		}
+		i = skipSpace(s, i+1)
+	}
+}
+
+// checkEnd - only spaces may follow the closing brace, anything else is a malformed line rather than a second record
+func checkEnd(s []byte, i int) error {
+	if i = skipSpace(s, i); i < len(s) {
+		return errors.New("unexpected data after the object at offset " + strconv.Itoa(i))
+	}
+	return nil
+}
+
+// String - the value as a string, repeated values share one copy
+func (d *adviceDecoder) String(value []byte) string {
+	if s, ok := d.strs[string(value)]; ok {
+		return s
+	}
+	s := string(value)
+	if len(d.strs) < internLimit {
+		d.strs[s] = s
+	}
+	return s
+}
+
+// Profile - the profile of a provider, times are parsed with it until the next call
+func (d *adviceDecoder) Profile(provider string) util.ProviderProfile {
+	if !d.hasProfile || provider != d.provider {
+		d.profile = d.profiles.Get(provider)
+		d.provider = provider
+		d.hasProfile = true
+		d.lastTime = ""
+	}
+	return d.profile
+}
+
+// ParseTime - parse a timestamp with the current profile, reusing the last result for repeated values
+func (d *adviceDecoder) ParseTime(value string) (time.Time, error) {
+	if value != d.lastTime || len(value) == 0 {
+		d.lastParsed, d.lastErr = d.profile.ParseTime(value)
+		d.lastTime = value
+	}
+	return d.lastParsed, d.lastErr
+}
+
+// unquote - the string starting at s[i] and the offset after it; values are unescaped in the scratch buffer
+// which is valid until the next value, keys without escapes are returned in place
+func (d *adviceDecoder) unquote(s []byte, i int, value bool) (result []byte, next int, e error) {
+	start := i + 1
+	j := start
+	for j < len(s) && s[j] != '"' && s[j] != '\\' {
+		j++
+	}
+	if j >= len(s) {
+		return nil, j, errors.New("unterminated string")
+	}
+	if s[j] == '"' {
+		return s[start:j], j + 1, nil
+	}
+
+	// Unescape into the scratch buffer
+	buf := d.scratch[:0]
+	if !value {
+		buf = nil
+	}
+	buf = append(buf, s[start:j]...)
+	for j < len(s) {
+		c := s[j]
+		switch {
+		case c == '"':
+			if value {
+				d.scratch = buf
+			}
+			return buf, j + 1, nil
+		case c != '\\':
+			buf = append(buf, c)
+			j++
+		case j+1 >= len(s):
+			return nil, j, errors.New("unterminated string")
+		default:
+			j++
+			switch s[j] {
+			case '"', '\\', '/':
+				buf = append(buf, s[j])
+			case 'b':
+				buf = append(buf, '\b')
+			case 'f':
+				buf = append(buf, '\f')
+			case 'n':
+				buf = append(buf, '\n')
+			case 'r':
+				buf = append(buf, '\r')
+			case 't':
+				buf = append(buf, '\t')
+			case 'u':
+				r, n := unquoteRune(s[j-1:])
+				if n == 0 {
+					return nil, j, errors.New("invalid unicode escape")
+				}
+				buf = utf8.AppendRune(buf, r)
+				j += n - 2
+			default:
+				return nil, j, errors.New("invalid escape")
+			}
+			j++
+		}
+	}
+	return nil, j, errors.New("unterminated string")
+}
+
+// unquoteRune - decode a \uXXXX escape, or a surrogate pair of them, returning the rune and the bytes used
+func unquoteRune(s []byte) (r rune, n int) {
+	r1, ok := hex4(s)
+	if !ok {
+		return
+	}
+	if utf16.IsSurrogate(r1) {
+		if r2, ok := hex4(s[6:]); ok {
+			if r = utf16.DecodeRune(r1, r2); r != utf8.RuneError {
+				return r, 12
+			}
+		}
+		return utf8.RuneError, 6
+	}
+	return r1, 6
+}
+
+func hex4(s []byte) (rune, bool) {
+	if len(s) < 6 || s[0] != '\\' || s[1] != 'u' {
+		return 0, false
+	}
+	v, e := strconv.ParseUint(string(s[2:6]), 16, 16)
+	return rune(v), e == nil
+}
+
+// skipNested - the offset after the object or array starting at s[i]
+func skipNested(s []byte, i int) (int, error) {
+	depth := 0
+	for i < len(s) {
+		switch s[i] {
+		case '"':
+			i++
+			for i < len(s) && s[i] != '"' {
+				if s[i] == '\\' {
+					i++
+				}
+				i++
+			}
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+			if depth == 0 {
+				return i + 1, nil
+			}
+		}
+		i++
+	}
+	return i, errors.New("unterminated object or array")
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+func skipSpace(s []byte, i int) int {
+	for i < len(s) && isSpace(s[i]) {
+		i++
+	}
+	return i
+}
+
+func trimSpace(s []byte) []byte {
+	i := skipSpace(s, 0)
+	j := len(s)
+	for j > i && isSpace(s[j-1]) {
+		j--
+	}
+	return s[i:j]
+}
+
+// parseAmount - parse a JSON number as float32
+func parseAmount(value []byte) (float32, error) {
+	f, e := strconv.ParseFloat(string(value), 32)
+	return float32(f), e
+}
+
+// parseVersion - parse a JSON number as uint32
+func parseVersion(value []byte) (uint32, error) {
+	v, e := strconv.ParseUint(string(value), 10, 32)
+	return uint32(v), e
+}
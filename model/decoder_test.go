@@ -0,0 +1,119 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestAdviceDecoderMatchesEncodingJSON(t *testing.T) {
+	long := strings.Repeat("x", 3*adviceReaderSize)
+	lines := []string{
+		sacLine,
+		`{"AdviceFileName":"1001","AdviceProvider":"Pay\"pal\\","Version":3,"TransactionType":"Charge","DownloadedTime":"2017-03-02T00:00:00Z","TimeStamp":"2017-03-01T10:00:00Z","MerchantId":"Mé1😀","Currency":"EUR","Amount":-1.25e2,"MerchantReferenceNumber":"A\/B\tC"}`,
+		`{ "adviceFileName" : "1001", "ADVICEPROVIDER":"Paypal", "version":1, "transactionType":"Refund", "downloadedtime":"2017-03-02T00:00:00Z", "timestamp":"2017-03-01T10:00:00Z", "Amount":null, "MerchantReferenceNumber":"MRN" }`,
+		`{"AdviceFileName":"1001","AdditionalData":"` + long + `","Nested":{"a":[1,{"b":"}"}]},"TransactionType":"Charge","DownloadedTime":"2017-03-02T00:00:00Z","TimeStamp":"2017-03-01T10:00:00Z","Amount":7}`,
+	}
+	d := newAdviceDecoder(strings.NewReader(strings.Join(lines, "\r\n")))
+	for i, line := range lines {
+		if !d.Next() {
+			t.Fatalf("line %d: %v", i+1, d.Err())
+		}
+		var got SubmissionActivity
+		if e := got.decode(d); e != nil {
+			t.Fatalf("line %d: %v", i+1, e)
+		}
+		var sac SAC
+		if e := json.Unmarshal([]byte(line), &sac); e != nil {
+			t.Fatal(e)
+		}
+		var want SubmissionActivity
+		want.LoadData(sac)
+		got.LastModifiedTime = want.LastModifiedTime
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("line %d: got %+v, want %+v", i+1, got, want)
+		}
+	}
+	if d.Next() || d.Err() != nil {
+		t.Errorf("unexpected line or error %v after the last line", d.Err())
+	}
+}
+
+func TestAdviceDecoderMalformed(t *testing.T) {
+	tests := []string{
+		`not json`,
+		`{"AdviceFileName":"1001"`,
+		`{"AdviceFileName":"1001" "Version":1}`,
+		`{"Version":-1}`,
+		`{"Amount":1.5.1}`,
+		`{"AdviceFileName":"10`,
+		`{"Nested":{"a":[1,2}`,
+		`{"MerchantId":"\q"}`,
+		`{"Version":1} {"Version":2}`,
+		`{}x`,
+	}
+	for _, line := range tests {
+		d := newAdviceDecoder(strings.NewReader(line))
+		if !d.Next() {
+			t.Fatalf("%s: no line", line)
+		}
+		var act SubmissionActivity
+		if e := act.decode(d); e == nil {
+			t.Errorf("%s: no error", line)
+		}
+	}
+}
+
+func TestAdviceDecoderLines(t *testing.T) {
+	d := newAdviceDecoder(strings.NewReader("\n{}\n  \n{}"))
+	var lines []int
+	for d.Next() {
+		lines = append(lines, d.lineNo)
+	}
+	if !reflect.DeepEqual(lines, []int{2, 4}) || d.Err() != nil {
+		t.Errorf("got lines %v, %v", lines, d.Err())
+	}
+
+	failure := errors.New("disk failure")
+	d = newAdviceDecoder(io.MultiReader(strings.NewReader("{}\n{"), iotest.ErrReader(failure)))
+	if !d.Next() || d.Next() {
+		t.Fatal("expected one line before the read error")
+	}
+	if d.Err() != failure {
+		t.Errorf("got %v, want %v", d.Err(), failure)
+	}
+}
+
+func TestLoadDataFileRejectsMalformedLines(t *testing.T) {
+	batch := NewSubmissionActivityBatch()
+	file := writeFile(t, "1001.sac", sacLine, `{"AdviceFileName":`, strings.Replace(sacLine, "MRN1", "MRN2", 1))
+	count, err := batch.LoadDataFile(file)
+	if lineErr, ok := err.(*LineError); !ok || lineErr.Line != 2 || lineErr.File != file {
+		t.Errorf("got %#v, want an error of line 2", err)
+	}
+	// The records before the line are not kept, they would be compared as the whole file
+	if count != 0 || batch.Count() != 0 {
+		t.Errorf("got %d records, batch of %d", count, batch.Count())
+	}
+
+	accBatch := NewAccountActivityBatch()
+	if _, err = accBatch.LoadDataFile(writeFile(t, "1001.aac", aacLine, `{"Version":`)); err == nil || accBatch.Count() != 0 {
+		t.Errorf("got %v with %d records", err, accBatch.Count())
+	}
+}
+
+func TestLoadDataFileMissing(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "1001.sac")
+	if _, err := NewSubmissionActivityBatch().LoadDataFile(missing); !os.IsNotExist(err) {
+		t.Errorf("got %v, want a missing file error", err)
+	}
+	if _, err := NewAccountActivityBatch().LoadDataFile(missing); !os.IsNotExist(err) {
+		t.Errorf("got %v, want a missing file error", err)
+	}
+}
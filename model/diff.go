@@ -0,0 +1,180 @@
+package model
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"../logger"
+	"../store"
+)
+
+// aacKeyFields - stored fields of the AccountActivity hash code, in merge order
+var aacKeyFields = []string{"merchantid", "activitytype", "time", "currency"}
+
+// sacKeyFields - stored fields of the SubmissionActivity hash code, in merge order
+var sacKeyFields = []string{"merchantreferencenumber", "merchantid", "advicetype", "time", "currency", "internalmrn", "sellerofrecord", "partner"}
+
+// versionIter - iterate the records of a batch version in key order
+//
+// The index lets the store stream the records in key order instead of sorting them in memory.
+func versionIter(cData store.Collection, batchid string, provider string, version uint32, keyFields []string) store.Iter {
+	index := append([]string{"batchname", "adviceprovider", "versionnumber"}, keyFields...)
+	if err := cData.EnsureIndex(index, false); err != nil {
+		logger.Error("Failed to ensure version index", logger.KeyError, err)
+	}
+	return cData.Find(bson.M{"batchname": batchid, "adviceprovider": provider, "versionnumber": version}).Sort(keyFields...).Iter()
+}
+
+// mergeVersions - merge join the last and current versions of a batch, both in key order
+//
+// matched is called for records in both versions, removed for records only in the last version and
+// added for records only in the current one. Only a run of records which compareRun finds equal is held in
+// memory for each version, see runIter.
+func mergeVersions[T any](last store.Iter, current store.Iter, compareRun func(a *T, b *T) int, compare func(a *T, b *T) int, matched func(o *T, v *T), removed func(o *T), added func(v *T)) error {
+	lastRuns := newRunIter(last, compareRun, compare)
+	currentRuns := newRunIter(current, compareRun, compare)
+	o := lastRuns.next()
+	v := currentRuns.next()
+	for o != nil || v != nil {
+		c := 0
+		switch {
+		case o == nil:
+			c = 1
+		case v == nil:
+			c = -1
+		default:
+			c = compare(o, v)
+		}
+		switch {
+		case c == 0:
+			matched(o, v)
+			o = lastRuns.next()
+			v = currentRuns.next()
+		case c < 0:
+			removed(o)
+			o = lastRuns.next()
+		default:
+			added(v)
+			v = currentRuns.next()
+		}
+	}
+	if e := last.Close(); e != nil {
+		current.Close()
+		return e
+	}
+	return current.Close()
+}
+
+// runIter - yield the records of a version in compare order
+//
+// The store orders times to the millisecond but records are keyed to the second, so the records of a run, which
+// share the key fields up to the time second, may come in any order of the remaining key fields. A run is read
+// and sorted before its first record is yielded.
+type runIter[T any] struct {
+	iter       store.Iter
+	compareRun func(a *T, b *T) int
+	compare    func(a *T, b *T) int
+	run        []*T
+	ahead      *T
+}
+
+// newRunIter - constructor, reads the first record
+func newRunIter[T any](iter store.Iter, compareRun func(a *T, b *T) int, compare func(a *T, b *T) int) *runIter[T] {
+	r := &runIter[T]{iter: iter, compareRun: compareRun, compare: compare}
+	r.ahead = r.read()
+	return r
+}
+
+func (r *runIter[T]) read() *T {
+	var record T
+	if r.iter.Next(&record) {
+		return &record
+	}
+	return nil
+}
+
+// next - the next record in compare order, nil at the end
+func (r *runIter[T]) next() *T {
+	if len(r.run) == 0 {
+		if r.ahead == nil {
+			return nil
+		}
+		r.run = append(r.run[:0], r.ahead)
+		for r.ahead = r.read(); r.ahead != nil && r.compareRun(r.ahead, r.run[0]) == 0; r.ahead = r.read() {
+			r.run = append(r.run, r.ahead)
+		}
+		sort.SliceStable(r.run, func(i int, j int) bool { return r.compare(r.run[i], r.run[j]) < 0 })
+	}
+	record := r.run[0]
+	r.run[0] = nil
+	r.run = r.run[1:]
+	return record
+}
+
+// compareTimes - order times to the second, as GetHashCode keys them
+func compareTimes(a time.Time, b time.Time) int {
+	x := a.Unix()
+	y := b.Unix()
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// compareAccountRuns - order account activities by aacKeyFields up to the time
+func compareAccountRuns(a *AccountActivity, b *AccountActivity) int {
+	if c := strings.Compare(a.MerchantID, b.MerchantID); c != 0 {
+		return c
+	}
+	if c := strings.Compare(a.ActivityType, b.ActivityType); c != 0 {
+		return c
+	}
+	return compareTimes(a.Time, b.Time)
+}
+
+// compareAccountActivities - order account activities by aacKeyFields
+func compareAccountActivities(a *AccountActivity, b *AccountActivity) int {
+	if c := compareAccountRuns(a, b); c != 0 {
+		return c
+	}
+	return strings.Compare(a.Currency, b.Currency)
+}
+
+// compareSubmissionRuns - order submission activities by sacKeyFields up to the time
+func compareSubmissionRuns(a *SubmissionActivity, b *SubmissionActivity) int {
+	for _, c := range []int{
+		strings.Compare(a.MerchantReferenceNumber, b.MerchantReferenceNumber),
+		strings.Compare(a.MerchantID, b.MerchantID),
+		strings.Compare(a.keyType(), b.keyType()),
+		compareTimes(a.Time, b.Time),
+	} {
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// compareSubmissionActivities - order submission activities by sacKeyFields
+func compareSubmissionActivities(a *SubmissionActivity, b *SubmissionActivity) int {
+	if c := compareSubmissionRuns(a, b); c != 0 {
+		return c
+	}
+	for _, c := range []int{
+		strings.Compare(a.Currency, b.Currency),
+		strings.Compare(a.InternalMRN, b.InternalMRN),
+		strings.Compare(a.SellerOfRecord, b.SellerOfRecord),
+		strings.Compare(a.Partner, b.Partner),
+	} {
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
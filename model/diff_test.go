@@ -0,0 +1,206 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"../common"
+	"../store"
+)
+
+// daRecords - DA records of a collection without processing times and ids, in a stable order
+func daRecords(t *testing.T, cDA store.Collection, result interface{}) []string {
+	if err := cDA.Find(nil).All(result); err != nil {
+		t.Fatal(err)
+	}
+	var records []string
+	switch das := result.(type) {
+	case *[]AccountActivity:
+		for _, da := range *das {
+			da.LastModifiedTime = time.Time{}
+			da.ID = ""
+			records = append(records, fmt.Sprintf("%+v", da))
+		}
+	case *[]SubmissionActivity:
+		for _, da := range *das {
+			da.LastModifiedTime = time.Time{}
+			da.ID = ""
+			records = append(records, fmt.Sprintf("%+v", da))
+		}
+	}
+	sort.Strings(records)
+	return records
+}
+
+func TestStreamCompareMatchesInMemoryCompare(t *testing.T) {
+	const n = 200
+	compare := func(stream bool) []string {
+		cData := store.NewMemory()
+		cDA := store.NewMemory()
+		benchBatch(n, 1).InsertToStore(cData)
+		batch := benchBatch(n, 2)
+		// Records with the same time sort by the remaining key fields
+		same := benchSubmission(n*3, 2)
+		same.Time = benchSubmission(5, 2).Time
+		batch.Batch[same.GetHashCode()] = same
+		batch.InsertToStore(cData)
+		if stream {
+			batch.StreamThreshold = 1
+		}
+		batch.GetAndCompareLastBatch("1001", "Paypal", 2, 1, cData, cDA)
+		batch.InsertToStore(cDA)
+		var das []SubmissionActivity
+		return daRecords(t, cDA, &das)
+	}
+	inMemory := compare(false)
+	streamed := compare(true)
+	if len(inMemory) == 0 || fmt.Sprint(inMemory) != fmt.Sprint(streamed) {
+		t.Errorf("streamed DA differs:\n%v\nin memory:\n%v", streamed, inMemory)
+	}
+}
+
+func TestStreamCompareAccountActivities(t *testing.T) {
+	const ts = "2017-03-01T10:00:00.000-08:00"
+	activity := func(merchant string, activityType string, amount float32, version uint32) AccountActivity {
+		var act AccountActivity
+		act.LoadData(AAC{AdviceFileName: "1001", AdviceProvider: "Paypal", Version: version, ActivityType: activityType, DownloadedTime: ts, ActivityTime: ts, MerchantID: merchant, Currency: "USD", Amount: amount})
+		return act
+	}
+	compare := func(stream bool) []string {
+		cData := store.NewMemory()
+		cDA := store.NewMemory()
+		last := NewAccountActivityBatch()
+		for _, act := range []AccountActivity{activity("M1", "Fee", 1, 1), activity("M2", "Fee", 2, 1), activity("M3", "Payout", -3, 1), activity("M3", "Fee", 4, 1)} {
+			last.Batch[act.GetHashCode()] = act
+		}
+		last.InsertToStore(cData)
+		batch := NewAccountActivityBatch()
+		for _, act := range []AccountActivity{activity("M1", "Fee", 1, 2), activity("M2", "Fee", 5, 2), activity("M3", "Fee", 4, 2), activity("M0", "Fee", 6, 2), activity("M4", "Fee", 7, 2)} {
+			batch.Batch[act.GetHashCode()] = act
+		}
+		batch.InsertToStore(cData)
+		if stream {
+			batch.StreamThreshold = 1
+		}
+		batch.GetAndCompareLastBatch("1001", "Paypal", 2, 1, cData, cDA)
+		batch.InsertToStore(cDA)
+		var das []AccountActivity
+		return daRecords(t, cDA, &das)
+	}
+	inMemory := compare(false)
+	streamed := compare(true)
+	if len(inMemory) != 4 || fmt.Sprint(inMemory) != fmt.Sprint(streamed) {
+		t.Errorf("streamed DA differs:\n%v\nin memory:\n%v", streamed, inMemory)
+	}
+}
+
+func TestStreamCompareSubSecondTimes(t *testing.T) {
+	activity := func(ts string, currency string, amount float32, version uint32) AccountActivity {
+		var act AccountActivity
+		act.LoadData(AAC{AdviceFileName: "1001", AdviceProvider: "Paypal", Version: version, ActivityType: "Fee", DownloadedTime: ts, ActivityTime: ts, MerchantID: "M1", Currency: currency, Amount: amount})
+		return act
+	}
+	compare := func(stream bool) []string {
+		cData := store.NewMemory()
+		cDA := store.NewMemory()
+		// The records are keyed to the second, the milliseconds order them differently in each version
+		last := NewAccountActivityBatch()
+		for _, act := range []AccountActivity{activity("2017-03-01T10:00:00.100Z", "USD", 1, 1), activity("2017-03-01T10:00:00.200Z", "EUR", 2, 1)} {
+			last.Batch[act.GetHashCode()] = act
+		}
+		last.InsertToStore(cData)
+		batch := NewAccountActivityBatch()
+		for _, act := range []AccountActivity{activity("2017-03-01T10:00:00.050Z", "EUR", 2, 2), activity("2017-03-01T10:00:00.300Z", "USD", 3, 2)} {
+			batch.Batch[act.GetHashCode()] = act
+		}
+		batch.InsertToStore(cData)
+		if stream {
+			batch.StreamThreshold = 1
+		}
+		batch.GetAndCompareLastBatch("1001", "Paypal", 2, 1, cData, cDA)
+		batch.InsertToStore(cDA)
+		var das []AccountActivity
+		return daRecords(t, cDA, &das)
+	}
+	inMemory := compare(false)
+	streamed := compare(true)
+	if len(inMemory) != 1 || fmt.Sprint(inMemory) != fmt.Sprint(streamed) {
+		t.Errorf("streamed DA differs:\n%v\nin memory:\n%v", streamed, inMemory)
+	}
+}
+
+// countingIter - counts the records read from an iterator
+type countingIter struct {
+	store.Iter
+	read int
+}
+
+func (iter *countingIter) Next(result interface{}) bool {
+	if !iter.Iter.Next(result) {
+		return false
+	}
+	iter.read++
+	return true
+}
+
+func TestMergeVersionsHoldsOneRun(t *testing.T) {
+	const n = 50
+	cData := store.NewMemory()
+	benchBatch(n, 1).InsertToStore(cData)
+	benchBatch(n, 2).InsertToStore(cData)
+	last := &countingIter{Iter: versionIter(cData, "1001", "Paypal", 1, sacKeyFields)}
+	current := &countingIter{Iter: versionIter(cData, "1001", "Paypal", 2, sacKeyFields)}
+	lastDone, currentDone, held := 0, 0, 0
+	check := func() {
+		// The records of a run and the first record of the next one are read ahead of the merge
+		if h := last.read - lastDone + current.read - currentDone; h > held {
+			held = h
+		}
+	}
+	err := mergeVersions(last, current, compareSubmissionRuns, compareSubmissionActivities,
+		func(o *SubmissionActivity, v *SubmissionActivity) { lastDone++; currentDone++; check() },
+		func(o *SubmissionActivity) { lastDone++; check() },
+		func(v *SubmissionActivity) { currentDone++; check() })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastDone != n || currentDone != n || held > 4 {
+		t.Errorf("merged %d and %d records, held up to %d", lastDone, currentDone, held)
+	}
+}
+
+func TestCompareVersionStoredWithAliasTypes(t *testing.T) {
+	const ts = "2017-03-01T10:00:00Z"
+	types := util.NewTypeRegistry([]util.TransactionType{{ID: 0, Name: "Charge"}, {ID: 1, Name: "Refund", Sign: -1, Aliases: map[string][]string{"Paypal": {"Return"}}}})
+	compare := func(stream bool) []string {
+		cData := store.NewMemory()
+		cDA := store.NewMemory()
+		// Stored by a release which kept the advice type as the activity type
+		last := NewSubmissionActivityBatch()
+		for _, act := range []*SubmissionActivity{newSubmission("returned", "Return", ts, -10, 1), newSubmission("charged", "Charge", ts, 5, 1)} {
+			act.AdviceType = ""
+			last.Batch[act.GetHashCode()] = act
+		}
+		last.InsertToStore(cData)
+		batch := NewSubmissionActivityBatch()
+		for _, act := range []*SubmissionActivity{newSubmission("returned", "Return", ts, -10, 2), newSubmission("charged", "Charge", ts, 5, 2)} {
+			act.NormalizeType(types, util.ProviderProfile{})
+			batch.Batch[act.GetHashCode()] = act
+		}
+		batch.InsertToStore(cData)
+		if stream {
+			batch.StreamThreshold = 1
+		}
+		batch.GetAndCompareLastBatch("1001", "Paypal", 2, 1, cData, cDA)
+		batch.InsertToStore(cDA)
+		var das []SubmissionActivity
+		return daRecords(t, cDA, &das)
+	}
+	for _, stream := range []bool{false, true} {
+		if da := compare(stream); len(da) != 0 {
+			t.Errorf("stream %v: got DA %v", stream, da)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package model
+
+import (
+	"sort"
+	"time"
+
+	"../common"
+	"../logger"
+	"../store"
+)
+
+// Reasons of submissions not matching a transaction
+const (
+	UnmatchedUnknownType   = "UnknownType"
+	UnmatchedNoTransaction = "NoTransaction"
+)
+
+// EnrichmentStats - outcome of matching a submission batch to transactions
+type EnrichmentStats struct {
+	BatchName      string
+	AdviceProvider string
+	VersionNumber  uint32
+	Total          int
+	Matched        int
+	Ambiguous      int
+	Unmatched      int
+	UnknownType    int
+	// NotEnriched - submissions of providers whose profile does not match transactions
+	NotEnriched    int
+	ProcessingTime time.Time
+}
+
+// LoadAdditionalProperties - load tx properties to submission activities
+// CPU/Disk intensive job!
+func (batch *SubmissionActivityBatch) LoadAdditionalProperties(col store.Collection) {
+	batchname, provider, version := batch.GetKeys()
+	stats := EnrichmentStats{BatchName: batchname, AdviceProvider: provider, VersionNumber: version, Total: len(batch.Batch)}
+	reasons := make(map[*SubmissionActivity]string)
+
+	// Group records by activity date so that each date is loaded once
+	groups := make(map[uint32][]*SubmissionActivity)
+	for _, v := range batch.Batch {
+		if batch.Profiles.Get(v.AdviceProvider).Matching == util.MatchNone {
+			stats.NotEnriched++
+			continue
+		}
+		if batch.Types != nil {
+			if _, ok := batch.Types.ByName(v.AdviceProvider, v.ActivityType); !ok {
+				// Unknown types are reported when loaded and never match a transaction
+				reasons[v] = UnmatchedUnknownType
+				stats.UnknownType++
+				continue
+			}
+		}
+		date := batch.BusinessDay.Date(v.Time)
+		groups[date] = append(groups[date], v)
+	}
+	dates := make([]uint32, 0, len(groups))
+	for date := range groups {
+		dates = append(dates, date)
+	}
+	sort.Slice(dates, func(i, j int) bool { return dates[i] < dates[j] })
+
+	loaded := make(map[uint32]map[uint32]Transaction)
+	// Small batches query the transactions of their MRNs instead of loading whole dates
+	indexed := batch.Index != nil && len(batch.Batch) <= batch.Index.Threshold
+	if indexed {
+		var submissions []*SubmissionActivity
+		for _, date := range dates {
+			submissions = append(submissions, groups[date]...)
+		}
+		loaded = batch.Index.Lookup(submissions, batch.DateWindow, batch.BusinessDay, batch.txTypes, col)
+	}
+	for _, date := range dates {
+		// Release dates which are out of the window of the remaining groups
+		if !indexed {
+			for d := range loaded {
+				if d+batch.DateWindow < date {
+					delete(loaded, d)
+				}
+			}
+		}
+		for _, v := range groups[date] {
+			txHashes := txHashCodes(v.MerchantReferenceNumber, batch.txTypes(v))
+			matches := 0
+			// Search the dates around the activity time, closest first
+			for _, d := range candidateDates(v.Time, batch.DateWindow, batch.BusinessDay) {
+				hashmap, ok := loaded[d]
+				if !ok && !indexed {
+					hashmap = batch.getTransactions(d, col)
+					loaded[d] = hashmap
+				}
+				for _, txHash := range txHashes {
+					if tx, ok := hashmap[txHash]; ok {
+						if matches == 0 {
+							v.SellerOfRecord = tx.SOR
+							v.Partner = tx.Partner
+							v.InternalMRN = tx.InternalMRN
+						}
+						matches++
+					}
+				}
+			}
+			switch {
+			case matches == 0:
+				reasons[v] = UnmatchedNoTransaction
+				stats.Unmatched++
+			case matches > 1:
+				stats.Ambiguous++
+			default:
+				stats.Matched++
+			}
+		}
+	}
+
+	// Enriched properties are part of the hash code
+	batch.rehash(reasons)
+	batch.Stats = stats
+	logger.Info("Enriched", logger.KeyBatchName, batchname, logger.KeyProvider, provider, logger.KeyVersion, version, "total", stats.Total, "matched", stats.Matched,
+		"ambiguous", stats.Ambiguous, "unmatched", stats.Unmatched, "unknowntype", stats.UnknownType, "notenriched", stats.NotEnriched)
+	batch.reportUnmatched()
+}
+
+// rehash - rebuild the batch keyed by the current hash codes
+func (batch *SubmissionActivityBatch) rehash(reasons map[*SubmissionActivity]string) {
+	rehashed := make(map[uint32]*SubmissionActivity, len(batch.Batch))
+	batch.Unmatched = make(map[uint32]string)
+	for _, v := range batch.Batch {
+		hash := v.GetHashCode()
+		if _, ok := rehashed[hash]; ok {
+			continue
+		}
+		rehashed[hash] = v
+		if reason, ok := reasons[v]; ok {
+			batch.Unmatched[hash] = reason
+		}
+	}
+	batch.Batch = rehashed
+}
+
+// getTransactions - get transactions of a date from cache or store
+func (batch *SubmissionActivityBatch) getTransactions(date uint32, col store.Collection) map[uint32]Transaction {
+	hashmap, _ := batch.Cache.GetOrLoad(date, func() (map[uint32]Transaction, int64, error) {
+		hashmap := ReadTxFromStore(date, col)
+		return hashmap, TxMapCost(hashmap), nil
+	})
+	return hashmap
+}
+
+// reportUnmatched - print counts of unmatched records by reason and a sample of each
+func (batch *SubmissionActivityBatch) reportUnmatched() {
+	if len(batch.Unmatched) == 0 {
+		return
+	}
+	log := batchLogger(batch)
+	counts := make(map[string]int)
+	for hash, reason := range batch.Unmatched {
+		if counts[reason] == 0 {
+			v := batch.Batch[hash]
+			log.Info("Unmatched submission", "reason", reason, "mrn", v.MerchantReferenceNumber, "type", v.ActivityType, "time", v.Time)
+		}
+		counts[reason]++
+	}
+	for reason, count := range counts {
+		log.Info("Unmatched submissions", "reason", reason, logger.KeyCount, count)
+	}
+}
+
+// txTypes - transaction types a submission matches under the matching strategy of its provider
+func (batch *SubmissionActivityBatch) txTypes(v *SubmissionActivity) []string {
+	return matchingTxTypes(v.ActivityType, batch.Profiles.Get(v.AdviceProvider), batch.Types)
+}
+
+// matchingTxTypes - transaction types matched under a matching strategy: the activity type, or any registered type
+func matchingTxTypes(activityType string, profile util.ProviderProfile, types *util.TypeRegistry) []string {
+	if profile.Matching != util.MatchMRN || types == nil {
+		return []string{activityType}
+	}
+	return types.Names()
+}
+
+// txHashCodes - hash codes of the transactions of an MRN and the types
+func txHashCodes(mrn string, types []string) []uint32 {
+	hashes := make([]uint32, len(types))
+	for i, t := range types {
+		hashes[i] = GetTxHashCode(mrn, t)
+	}
+	return hashes
+}
+
+// candidateDates - the business date of the activity followed by up to window days before and after, ordered by
+// distance to the activity time
+func candidateDates(t time.Time, window uint32, day *util.BusinessDay) (dates []uint32) {
+	date := day.Date(t)
+	dates = append(dates, date)
+	// The previous day is closer if the activity is in the first half of its day
+	earlierFirst := t.Sub(day.Start(t)) < 12*time.Hour
+	for d := uint32(1); d <= window; d++ {
+		if earlierFirst && date >= d {
+			dates = append(dates, date-d)
+		}
+		dates = append(dates, date+d)
+		if !earlierFirst && date >= d {
+			dates = append(dates, date-d)
+		}
+	}
+	return
+}
@@ -0,0 +1,91 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"../common"
+	"../store"
+)
+
+// countingCollection - collection recording the queries of Find
+type countingCollection struct {
+	store.Collection
+	queries *[]bson.M
+}
+
+func (col countingCollection) Find(query bson.M) store.Query {
+	*col.queries = append(*col.queries, query)
+	return col.Collection.Find(query)
+}
+
+func TestCandidateDates(t *testing.T) {
+	at := func(ts string) time.Time {
+		tm, _ := time.Parse(time.RFC3339, ts)
+		return tm
+	}
+	date := util.GetDate(at("2017-03-01T00:00:00Z"))
+	cutoff, _ := util.NewBusinessDay("", "18:00")
+	tests := []struct {
+		name   string
+		time   time.Time
+		window uint32
+		day    *util.BusinessDay
+		dates  []uint32
+	}{
+		{"no window", at("2017-03-01T10:00:00Z"), 0, nil, []uint32{date}},
+		{"early, previous first", at("2017-03-01T10:00:00Z"), 2, nil, []uint32{date, date - 1, date + 1, date - 2, date + 2}},
+		{"late, next first", at("2017-03-01T20:00:00Z"), 1, nil, []uint32{date, date + 1, date - 1}},
+		{"no dates before the epoch", at("1970-01-01T10:00:00Z"), 2, nil, []uint32{0, 1, 2}},
+		// The business day after the 18:00 cutoff starts on the evening before
+		{"after cutoff", at("2017-03-01T19:00:00Z"), 1, cutoff, []uint32{date + 1, date, date + 2}},
+		{"before cutoff, late in the business day", at("2017-03-01T10:00:00Z"), 1, cutoff, []uint32{date, date + 1, date - 1}},
+	}
+	for _, test := range tests {
+		if dates := candidateDates(test.time, test.window, test.day); !reflect.DeepEqual(dates, test.dates) {
+			t.Errorf("%s: got %v, want %v", test.name, dates, test.dates)
+		}
+	}
+}
+
+func TestLoadAdditionalPropertiesGroupsByDate(t *testing.T) {
+	date := util.GetDate(time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC))
+	var queries []bson.M
+	cTx := countingCollection{store.NewMemory(), &queries}
+	batch := NewSubmissionActivityBatch()
+	// Nothing is cached, so each load of a date is a query
+	batch.Cache = NewTxCache(1, 0, 0)
+	batch.Types = util.NewTypeRegistry(nil)
+	batch.DateWindow = 1
+	for i, day := range []string{"01", "02", "03"} {
+		mrn := "MRN" + day
+		cTx.Insert(&Transaction{MRN: mrn, TransactionType: "Charge", InternalMRN: "I" + day, Date: date + uint32(i)})
+		for _, ts := range []string{"T08:00:00Z", "T10:00:00Z"} {
+			act := newSubmission(mrn, "Charge", "2017-03-"+day+ts, 1, 1)
+			batch.Batch[act.GetHashCode()] = act
+		}
+	}
+	batch.LoadAdditionalProperties(cTx)
+
+	// Each date of the window around the three dates is loaded once
+	loaded := make(map[uint32]int)
+	for _, query := range queries {
+		loaded[query["date"].(uint32)]++
+	}
+	want := map[uint32]int{date - 1: 1, date: 1, date + 1: 1, date + 2: 1, date + 3: 1}
+	if !reflect.DeepEqual(loaded, want) {
+		t.Errorf("got loads %v, want %v", loaded, want)
+	}
+	stats := batch.Stats
+	if stats.Total != 6 || stats.Matched != 6 || stats.BatchName != "1001" || stats.AdviceProvider != "Paypal" || stats.VersionNumber != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	for _, act := range batch.Batch {
+		if act.InternalMRN != "I"+act.MerchantReferenceNumber[3:] {
+			t.Errorf("%s enriched with %s", act.MerchantReferenceNumber, act.InternalMRN)
+		}
+	}
+}
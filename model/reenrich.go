@@ -0,0 +1,183 @@
+package model
+
+import (
+	"sort"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"../common"
+	"../logger"
+	"../store"
+)
+
+// PendingSubmission - submission which did not match a transaction when loaded
+type PendingSubmission struct {
+	BatchName               string
+	AdviceProvider          string
+	VersionNumber           uint32
+	MerchantReferenceNumber string
+	MerchantID              string
+	ActivityType            string
+	Time                    time.Time
+	Currency                string
+	Date                    uint32
+}
+
+// TrackEnrichment - persist enrichment stats and track unmatched submissions for re-enrichment
+func (batch SubmissionActivityBatch) TrackEnrichment(cStats store.Collection, cPending store.Collection) {
+	if batch.Stats.Total == 0 {
+		return
+	}
+	batch.Stats.ProcessingTime = time.Now().UTC()
+	stats := store.NewWriter(cStats, batch.Writes)
+	err := stats.Insert(&batch.Stats)
+	if err == nil {
+		err = stats.Flush()
+	}
+	if err != nil {
+		logger.Fatal("Failed to save enrichment stats", logger.KeyBatchName, batch.Stats.BatchName, logger.KeyProvider, batch.Stats.AdviceProvider, logger.KeyVersion, batch.Stats.VersionNumber, logger.KeyError, err)
+	}
+
+	// Pending submissions of earlier versions are superseded by this version
+	_, err = cPending.RemoveAll(bson.M{"batchname": batch.Stats.BatchName, "adviceprovider": batch.Stats.AdviceProvider, "versionnumber": bson.M{"$lt": batch.Stats.VersionNumber}})
+	if err != nil {
+		logger.Fatal("Failed to remove superseded pending submissions", logger.KeyBatchName, batch.Stats.BatchName, logger.KeyProvider, batch.Stats.AdviceProvider, logger.KeyVersion, batch.Stats.VersionNumber, logger.KeyError, err)
+	}
+	w := store.NewWriter(cPending, batch.Writes)
+	for hash, reason := range batch.Unmatched {
+		if reason == UnmatchedNoTransaction {
+			if err = w.Insert(newPendingSubmission(batch.Batch[hash], batch.BusinessDay)); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		logger.Fatal("Failed to save pending submissions", logger.KeyBatchName, batch.Stats.BatchName, logger.KeyProvider, batch.Stats.AdviceProvider, logger.KeyVersion, batch.Stats.VersionNumber, logger.KeyError, err)
+	}
+}
+
+// ReenrichPending - enrich pending submissions which match transactions loaded since, update them in data store and emit corrective DA;
+// submissions match by the strategy of their provider's profile on the dates around their business day; DA is written with writes
+func ReenrichPending(window uint32, day *util.BusinessDay, profiles *util.ProfileRegistry, types *util.TypeRegistry, cPending store.Collection, cData store.Collection, cDA store.Collection, cTx store.Collection, writes store.WriteConfig) (count int) {
+	var pending []PendingSubmission
+	err := cPending.Find(nil).All(&pending)
+	if err != nil {
+		logger.Fatal("Failed to read pending submissions", logger.KeyError, err)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Date < pending[j].Date })
+
+	now := time.Now().UTC()
+	w := store.NewWriter(cDA, writes)
+	loaded := make(map[uint32]map[uint32]Transaction)
+	for _, p := range pending {
+		// Release dates which are out of the window of the remaining submissions
+		for d := range loaded {
+			if d+window < p.Date {
+				delete(loaded, d)
+			}
+		}
+		txHashes := txHashCodes(p.MerchantReferenceNumber, matchingTxTypes(p.ActivityType, profiles.Get(p.AdviceProvider), types))
+		var tx Transaction
+		matched := false
+		for _, d := range candidateDates(p.Time, window, day) {
+			hashmap, ok := loaded[d]
+			if !ok {
+				hashmap = ReadTxFromStore(d, cTx)
+				loaded[d] = hashmap
+			}
+			for _, txHash := range txHashes {
+				if tx, matched = hashmap[txHash]; matched {
+					break
+				}
+			}
+			if matched {
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		selector := p.selector()
+		var original SubmissionActivity
+		err = cData.Find(selector).One(&original)
+		if err == store.ErrNotFound {
+			// Nothing to correct
+			cPending.Remove(p.key())
+			continue
+		}
+		if err != nil {
+			logger.Fatal("Failed to read pending submission", logger.KeyBatchName, p.BatchName, logger.KeyProvider, p.AdviceProvider, logger.KeyVersion, p.VersionNumber, logger.KeyError, err)
+		}
+		err = cData.Update(selector, bson.M{"$set": bson.M{"internalmrn": tx.InternalMRN, "sellerofrecord": tx.SOR, "partner": tx.Partner}})
+		if err != nil {
+			logger.Fatal("Failed to update pending submission", logger.KeyBatchName, p.BatchName, logger.KeyProvider, p.AdviceProvider, logger.KeyVersion, p.VersionNumber, logger.KeyError, err)
+		}
+
+		// Reverse the unenriched activity and add the enriched one, both new documents
+		original.ID = ""
+		reversal := original
+		reversal.SetDocAmount(-original.DocAmount())
+		reversal.SetProcessingTime(now)
+		enriched := original
+		enriched.InternalMRN = tx.InternalMRN
+		enriched.SellerOfRecord = tx.SOR
+		enriched.Partner = tx.Partner
+		enriched.SetProcessingTime(now)
+		// Written before the pending submission is removed, a rerun finds the data record enriched and adds no DA
+		err = w.Insert(&reversal, &enriched)
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			logger.Fatal("Failed to write DA", logger.KeyBatchName, p.BatchName, logger.KeyProvider, p.AdviceProvider, logger.KeyVersion, p.VersionNumber, logger.KeyError, err)
+		}
+
+		err = cPending.Remove(p.key())
+		if err != nil && err != store.ErrNotFound {
+			logger.Fatal("Failed to remove pending submission", logger.KeyBatchName, p.BatchName, logger.KeyProvider, p.AdviceProvider, logger.KeyVersion, p.VersionNumber, logger.KeyError, err)
+		}
+		count++
+	}
+	return
+}
+
+func newPendingSubmission(act *SubmissionActivity, day *util.BusinessDay) (p PendingSubmission) {
+	p.BatchName = act.BatchName
+	p.AdviceProvider = act.AdviceProvider
+	p.VersionNumber = act.VersionNumber
+	p.MerchantReferenceNumber = act.MerchantReferenceNumber
+	p.MerchantID = act.MerchantID
+	p.ActivityType = act.ActivityType
+	p.Time = act.Time
+	p.Currency = act.Currency
+	p.Date = day.Date(act.Time)
+	return
+}
+
+// key - query of the pending submission itself
+func (p PendingSubmission) key() bson.M {
+	return bson.M{
+		"batchname":               p.BatchName,
+		"adviceprovider":          p.AdviceProvider,
+		"versionnumber":           p.VersionNumber,
+		"merchantreferencenumber": p.MerchantReferenceNumber,
+		"merchantid":              p.MerchantID,
+		"activitytype":            p.ActivityType,
+		"time":                    p.Time,
+		"currency":                p.Currency,
+	}
+}
+
+// selector - query of the unenriched submission by the properties of its hash code
+func (p PendingSubmission) selector() bson.M {
+	selector := p.key()
+	selector["internalmrn"] = ""
+	selector["sellerofrecord"] = ""
+	selector["partner"] = ""
+	return selector
+}
@@ -0,0 +1,123 @@
+package model
+
+import (
+	"io"
+	"testing"
+
+	"../common"
+	"../store"
+)
+
+// trackUnmatched - enrich a batch of the submissions without transactions and track them as pending
+func trackUnmatched(cPending store.Collection, acts ...*SubmissionActivity) *SubmissionActivityBatch {
+	batch := NewSubmissionActivityBatch()
+	batch.Cache = NewTxCache(1, 1<<20, 0)
+	for _, act := range acts {
+		batch.Batch[act.GetHashCode()] = act
+	}
+	batch.LoadAdditionalProperties(store.NewMemory())
+	batch.TrackEnrichment(store.NewMemory(), cPending)
+	return batch
+}
+
+func TestTrackEnrichmentSupersedesEarlierVersions(t *testing.T) {
+	cPending := store.NewMemory()
+	trackUnmatched(cPending, newSubmission("a", "Charge", "2017-03-01T10:00:00Z", 1, 1), newSubmission("b", "Charge", "2017-03-01T10:00:00Z", 1, 1))
+	trackUnmatched(cPending, newSubmission("b", "Charge", "2017-03-01T10:00:00Z", 1, 2))
+
+	var pending []PendingSubmission
+	cPending.Find(nil).All(&pending)
+	if len(pending) != 1 || pending[0].MerchantReferenceNumber != "b" || pending[0].VersionNumber != 2 {
+		t.Errorf("unexpected pending submissions %+v", pending)
+	}
+	if date := util.GetDate(pending[0].Time); len(pending) == 1 && pending[0].Date != date {
+		t.Errorf("got pending date %d, want %d", pending[0].Date, date)
+	}
+}
+
+func TestReenrichPendingWindow(t *testing.T) {
+	cData := store.NewMemory()
+	cDA := store.NewMemory()
+	cTx := store.NewMemory()
+	cPending := store.NewMemory()
+	act := newSubmission("late", "Charge", "2017-03-01T20:00:00Z", 10, 1)
+	trackUnmatched(cPending, act).InsertToStore(cData)
+	cTx.Insert(&Transaction{MRN: "late", TransactionType: "Charge", InternalMRN: "I1", Date: util.GetDate(act.Time) + 1})
+
+	if count := ReenrichPending(0, nil, nil, nil, cPending, cData, cDA, cTx, store.WriteConfig{}); count != 0 {
+		t.Errorf("re-enriched %d submissions with a transaction out of the window", count)
+	}
+	if count := ReenrichPending(1, nil, nil, nil, cPending, cData, cDA, cTx, store.WriteConfig{}); count != 1 {
+		t.Errorf("re-enriched %d submissions, want 1", count)
+	}
+}
+
+func TestReenrichPendingWithoutDataRecord(t *testing.T) {
+	cTx := store.NewMemory()
+	cPending := store.NewMemory()
+	cDA := store.NewMemory()
+	act := newSubmission("gone", "Charge", "2017-03-01T10:00:00Z", 10, 1)
+	trackUnmatched(cPending, act)
+	cTx.Insert(&Transaction{MRN: "gone", TransactionType: "Charge", InternalMRN: "I1", Date: util.GetDate(act.Time)})
+
+	// The data record was replaced since, so there is nothing to correct
+	if count := ReenrichPending(0, nil, nil, nil, cPending, store.NewMemory(), cDA, cTx, store.WriteConfig{}); count != 0 {
+		t.Errorf("re-enriched %d submissions", count)
+	}
+	if n, _ := cPending.Find(nil).Count(); n != 0 {
+		t.Errorf("%d submissions still pending", n)
+	}
+	if n, _ := cDA.Find(nil).Count(); n != 0 {
+		t.Errorf("wrote %d DA", n)
+	}
+}
+
+// flakyDA - collection whose first bulk write applies its first insert and then fails with a transient error
+type flakyDA struct {
+	*store.Memory
+	failed bool
+}
+
+func (col *flakyDA) Bulk() store.Bulk {
+	return &flakyDABulk{Bulk: col.Memory.Bulk(), col: col}
+}
+
+type flakyDABulk struct {
+	store.Bulk
+	col  *flakyDA
+	docs []interface{}
+}
+
+func (bulk *flakyDABulk) Insert(docs ...interface{}) {
+	bulk.docs = append(bulk.docs, docs...)
+}
+
+func (bulk *flakyDABulk) Run() (*store.BulkResult, error) {
+	if !bulk.col.failed {
+		bulk.col.failed = true
+		bulk.Bulk.Insert(bulk.docs[0])
+		bulk.Bulk.Run()
+		return nil, io.ErrUnexpectedEOF
+	}
+	bulk.Bulk.Insert(bulk.docs...)
+	return bulk.Bulk.Run()
+}
+
+func TestReenrichPendingRetriesDAWrites(t *testing.T) {
+	cData := store.NewMemory()
+	cDA := &flakyDA{Memory: store.NewMemory()}
+	cTx := store.NewMemory()
+	cPending := store.NewMemory()
+	act := newSubmission("retried", "Charge", "2017-03-01T10:00:00Z", 10, 1)
+	trackUnmatched(cPending, act).InsertToStore(cData)
+	cTx.Insert(&Transaction{MRN: "retried", TransactionType: "Charge", InternalMRN: "I1", Date: util.GetDate(act.Time)})
+
+	if count := ReenrichPending(0, nil, nil, nil, cPending, cData, cDA, cTx, store.WriteConfig{Retries: 1}); count != 1 {
+		t.Fatalf("re-enriched %d submissions, want 1", count)
+	}
+	// The reversal written by the failed attempt is not written again
+	var das []SubmissionActivity
+	if records := daRecords(t, cDA, &das); len(records) != 2 || das[0].Amount != -das[1].Amount {
+		t.Errorf("got DA %v", records)
+	}
+}
@@ -1,18 +1,18 @@
 package model
 
 import (
-	"bufio"
-	"encoding/json"
-	"log"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
-	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
-	"../cache"
 	"../common"
+	"../fx"
+	"../logger"
+	"../merchant"
+	"../store"
 )
 
 // SAC file syntax
@@ -48,12 +48,43 @@ type SubmissionActivity struct {
 	InternalMRN             string
 	SellerOfRecord          string
 	Partner                 string
+	LegalEntity             string
+	Country                 string
+	Region                  string
+	LocalCurrency           string
+	GroupCurrency           string
+	LocalRate               float32
+	GroupRate               float32
+	// AdviceType - the type as named in the advice, which keys the record while ActivityType is its registered name
+	AdviceType string
+	// Unconverted - a rate was missing at activity time, so LocAmount and GrpAmount are 0 rather than converted
+	Unconverted bool
+	// ID - _id of the document, set by the writer on each insert
+	ID bson.ObjectId `bson:"_id,omitempty"`
 }
 
 // SubmissionActivityBatch - slice of SubmissionActivity
 type SubmissionActivityBatch struct {
-	Batch map[uint32]*SubmissionActivity
-	Cache *cache.LRUCache
+	Batch     map[uint32]*SubmissionActivity
+	Cache     *TxCache
+	Rates     *fx.RateTable
+	Merchants *merchant.Master
+	Types     *util.TypeRegistry
+	Index     *TxIndex
+	// DateWindow - days before and after the activity date to search for transactions
+	DateWindow uint32
+	// BusinessDay - calendar of the dates submissions are matched to transactions and FX rates on, UTC days if nil
+	BusinessDay *util.BusinessDay
+	// Unmatched - reasons of records not matching a transaction, by record hash
+	Unmatched map[uint32]string
+	// Stats - outcome of matching the batch to transactions
+	Stats EnrichmentStats
+	// StreamThreshold - batches with at least this many records are compared by streaming both versions from the store, 0 to disable
+	StreamThreshold int
+	// Writes - bulk writes of records and DA
+	Writes store.WriteConfig
+	// Profiles - advice conventions by provider, the built-in profile applies if nil
+	Profiles *util.ProfileRegistry
 }
 
 // SubmissionActivityOperation - operations for SubmissionActivity
@@ -61,71 +92,54 @@ type SubmissionActivityOperation struct {
 }
 
 // GetLastVersion - get last version for the key
-func (op SubmissionActivityOperation) GetLastVersion(query *mgo.Query) uint32 {
+func (op SubmissionActivityOperation) GetLastVersion(query store.Query) uint32 {
 	var last SubmissionActivity
 	err := query.One(&last)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal("Failed to read last version", logger.KeyError, err)
 	}
 	return last.VersionNumber
 }
 
 // InsertToStore - insert records to store
-func (batch SubmissionActivityBatch) InsertToStore(col *mgo.Collection) {
+func (batch SubmissionActivityBatch) InsertToStore(col store.Collection) {
+	w := store.NewWriter(col, batch.Writes)
 	for _, v := range batch.Batch {
-		err := col.Insert(&v)
+		err := w.Insert(v)
 		if err != nil {
-			log.Fatal(err)
+			batchLogger(batch).Fatal("Failed to write activities", logger.KeyError, err)
 		}
 	}
-}
-
-// LoadAdditionalProperties - load tx properties to submission activities
-// CPU/Disk intensive job!
-func (batch *SubmissionActivityBatch) LoadAdditionalProperties(col *mgo.Collection) {
-	lastDate := uint32(0)
-	var hashmap map[uint32]Transaction
-	for _, v := range batch.Batch {
-		mrn := v.MerchantReferenceNumber
-		txtype := v.ActivityType
-		time := v.Time
-		date := util.GetDate(time)
-		if date != lastDate {
-			if r, ok := batch.Cache.Get(date); !ok {
-				hashmap = ReadTxFromStore(date, col)
-				batch.Cache.Put(date, hashmap)
-			} else {
-				hashmap = r.(map[uint32]Transaction)
-			}
-		}
-		hash := GetTxHashCode(mrn, txtype)
-		if tx, ok := hashmap[hash]; ok {
-			v.SellerOfRecord = tx.SOR
-			v.Partner = tx.Partner
-			v.InternalMRN = tx.InternalMRN
-		}
+	if err := w.Flush(); err != nil {
+		batchLogger(batch).Fatal("Failed to write activities", logger.KeyError, err)
 	}
 }
 
 // GetAndCompareLastBatch - get and compare last batch with current batch
-func (batch *SubmissionActivityBatch) GetAndCompareLastBatch(batchid string, provider string, version uint32, lastVer uint32, cData *mgo.Collection, cDA *mgo.Collection) {
+func (batch *SubmissionActivityBatch) GetAndCompareLastBatch(batchid string, provider string, version uint32, lastVer uint32, cData store.Collection, cDA store.Collection) {
+	if batch.StreamThreshold > 0 && len(batch.Batch) >= batch.StreamThreshold && storedAdviceTypes(batchid, provider, lastVer, cData) {
+		batch.streamCompareLastBatch(batchid, provider, version, lastVer, cData, cDA)
+		return
+	}
 	now := time.Now().UTC()
+	w := store.NewWriter(cDA, batch.Writes)
 	var lastRecords []SubmissionActivity
 	err := cData.Find(bson.M{"batchname": batchid, "adviceprovider": provider, "versionnumber": lastVer}).All(&lastRecords)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal("Failed to read last version", logger.KeyBatchName, batchid, logger.KeyProvider, provider, logger.KeyVersion, lastVer, logger.KeyError, err)
 	}
 
-	for _, o := range lastRecords {
+	for i := range lastRecords {
+		o := &lastRecords[i]
 		hash := o.GetHashCode()
 		// If record with same key exists
 		if v, ok := batch.Batch[hash]; ok {
 			diff := v.DocAmount() - o.DocAmount()
 			if diff != 0 {
 				v.SetDocAmount(diff)
-				err = cDA.Insert(&v)
+				err = w.Insert(v)
 				if err != nil {
-					log.Fatal(err)
+					logger.Fatal("Failed to write DA", logger.KeyBatchName, batchid, logger.KeyProvider, provider, logger.KeyVersion, version, logger.KeyError, err)
 				}
 			}
 			delete(batch.Batch, hash)
@@ -133,12 +147,67 @@ func (batch *SubmissionActivityBatch) GetAndCompareLastBatch(batchid string, pro
 			// If record has been removed
 			o.SetDocAmount(-o.DocAmount())
 			o.SetProcessingTime(now)
-			err = cDA.Insert(&o)
+			err = w.Insert(o)
 			if err != nil {
-				log.Fatal(err)
+				logger.Fatal("Failed to write DA", logger.KeyBatchName, batchid, logger.KeyProvider, provider, logger.KeyVersion, version, logger.KeyError, err)
 			}
 		}
 	}
+	if err = w.Flush(); err != nil {
+		logger.Fatal("Failed to write DA", logger.KeyBatchName, batchid, logger.KeyProvider, provider, logger.KeyVersion, version, logger.KeyError, err)
+	}
+}
+
+// storedAdviceTypes - the records of a version were stored with advice types, which the streamed compare orders them by;
+// a version stored before is compared in memory
+func storedAdviceTypes(batchid string, provider string, version uint32, cData store.Collection) bool {
+	n, err := cData.Find(bson.M{"batchname": batchid, "adviceprovider": provider, "versionnumber": version, "advicetype": bson.M{"$exists": false}}).Count()
+	if err != nil {
+		logger.Fatal("Failed to read last version", logger.KeyBatchName, batchid, logger.KeyProvider, provider, logger.KeyVersion, version, logger.KeyError, err)
+	}
+	if n > 0 {
+		logger.Info("Comparing a version stored without advice types in memory", logger.KeyBatchName, batchid, logger.KeyProvider, provider, logger.KeyVersion, version)
+	}
+	return n == 0
+}
+
+// streamCompareLastBatch - compare the last and current versions stored in data store in key order and add DA for
+// changed, removed and added records; the batch is left empty as all DA is added
+//
+// The loaded batch is released before the compare, which then holds a run of records sharing the key up to the
+// time second of each version and the pending DA writes. Loading the file still holds the whole batch, once.
+func (batch *SubmissionActivityBatch) streamCompareLastBatch(batchid string, provider string, version uint32, lastVer uint32, cData store.Collection, cDA store.Collection) {
+	now := time.Now().UTC()
+	w := store.NewWriter(cDA, batch.Writes)
+	insert := func(act *SubmissionActivity) {
+		if err := w.Insert(act); err != nil {
+			logger.Fatal("Failed to write DA", logger.KeyBatchName, batchid, logger.KeyProvider, provider, logger.KeyVersion, version, logger.KeyError, err)
+		}
+	}
+	// The current version is stored, its records are read back in key order
+	batch.Batch = make(map[uint32]*SubmissionActivity)
+	err := mergeVersions(versionIter(cData, batchid, provider, lastVer, sacKeyFields), versionIter(cData, batchid, provider, version, sacKeyFields), compareSubmissionRuns, compareSubmissionActivities,
+		func(o *SubmissionActivity, v *SubmissionActivity) {
+			// If record with same key exists
+			diff := v.DocAmount() - o.DocAmount()
+			if diff != 0 {
+				v.SetDocAmount(diff)
+				insert(v)
+			}
+		},
+		func(o *SubmissionActivity) {
+			// If record has been removed
+			o.SetDocAmount(-o.DocAmount())
+			o.SetProcessingTime(now)
+			insert(o)
+		},
+		insert)
+	if err != nil {
+		logger.Fatal("Failed to compare versions", logger.KeyBatchName, batchid, logger.KeyProvider, provider, logger.KeyVersion, version, logger.KeyError, err)
+	}
+	if err = w.Flush(); err != nil {
+		logger.Fatal("Failed to write DA", logger.KeyBatchName, batchid, logger.KeyProvider, provider, logger.KeyVersion, version, logger.KeyError, err)
+	}
 }
 
 // Count - get length of map
@@ -150,12 +219,15 @@ func (batch *SubmissionActivityBatch) Count() int {
 func NewSubmissionActivityBatch() *SubmissionActivityBatch {
 	var batch SubmissionActivityBatch
 	batch.Batch = make(map[uint32]*SubmissionActivity)
+	batch.Unmatched = make(map[uint32]string)
 	return &batch
 }
 
 // Clear - reset the buffer
 func (batch *SubmissionActivityBatch) Clear() {
 	batch.Batch = make(map[uint32]*SubmissionActivity)
+	batch.Unmatched = make(map[uint32]string)
+	batch.Stats = EnrichmentStats{}
 }
 
 // GetKeys - get batchid, provider and version of current batch
@@ -172,26 +244,104 @@ func (batch SubmissionActivityBatch) GetKeys() (batchid string, provider string,
 // GetHashCode - get hash code
 func (act *SubmissionActivity) GetHashCode() uint32 {
 	t := act.Time.UTC().Unix()
-	s := act.MerchantReferenceNumber + "-" + act.MerchantID + "-" + act.ActivityType + "-" + strconv.FormatInt(t, 10) + "-" + act.Currency + "-" + act.InternalMRN + "-" + act.SellerOfRecord + "-" + act.Partner
+	s := act.MerchantReferenceNumber + "-" + act.MerchantID + "-" + act.keyType() + "-" + strconv.FormatInt(t, 10) + "-" + act.Currency + "-" + act.InternalMRN + "-" + act.SellerOfRecord + "-" + act.Partner
 	hash := util.Hash(s)
 	return hash
 }
 
+// keyType - the type which keys the record, records stored without an advice type were keyed by their stored type
+func (act *SubmissionActivity) keyType() string {
+	if len(act.AdviceType) > 0 {
+		return act.AdviceType
+	}
+	return act.ActivityType
+}
+
 // LoadData - converts AAC to AccountActivity
-func (act *SubmissionActivity) LoadData(sac SAC) {
+func (act *SubmissionActivity) LoadData(sac SAC) (e error) {
 	act.BatchName = sac.AdviceFileName
 	act.AdviceProvider = sac.AdviceProvider
 	act.VersionNumber = sac.Version
 	act.ActivityType = sac.ActivityType
-	act.Time = util.ParseTime(sac.ActivityTime)
+	act.AdviceType = sac.ActivityType
 	act.MerchantID = sac.MerchantID
 	act.Currency = sac.Currency
 	act.Amount = sac.Amount
 	act.MerchantReferenceNumber = sac.MerchantReferenceNumber
-	act.DownloadedTime = util.ParseTime(sac.DownloadedTime)
+	if act.Time, e = util.ParseTime(sac.ActivityTime); e != nil {
+		return
+	}
+	if act.DownloadedTime, e = util.ParseTime(sac.DownloadedTime); e != nil {
+		return
+	}
 	act.LastModifiedTime = time.Now().UTC()
+	return
+}
+
+// decode - converts the SAC on the current line of the decoder to SubmissionActivity
+func (act *SubmissionActivity) decode(d *adviceDecoder) error {
+	var times adviceTimes
+	e := d.Fields(func(key []byte, value []byte) error {
+		ok, e := act.setField(d, string(key), value, &times)
+		if !ok && e == nil {
+			// Keys match the syntax case-insensitively, like encoding/json
+			if name, found := sacFieldNames[strings.ToLower(string(key))]; found {
+				_, e = act.setField(d, name, value, &times)
+			}
+		}
+		return e
+	})
+	if e != nil {
+		return e
+	}
+	profile := d.Profile(act.AdviceProvider)
+	if act.Time, e = profile.ParseTime(times.activity); e != nil {
+		return e
+	}
+	if act.DownloadedTime, e = d.ParseTime(times.downloaded); e != nil {
+		return e
+	}
+	act.Amount = profile.ProviderAmount(act.Amount)
+	act.LastModifiedTime = time.Now().UTC()
+	return nil
 }
 
+// setField - set the field of a key of the SAC syntax, ok is false for unknown keys
+func (act *SubmissionActivity) setField(d *adviceDecoder, key string, value []byte, times *adviceTimes) (ok bool, e error) {
+	ok = true
+	switch key {
+	case "AdviceFileName":
+		act.BatchName = d.String(value)
+	case "AdviceProvider":
+		act.AdviceProvider = d.String(value)
+	case "Version":
+		act.VersionNumber, e = parseVersion(value)
+	case "TransactionType":
+		act.ActivityType = d.String(value)
+		act.AdviceType = act.ActivityType
+	case "DownloadedTime":
+		times.downloaded = d.String(value)
+	case "TimeStamp":
+		times.activity = string(value)
+	case "MerchantId":
+		act.MerchantID = d.String(value)
+	case "Currency":
+		act.Currency = d.String(value)
+	case "Amount":
+		act.Amount, e = parseAmount(value)
+	case "MerchantReferenceNumber":
+		act.MerchantReferenceNumber = string(value)
+	case "CorrelationId", "AdditionalData", "RecordId":
+		// Not used
+	default:
+		ok = false
+	}
+	return
+}
+
+// sacFieldNames - decoded SAC keys by their lower case
+var sacFieldNames = map[string]string{"advicefilename": "AdviceFileName", "adviceprovider": "AdviceProvider", "version": "Version", "transactiontype": "TransactionType", "downloadedtime": "DownloadedTime", "timestamp": "TimeStamp", "merchantid": "MerchantId", "currency": "Currency", "amount": "Amount", "merchantreferencenumber": "MerchantReferenceNumber"}
+
 // BatchID - get file name or batch name
 func (act SubmissionActivity) BatchID() string {
 	return act.BatchName
@@ -229,14 +379,12 @@ func (act *SubmissionActivity) SetDocAmount(amount float32) {
 
 // LocAmount - amount in local currency
 func (act SubmissionActivity) LocAmount() float32 {
-	// To do
-	return 0
+	return act.Amount * act.LocalRate
 }
 
 // GrpAmount - amount in group currency
 func (act SubmissionActivity) GrpAmount() float32 {
-	// To do
-	return 0
+	return act.Amount * act.GroupRate
 }
 
 // DocCurrency - document currency
@@ -246,12 +394,54 @@ func (act SubmissionActivity) DocCurrency() string {
 
 // LocCurrency - local currency
 func (act SubmissionActivity) LocCurrency() string {
-	return act.Currency
+	if len(act.LocalCurrency) == 0 {
+		return act.Currency
+	}
+	return act.LocalCurrency
 }
 
 // GrpCurrency - group currency
 func (act SubmissionActivity) GrpCurrency() string {
-	return "USD"
+	if len(act.GroupCurrency) == 0 {
+		return util.DefaultGroupCurrency
+	}
+	return act.GroupCurrency
+}
+
+// NormalizeType - map the provider's transaction type to the registered type and apply its sign convention,
+// unless the provider's profile keeps amounts as provided
+func (act *SubmissionActivity) NormalizeType(types *util.TypeRegistry, profile util.ProviderProfile) (ok bool) {
+	t, ok := types.ByName(act.AdviceProvider, act.ActivityType)
+	if !ok {
+		types.ReportUnknown(act.AdviceProvider, act.ActivityType)
+		return
+	}
+	act.ActivityType = t.Name
+	if profile.TypeSign() {
+		act.Amount = t.NormalizeAmount(act.Amount)
+	}
+	return
+}
+
+// LoadMerchant - enrich with merchant reference data
+func (act *SubmissionActivity) LoadMerchant(master *merchant.Master) {
+	if m, ok := master.Get(act.MerchantID); ok {
+		act.LegalEntity = m.LegalEntity
+		act.Country = m.Country
+		act.Region = m.Region
+		act.LocalCurrency = m.LocalCurrency
+	}
+}
+
+// ConvertCurrency - set group currency and the rates of the business day of the activity, false if a rate is missing
+func (act *SubmissionActivity) ConvertCurrency(rates *fx.RateTable, day *util.BusinessDay) bool {
+	date := day.Date(act.Time)
+	act.GroupCurrency = rates.GroupCurrency
+	var localOK, groupOK bool
+	act.LocalRate, localOK = rates.Rate(date, act.Currency, act.LocCurrency())
+	act.GroupRate, groupOK = rates.Rate(date, act.Currency, act.GroupCurrency)
+	act.Unconverted = !localOK || !groupOK
+	return !act.Unconverted
 }
 
 // Type - type of underling activity
@@ -264,31 +454,55 @@ func (act SubmissionActivity) ProcessingTime() time.Time {
 	return act.LastModifiedTime
 }
 
+// SetID - set the _id of the document
+func (act *SubmissionActivity) SetID(id bson.ObjectId) {
+	act.ID = id
+}
+
 // SetProcessingTime - set last modified time
 func (act *SubmissionActivity) SetProcessingTime(time time.Time) {
 	act.LastModifiedTime = time
 }
 
-// LoadDataFile - loads AAC file into data model
-func (batch *SubmissionActivityBatch) LoadDataFile(filename string) (count int) {
+// LoadDataFile - loads SAC file into data model, a line which cannot be decoded fails the file with a LineError
+func (batch *SubmissionActivityBatch) LoadDataFile(filename string) (count int, e error) {
 	file, e := os.Open(filename)
 	if e != nil {
-		log.Fatal("File error:" + e.Error())
-		os.Exit(3)
+		return 0, e
 	}
 	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		buffer := scanner.Bytes()
-		var sac SAC
-		json.Unmarshal(buffer, &sac)
+	decoder := newAdviceDecoder(file)
+	decoder.profiles = batch.Profiles
+	unconverted := 0
+	for decoder.Next() {
 		var activity SubmissionActivity
-		activity.LoadData(sac)
+		if err := activity.decode(decoder); err != nil {
+			// A skipped record would be compared as removed and reversed, so the file is not loaded at all
+			batch.Clear()
+			return 0, &LineError{File: filename, Line: decoder.lineNo, Err: err}
+		}
+		if batch.Types != nil {
+			activity.NormalizeType(batch.Types, decoder.Profile(activity.AdviceProvider))
+		}
+		if batch.Merchants != nil {
+			activity.LoadMerchant(batch.Merchants)
+		}
+		if batch.Rates != nil && !activity.ConvertCurrency(batch.Rates, batch.BusinessDay) {
+			unconverted++
+		}
 		hash := activity.GetHashCode()
 		if _, ok := batch.Batch[hash]; !ok {
 			batch.Batch[hash] = &activity
 		}
 	}
+	if e = decoder.Err(); e != nil {
+		// A partly read file would remove the unread records from DA
+		batch.Clear()
+		return 0, e
+	}
+	if unconverted > 0 {
+		logger.Warn("Missing FX rates, activities are unconverted", logger.KeyFile, filename, logger.KeyCount, unconverted)
+	}
 
-	return batch.Count()
+	return batch.Count(), nil
 }
@@ -0,0 +1,343 @@
+package model
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"../common"
+	"../store"
+)
+
+const sacLine = `{"AdviceFileName":"1001","AdviceProvider":"Paypal","Version":1,"TransactionType":"Charge","DownloadedTime":"2017-03-02T00:00:00Z","TimeStamp":"2017-03-01T10:00:00.000-08:00","MerchantId":"M1","Currency":"USD","Amount":10.5,"MerchantReferenceNumber":"MRN1"}`
+
+func newSubmission(mrn string, txType string, timestamp string, amount float32, version uint32) *SubmissionActivity {
+	var act SubmissionActivity
+	act.LoadData(SAC{AdviceFileName: "1001", AdviceProvider: "Paypal", Version: version, ActivityType: txType, DownloadedTime: "2017-03-02T00:00:00Z", ActivityTime: timestamp, MerchantID: "M1", Currency: "USD", Amount: amount, MerchantReferenceNumber: mrn})
+	return &act
+}
+
+func TestSubmissionActivityLoadDataFile(t *testing.T) {
+	types := util.NewTypeRegistry([]util.TransactionType{
+		{ID: 0, Name: "Charge"},
+		{ID: 1, Name: "Refund", Sign: -1, Aliases: map[string][]string{"Paypal": {"Reversal"}}},
+	})
+	tests := []struct {
+		name   string
+		lines  []string
+		count  int
+		txType string
+		amount float32
+	}{
+		{"single", []string{sacLine}, 1, "Charge", 10.5},
+		{"duplicate keeps first", []string{sacLine, strings.Replace(sacLine, "10.5", "3", 1)}, 1, "Charge", 10.5},
+		{"different MRN", []string{sacLine, strings.Replace(sacLine, "MRN1", "MRN2", 1)}, 2, "Charge", 10.5},
+		{"provider alias and sign", []string{strings.Replace(sacLine, `"Charge"`, `"Reversal"`, 1)}, 1, "Refund", -10.5},
+		{"unknown type is kept", []string{strings.Replace(sacLine, `"Charge"`, `"Payout"`, 1)}, 1, "Payout", 10.5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			batch := NewSubmissionActivityBatch()
+			batch.Types = types
+			if count, err := batch.LoadDataFile(writeFile(t, "1001.sac", test.lines...)); err != nil || count != test.count {
+				t.Fatalf("got %d records, %v, want %d", count, err, test.count)
+			}
+			for _, act := range batch.Batch {
+				if act.MerchantReferenceNumber == "MRN1" && (act.ActivityType != test.txType || act.Amount != test.amount) {
+					t.Errorf("got %s %v, want %s %v", act.ActivityType, act.Amount, test.txType, test.amount)
+				}
+			}
+		})
+	}
+	if unknown := types.Unknown(); unknown["Paypal|Payout"] != 1 {
+		t.Errorf("unknown type not reported: %v", unknown)
+	}
+}
+
+func TestSubmissionActivityLoadDataFileProfiles(t *testing.T) {
+	types := util.NewTypeRegistry([]util.TransactionType{{ID: 0, Name: "Charge"}, {ID: 1, Name: "Refund", Sign: -1}})
+	refund := strings.Replace(sacLine, `"Charge"`, `"Refund"`, 1)
+	tests := []struct {
+		name    string
+		profile util.ProviderProfile
+		line    string
+		amount  float32
+		time    time.Time
+	}{
+		{"default", util.ProviderProfile{}, refund, -10.5, time.Date(2017, 3, 1, 18, 0, 0, 0, time.UTC)},
+		{"inverted", util.ProviderProfile{AmountSign: util.SignInverted}, sacLine, -10.5, time.Date(2017, 3, 1, 18, 0, 0, 0, time.UTC)},
+		{"as provided", util.ProviderProfile{AmountSign: util.SignAsProvided}, refund, 10.5, time.Date(2017, 3, 1, 18, 0, 0, 0, time.UTC)},
+		{"time format", util.ProviderProfile{TimeFormats: []string{"02/01/2006 15:04"}}, strings.Replace(sacLine, "2017-03-01T10:00:00.000-08:00", "01/03/2017 10:00", 1), 10.5, time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC)},
+		{"time zone", util.ProviderProfile{TimeZone: "America/Los_Angeles"}, strings.Replace(sacLine, "2017-03-01T10:00:00.000-08:00", "2017-03-01T10:00:00", 1), 10.5, time.Date(2017, 3, 1, 18, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			batch := NewSubmissionActivityBatch()
+			batch.Types = types
+			batch.Profiles = util.NewProfileRegistry(map[string]util.ProviderProfile{"paypal": test.profile})
+			if _, err := batch.LoadDataFile(writeFile(t, "1001.sac", test.line)); err != nil {
+				t.Fatal(err)
+			}
+			for _, act := range batch.Batch {
+				if act.Amount != test.amount || !act.Time.Equal(test.time) {
+					t.Errorf("got %v at %v, want %v at %v", act.Amount, act.Time, test.amount, test.time)
+				}
+			}
+		})
+	}
+}
+
+func TestSubmissionActivityLoadDataFileBadTime(t *testing.T) {
+	batch := NewSubmissionActivityBatch()
+	file := writeFile(t, "1001.sac", sacLine, strings.Replace(sacLine, "2017-03-01T10:00:00.000-08:00", "yesterday", 1))
+	_, err := batch.LoadDataFile(file)
+	// A timestamp in none of the layouts fails the file instead of stopping the service
+	var timeErr *util.TimeError
+	if lineErr, ok := err.(*LineError); !ok || lineErr.Line != 2 || !errors.As(lineErr.Err, &timeErr) {
+		t.Errorf("got %#v, want a time error of line 2", err)
+	}
+	if len(batch.Batch) != 0 {
+		t.Errorf("got %d records, want 0", len(batch.Batch))
+	}
+}
+
+func TestSubmissionActivityNormalizeType(t *testing.T) {
+	types := util.NewTypeRegistry([]util.TransactionType{{ID: 1, Name: "Refund", Sign: -1, Aliases: map[string][]string{"Paypal": {"Return"}}}})
+	act := SubmissionActivity{AdviceProvider: "Paypal", ActivityType: "Return", Amount: 10.5}
+	if !act.NormalizeType(types, util.ProviderProfile{}) || act.ActivityType != "Refund" || act.Amount != -10.5 {
+		t.Errorf("got %+v", act)
+	}
+	// Unknown types keep their name and amount and are reported
+	act = SubmissionActivity{AdviceProvider: "Paypal", ActivityType: "Adjustment", Amount: 10.5}
+	if act.NormalizeType(types, util.ProviderProfile{}) || act.ActivityType != "Adjustment" || act.Amount != 10.5 {
+		t.Errorf("got %+v", act)
+	}
+	if unknown := types.Unknown(); unknown["Paypal|Adjustment"] != 1 {
+		t.Errorf("got unknown types %v", unknown)
+	}
+}
+
+func TestSubmissionActivityHashCode(t *testing.T) {
+	act := newSubmission("MRN1", "Charge", "2017-03-01T10:00:00.000-08:00", 10, 1)
+	hash := act.GetHashCode()
+	// The hash keys records across versions stored by earlier releases, so it must not change
+	if hash != 0x7f095aaa {
+		t.Errorf("hash code changed to %#x", hash)
+	}
+	if other := newSubmission("MRN1", "Charge", "2017-03-01T10:00:00.000-08:00", 20, 2); other.GetHashCode() != hash {
+		t.Error("hash depends on amount or version")
+	}
+	if other := newSubmission("MRN2", "Charge", "2017-03-01T10:00:00.000-08:00", 10, 1); other.GetHashCode() == hash {
+		t.Error("hash does not depend on MRN")
+	}
+	enriched := *act
+	enriched.InternalMRN = "I1"
+	if enriched.GetHashCode() == hash {
+		t.Error("hash does not depend on enriched properties")
+	}
+}
+
+func TestSubmissionActivityGetAndCompareLastBatch(t *testing.T) {
+	const ts = "2017-03-01T10:00:00.000-08:00"
+	cData := store.NewMemory()
+	cDA := store.NewMemory()
+	last := NewSubmissionActivityBatch()
+	for _, act := range []*SubmissionActivity{newSubmission("same", "Charge", ts, 10, 1), newSubmission("changed", "Charge", ts, 10, 1), newSubmission("removed", "Charge", ts, 10, 1)} {
+		last.Batch[act.GetHashCode()] = act
+	}
+	last.InsertToStore(cData)
+
+	batch := NewSubmissionActivityBatch()
+	for _, act := range []*SubmissionActivity{newSubmission("same", "Charge", ts, 10, 2), newSubmission("changed", "Charge", ts, 4, 2), newSubmission("added", "Charge", ts, 7, 2)} {
+		batch.Batch[act.GetHashCode()] = act
+	}
+	batch.GetAndCompareLastBatch("1001", "Paypal", 2, 1, cData, cDA)
+
+	var da []SubmissionActivity
+	cDA.Find(nil).All(&da)
+	want := map[string]float32{"changed": -6, "removed": -10}
+	if len(da) != len(want) {
+		t.Fatalf("got %d DA records, want %d: %+v", len(da), len(want), da)
+	}
+	for _, act := range da {
+		if amount, ok := want[act.MerchantReferenceNumber]; !ok || act.Amount != amount {
+			t.Errorf("unexpected DA %s %v", act.MerchantReferenceNumber, act.Amount)
+		}
+	}
+	if len(batch.Batch) != 1 {
+		t.Fatalf("got %d remaining records, want 1", len(batch.Batch))
+	}
+}
+
+func TestLoadAdditionalProperties(t *testing.T) {
+	day := func(ts string) uint32 {
+		tm, _ := time.Parse(time.RFC3339, ts)
+		return util.GetDate(tm)
+	}
+	cTx := store.NewMemory()
+	cTx.Insert(
+		&Transaction{MRN: "today", TransactionType: "Charge", InternalMRN: "I1", SOR: "S1", Partner: "P1", Date: day("2017-03-01T00:00:00Z")},
+		&Transaction{MRN: "tomorrow", TransactionType: "Charge", InternalMRN: "I2", SOR: "S2", Partner: "P2", Date: day("2017-03-02T00:00:00Z")},
+		&Transaction{MRN: "both", TransactionType: "Charge", InternalMRN: "near", Date: day("2017-03-02T00:00:00Z")},
+		&Transaction{MRN: "both", TransactionType: "Charge", InternalMRN: "far", Date: day("2017-02-28T00:00:00Z")},
+		&Transaction{MRN: "refund", TransactionType: "Refund", InternalMRN: "I3", Date: day("2017-03-01T00:00:00Z")},
+	)
+
+	tests := []struct {
+		name        string
+		window      uint32
+		indexed     bool
+		mrn         string
+		txType      string
+		internalMRN string
+		reason      string
+	}{
+		{"same date", 0, false, "today", "Charge", "I1", ""},
+		{"next date out of window", 0, false, "tomorrow", "Charge", "", UnmatchedNoTransaction},
+		{"next date in window", 1, false, "tomorrow", "Charge", "I2", ""},
+		{"closest of two dates", 1, false, "both", "Charge", "near", ""},
+		{"type must match", 1, false, "refund", "Charge", "", UnmatchedNoTransaction},
+		{"unknown type", 1, false, "today", "Payout", "", UnmatchedUnknownType},
+		{"indexed same date", 0, true, "today", "Charge", "I1", ""},
+		{"indexed next date in window", 1, true, "tomorrow", "Charge", "I2", ""},
+		{"indexed no transaction", 1, true, "missing", "Charge", "", UnmatchedNoTransaction},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			batch := NewSubmissionActivityBatch()
+			batch.Cache = NewTxCache(2, 1<<20, 0)
+			batch.Types = util.NewTypeRegistry(nil)
+			batch.DateWindow = test.window
+			if test.indexed {
+				batch.Index = NewTxIndex(10, true, 0.01)
+			}
+			// Late in the day, so the next date is closer than the previous
+			act := newSubmission(test.mrn, test.txType, "2017-03-01T20:00:00Z", 10, 1)
+			batch.Batch[act.GetHashCode()] = act
+			batch.LoadAdditionalProperties(cTx)
+
+			if act.InternalMRN != test.internalMRN {
+				t.Errorf("got InternalMRN %q, want %q", act.InternalMRN, test.internalMRN)
+			}
+			if _, ok := batch.Batch[act.GetHashCode()]; !ok {
+				t.Error("batch is not keyed by the enriched hash code")
+			}
+			if reason := batch.Unmatched[act.GetHashCode()]; reason != test.reason {
+				t.Errorf("got unmatched reason %q, want %q", reason, test.reason)
+			}
+		})
+	}
+}
+
+func TestLoadAdditionalPropertiesMatching(t *testing.T) {
+	cTx := store.NewMemory()
+	cTx.Insert(&Transaction{MRN: "refund", TransactionType: "Refund", InternalMRN: "I3", Date: util.GetDate(time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC))})
+	tests := []struct {
+		matching    string
+		internalMRN string
+		stats       EnrichmentStats
+	}{
+		{util.MatchMRNAndType, "", EnrichmentStats{Total: 1, Unmatched: 1}},
+		{util.MatchMRN, "I3", EnrichmentStats{Total: 1, Matched: 1}},
+		{util.MatchNone, "", EnrichmentStats{Total: 1, NotEnriched: 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.matching, func(t *testing.T) {
+			batch := NewSubmissionActivityBatch()
+			batch.Cache = NewTxCache(1, 1<<20, 0)
+			batch.Types = util.NewTypeRegistry(nil)
+			batch.Profiles = util.NewProfileRegistry(map[string]util.ProviderProfile{"Paypal": {Matching: test.matching}})
+			act := newSubmission("refund", "Charge", "2017-03-01T10:00:00Z", 10, 1)
+			batch.Batch[act.GetHashCode()] = act
+			batch.LoadAdditionalProperties(cTx)
+
+			stats := batch.Stats
+			stats.BatchName, stats.AdviceProvider, stats.VersionNumber = "", "", 0
+			if act.InternalMRN != test.internalMRN || stats != test.stats {
+				t.Errorf("got InternalMRN %q and %+v, want %q and %+v", act.InternalMRN, stats, test.internalMRN, test.stats)
+			}
+			if test.matching == util.MatchNone && len(batch.Unmatched) > 0 {
+				t.Errorf("submissions which are not enriched are pending: %v", batch.Unmatched)
+			}
+		})
+	}
+}
+
+func TestEnrichmentStats(t *testing.T) {
+	cTx := store.NewMemory()
+	date := util.GetDate(time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC))
+	cTx.Insert(
+		&Transaction{MRN: "one", TransactionType: "Charge", Date: date},
+		&Transaction{MRN: "two", TransactionType: "Charge", Date: date},
+		&Transaction{MRN: "two", TransactionType: "Charge", Date: date + 1},
+	)
+	batch := NewSubmissionActivityBatch()
+	batch.Cache = NewTxCache(1, 1<<20, 0)
+	batch.Types = util.NewTypeRegistry(nil)
+	batch.DateWindow = 1
+	for _, act := range []*SubmissionActivity{
+		newSubmission("one", "Charge", "2017-03-01T10:00:00Z", 1, 1),
+		newSubmission("two", "Charge", "2017-03-01T10:00:00Z", 1, 1),
+		newSubmission("three", "Charge", "2017-03-01T10:00:00Z", 1, 1),
+		newSubmission("one", "Payout", "2017-03-01T10:00:00Z", 1, 1),
+	} {
+		batch.Batch[act.GetHashCode()] = act
+	}
+	batch.LoadAdditionalProperties(cTx)
+
+	stats := batch.Stats
+	if stats.Total != 4 || stats.Matched != 1 || stats.Ambiguous != 1 || stats.Unmatched != 1 || stats.UnknownType != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	cStats := store.NewMemory()
+	cPending := store.NewMemory()
+	batch.TrackEnrichment(cStats, cPending)
+	if n, _ := cStats.Find(nil).Count(); n != 1 {
+		t.Errorf("got %d stats documents, want 1", n)
+	}
+	var pending []PendingSubmission
+	cPending.Find(nil).All(&pending)
+	if len(pending) != 1 || pending[0].MerchantReferenceNumber != "three" {
+		t.Errorf("unexpected pending submissions %+v", pending)
+	}
+}
+
+func TestReenrichPending(t *testing.T) {
+	cData := store.NewMemory()
+	cDA := store.NewMemory()
+	cTx := store.NewMemory()
+	cPending := store.NewMemory()
+	cStats := store.NewMemory()
+
+	batch := NewSubmissionActivityBatch()
+	batch.Cache = NewTxCache(1, 1<<20, 0)
+	act := newSubmission("late", "Charge", "2017-03-01T10:00:00Z", 10, 1)
+	batch.Batch[act.GetHashCode()] = act
+	batch.LoadAdditionalProperties(cTx)
+	batch.InsertToStore(cData)
+	batch.TrackEnrichment(cStats, cPending)
+
+	if count := ReenrichPending(0, nil, nil, nil, cPending, cData, cDA, cTx, store.WriteConfig{}); count != 0 {
+		t.Fatalf("re-enriched %d submissions without transactions", count)
+	}
+	cTx.Insert(&Transaction{MRN: "late", TransactionType: "Charge", InternalMRN: "I1", SOR: "S1", Partner: "P1", Date: util.GetDate(act.Time)})
+	if count := ReenrichPending(0, nil, nil, nil, cPending, cData, cDA, cTx, store.WriteConfig{}); count != 1 {
+		t.Fatalf("re-enriched %d submissions, want 1", count)
+	}
+
+	var data []SubmissionActivity
+	cData.Find(nil).All(&data)
+	if len(data) != 1 || data[0].InternalMRN != "I1" || data[0].SellerOfRecord != "S1" {
+		t.Errorf("data record not enriched: %+v", data)
+	}
+	var da []SubmissionActivity
+	cDA.Find(nil).All(&da)
+	if len(da) != 2 || da[0].Amount != -10 || da[0].InternalMRN != "" || da[1].Amount != 10 || da[1].InternalMRN != "I1" {
+		t.Errorf("unexpected corrective DA %+v", da)
+	}
+	if n, _ := cPending.Find(nil).Count(); n != 0 {
+		t.Errorf("%d submissions still pending", n)
+	}
+}
@@ -3,17 +3,22 @@ package model
 import (
 	"bufio"
 	"encoding/csv"
+	"errors"
 	"io"
-	"log"
 	"os"
 	"path"
+	"reflect"
 	"strconv"
+	"time"
+	"unsafe"
 
-	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
+	"../cache"
 	"../common"
 	"../fs"
+	"../logger"
+	"../store"
 )
 
 // Transaction - represents a transaction with properties used in submission DA
@@ -24,21 +29,119 @@ type Transaction struct {
 	SOR             string
 	Partner         string
 	Date            uint32
+	Version         uint32
+}
+
+// Update policies of transactions already in store
+const (
+	// TxUpdateLastWriterWins - the last loaded transaction replaces the stored one
+	TxUpdateLastWriterWins = "LastWriterWins"
+	// TxUpdateVersion - the transaction replaces the stored one only if its version is not lower
+	TxUpdateVersion = "Version"
+)
+
+// TxIngestSummary - outcome of loading transactions
+type TxIngestSummary struct {
+	Inserted  int
+	Updated   int
+	Unchanged int
+	Stale     int
+	Duplicate int
+	Rejected  int
+}
+
+// TxCache - cache of transactions keyed by date and tx hash
+type TxCache = cache.ShardedCache[uint32, map[uint32]Transaction]
+
+// NewTxCache - create a tx cache sharded by date
+func NewTxCache(shards int, capacity int64, ttl time.Duration) *TxCache {
+	return cache.NewSharded[uint32, map[uint32]Transaction](shards, capacity, ttl, func(date uint32) uint32 { return date })
+}
+
+// TxListener - notified of transactions saved to the store
+type TxListener interface {
+	TransactionsSaved(transactions []Transaction)
+}
+
+// TxCacheInvalidator - invalidates cached dates of saved transactions
+type TxCacheInvalidator struct {
+	Cache *TxCache
+}
+
+// TransactionsSaved - invalidate the dates of the transactions
+func (invalidator TxCacheInvalidator) TransactionsSaved(transactions []Transaction) {
+	dates := make(map[uint32]bool)
+	for _, tx := range transactions {
+		if !dates[tx.Date] {
+			dates[tx.Date] = true
+			invalidator.Cache.Invalidate(tx.Date)
+		}
+	}
+}
+
+// TxLoader - loads transaction files into the store
+type TxLoader struct {
+	Types        *util.TypeRegistry
+	Schema       *TxSchema
+	RejectDir    string
+	UpdatePolicy string
+	// BatchSize - transactions per bulk write, util.TxBatchSize if 0
+	BatchSize int
+	// Listeners - notified of saved transactions
+	Listeners []TxListener
+	indexed   bool
+	// failed - modification times of files with a TxFileError kept in TxDIR as there is no reject dir, not loaded again
+	// until modified
+	failed map[string]time.Time
+}
+
+// NewTxLoader - constructor
+func NewTxLoader(types *util.TypeRegistry, schema *TxSchema, rejectDir string) *TxLoader {
+	var loader TxLoader
+	loader.Types = types
+	loader.Schema = schema
+	loader.RejectDir = rejectDir
+	loader.UpdatePolicy = TxUpdateLastWriterWins
+	loader.failed = make(map[string]time.Time)
+	return &loader
 }
 
 // LoadTxFile - load, process and delete files
-func LoadTxFile(txDir string, cTx *mgo.Collection) (e error) {
+func (loader *TxLoader) LoadTxFile(txDir string, cTx store.Collection) (summary TxIngestSummary, e error) {
+	if !loader.indexed {
+		// Without the unique index duplicates would be inserted, so no file is loaded until it exists
+		if e = ensureTxIndex(cTx); e != nil {
+			logger.Error("Failed to ensure unique tx index", logger.KeyError, e)
+			return
+		}
+		loader.indexed = true
+	}
+
 	// Load transactions
 	files := fs.LoadFilesByTime(txDir)
 	for _, file := range files {
+		if t, ok := loader.failed[file.Name()]; ok && t.Equal(file.ModTime()) {
+			continue
+		}
 		txfile := path.Join(txDir, file.Name())
 		_, txErr := os.Stat(txfile)
 		if txErr == nil {
-			println("Loading Tx from", file.Name())
-			transactions := loadTx(txfile, cTx)
-			println("Loaded", transactions, "transactions.")
+			logger.Info("Loading transactions", logger.KeyFile, file.Name())
+			fileSummary, loadErr := loader.loadTx(txfile, cTx)
+			summary.add(fileSummary)
+			if _, ok := loadErr.(*TxFileError); ok {
+				loader.reject(txfile, file, loadErr)
+				e = loadErr
+				continue
+			}
+			if loadErr != nil {
+				// Keep the file for the next round
+				logger.Error("Failed to load transactions", logger.KeyFile, file.Name(), logger.KeyError, loadErr)
+				e = loadErr
+				continue
+			}
+			logger.Info("Loaded transactions", append([]interface{}{logger.KeyFile, file.Name()}, fileSummary.Fields()...)...)
 			fs.DeleteFilesWithSuffix(txDir, file.Name())
-			println("Deleted tx.csv")
 		} else {
 			e = txErr
 		}
@@ -46,78 +149,306 @@ func LoadTxFile(txDir string, cTx *mgo.Collection) (e error) {
 	return
 }
 
-func loadTx(filepath string, col *mgo.Collection) (total int) {
+// txKeys - fields of the unique key of transactions
+var txKeys = []string{"mrn", "transactiontype", "date"}
+
+// ensureTxIndex - create the unique tx index, first removing duplicates left by loads without the index
+func ensureTxIndex(cTx store.Collection) error {
+	e := cTx.EnsureIndex(txKeys, true)
+	if !store.IsDup(e) {
+		return e
+	}
+	removed, e := dedupeTx(cTx)
+	if e != nil {
+		return e
+	}
+	logger.Warn("Removed duplicate transactions", logger.KeyCount, removed)
+	return cTx.EnsureIndex(txKeys, true)
+}
+
+// dedupeTx - keep the transaction with the highest version of each key, the latest stored one if versions are equal
+func dedupeTx(cTx store.Collection) (removed int, e error) {
+	fields := bson.M{"version": 1}
+	for _, k := range txKeys {
+		fields[k] = 1
+	}
+	iter := cTx.Find(nil).Select(fields).Sort(append(append([]string{}, txKeys...), "-version", "-_id")...).Iter()
+	var last bson.M
+	var ids []interface{}
+	for {
+		doc := bson.M{}
+		if !iter.Next(&doc) {
+			break
+		}
+		if last != nil && sameTxKey(doc, last) {
+			ids = append(ids, doc["_id"])
+			continue
+		}
+		last = doc
+	}
+	if e = iter.Close(); e != nil {
+		return
+	}
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > util.TxBatchSize {
+			n = util.TxBatchSize
+		}
+		count, err := cTx.RemoveAll(bson.M{"_id": bson.M{"$in": ids[:n]}})
+		removed += count
+		if err != nil {
+			return removed, err
+		}
+		ids = ids[n:]
+	}
+	return
+}
+
+// sameTxKey - the stored transactions have the same unique key
+func sameTxKey(a bson.M, b bson.M) bool {
+	for _, k := range txKeys {
+		if !reflect.DeepEqual(a[k], b[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// reject - move a file which cannot be loaded to the reject dir, or keep it but skip it until it is modified
+func (loader *TxLoader) reject(txfile string, file os.FileInfo, reason error) {
+	if len(loader.RejectDir) > 0 {
+		e := fs.MoveFile(txfile, loader.RejectDir)
+		if e == nil {
+			logger.Error("Rejected transaction file", logger.KeyFile, file.Name(), "dir", loader.RejectDir, logger.KeyError, reason)
+			return
+		}
+		logger.Error("Failed to move transaction file to the reject dir", logger.KeyFile, file.Name(), logger.KeyError, e)
+	}
+	logger.Error("Rejected transaction file, skipped until modified", logger.KeyFile, file.Name(), logger.KeyError, reason)
+	loader.failed[file.Name()] = file.ModTime()
+}
+
+func (loader *TxLoader) loadTx(filepath string, col store.Collection) (summary TxIngestSummary, e error) {
 	f, e := os.Open(filepath)
 	if e != nil {
-		log.Fatal(e)
+		return
 	}
+	defer f.Close()
 	reader := bufio.NewReader(f)
 	r := csv.NewReader(reader)
-	total = 0
-	var i uint32
-	transactions := make([]interface{}, util.TxBufferSize)
+	r.FieldsPerRecord = -1
+
+	var header []string
+	if loader.Schema.Header {
+		header, e = r.Read()
+		if e == io.EOF {
+			e = &TxFileError{Err: errors.New("missing header")}
+		} else if _, ok := e.(*csv.ParseError); ok {
+			e = &TxFileError{Err: e}
+		}
+		if e != nil {
+			return
+		}
+	}
+	columns, e := loader.Schema.Resolve(header)
+	if e != nil {
+		e = &TxFileError{Err: e}
+		return
+	}
+
+	rejects := newRejectWriter(loader.RejectDir, filepath)
+	defer rejects.Close()
+
+	versionAware := loader.UpdatePolicy == TxUpdateVersion
+	batchSize := loader.BatchSize
+	if batchSize <= 0 {
+		batchSize = util.TxBatchSize
+	}
+	// Grown on demand, so small files do not allocate a whole batch
+	var transactions []Transaction
+	// Index of a key in the buffer to de-duplicate transactions within the file
+	keys := make(map[uint32]int)
 	for {
 		record, err := r.Read()
 		if err == io.EOF {
-			if i > 0 {
-				saveTx(transactions[:i], col)
+			if len(transactions) > 0 {
+				summary.add(saveTx(transactions, col, versionAware))
+				loader.notify(transactions)
 			}
 			break
 		}
 		if err != nil {
-			log.Fatal(err)
+			if _, ok := err.(*csv.ParseError); !ok {
+				e = err
+				return
+			}
+			rejects.Write(record, err)
+			summary.Rejected++
+			continue
 		}
 
 		var transaction Transaction
-		transaction.LoadData(record)
-		transactions[i] = transaction
-		i++
-		total++
-		if i >= util.TxBufferSize {
-			saveTx(transactions, col)
-			transactions = make([]interface{}, util.TxBufferSize)
-			i = 0
+		if err = transaction.LoadData(record, columns, loader.Schema, loader.Types); err != nil {
+			rejects.Write(record, err)
+			summary.Rejected++
+			continue
+		}
+		key := transaction.GetKeyHashCode()
+		if i, ok := keys[key]; ok && transactions[i].sameKey(transaction) {
+			if !versionAware || transaction.Version >= transactions[i].Version {
+				transactions[i] = transaction
+			}
+			summary.Duplicate++
+			continue
+		}
+		keys[key] = len(transactions)
+		transactions = append(transactions, transaction)
+		if len(transactions) >= batchSize {
+			summary.add(saveTx(transactions, col, versionAware))
+			loader.notify(transactions)
+			transactions = transactions[:0]
+			keys = make(map[uint32]int)
 		}
 	}
 	return
 }
 
-func saveTx(transactions []interface{}, col *mgo.Collection) {
-	println("Saving", len(transactions), "transactions...")
+// notify - notify listeners of saved transactions
+func (loader *TxLoader) notify(transactions []Transaction) {
+	for _, listener := range loader.Listeners {
+		listener.TransactionsSaved(transactions)
+	}
+}
+
+// saveTx - upsert transactions by key
+func saveTx(transactions []Transaction, col store.Collection, versionAware bool) (summary TxIngestSummary) {
+	logger.Debug("Saving transactions", logger.KeyCount, len(transactions))
 	bulk := col.Bulk()
-	bulk.Unordered()
-	bulk.Insert(transactions...)
-	_, e := bulk.Run()
+	for i := range transactions {
+		tx := &transactions[i]
+		selector := tx.keySelector()
+		if versionAware {
+			// Transactions stored before versions were tracked have none and are replaced by any version
+			selector["$or"] = []bson.M{{"version": bson.M{"$exists": false}}, {"version": bson.M{"$lte": tx.Version}}}
+			bulk.Update(selector, bson.M{"$set": tx})
+		} else {
+			bulk.Upsert(selector, bson.M{"$set": tx})
+		}
+	}
+	result, e := bulk.Run()
 	if e != nil {
-		log.Fatal(e)
+		logger.Fatal("Failed to save transactions", logger.KeyError, e)
 	}
-	println("Saved", len(transactions), "transactions.")
-}
+	summary.Updated = result.Modified
+	summary.Unchanged = result.Matched - result.Modified
 
-// LoadData - loads data from deserialized csv record
-func (t *Transaction) LoadData(record []string) {
-	if len(record) >= 4 {
-		t.MRN = record[0]
-		v, e := strconv.ParseUint(record[1], 10, 16)
+	if !versionAware {
+		summary.Inserted = len(transactions) - result.Matched
+	} else {
+		// Insert the transactions which were not updated, existing keys are rejected by the unique index
+		bulk = col.Bulk()
+		for i := range transactions {
+			bulk.Insert(&transactions[i])
+		}
+		inserted, e := bulk.Run()
 		if e != nil {
-			log.Fatal(e)
+			logger.Fatal("Failed to insert transactions", logger.KeyError, e)
 		}
-		t.TransactionType = util.TransactionTypeIDToStr(uint16(v))
-		internalMRN := record[2]
-		if internalMRN == "#" {
-			t.InternalMRN = t.MRN
-		} else {
-			t.InternalMRN = internalMRN
+		summary.Inserted = len(transactions) - inserted.Duplicates
+		summary.Stale = inserted.Duplicates - result.Matched
+	}
+	logger.Debug("Saved transactions", logger.KeyCount, len(transactions))
+	return
+}
+
+func (summary *TxIngestSummary) add(other TxIngestSummary) {
+	summary.Inserted += other.Inserted
+	summary.Updated += other.Updated
+	summary.Unchanged += other.Unchanged
+	summary.Stale += other.Stale
+	summary.Duplicate += other.Duplicate
+	summary.Rejected += other.Rejected
+}
+
+// Fields - key value pairs of the summary for the log
+func (summary TxIngestSummary) Fields() []interface{} {
+	return []interface{}{"inserted", summary.Inserted, "updated", summary.Updated, "unchanged", summary.Unchanged,
+		"stale", summary.Stale, "duplicate", summary.Duplicate, "rejected", summary.Rejected}
+}
+
+// String - printable summary
+func (summary TxIngestSummary) String() string {
+	return "inserted: " + strconv.Itoa(summary.Inserted) +
+		" updated: " + strconv.Itoa(summary.Updated) +
+		" unchanged: " + strconv.Itoa(summary.Unchanged) +
+		" stale: " + strconv.Itoa(summary.Stale) +
+		" duplicate: " + strconv.Itoa(summary.Duplicate) +
+		" rejected: " + strconv.Itoa(summary.Rejected)
+}
+
+// LoadData - loads data from deserialized csv record
+func (t *Transaction) LoadData(record []string, columns TxColumns, schema *TxSchema, types *util.TypeRegistry) (e error) {
+	values := make(map[string]string)
+	for _, field := range txFields {
+		if values[field], e = columns.Value(record, field); e != nil {
+			return
 		}
-		t.SOR = record[3]
-		t.Partner = record[4]
-		var d uint64
-		d, e = strconv.ParseUint(record[5], 10, 32)
-		t.Date = uint32(d)
-		if e != nil {
-			log.Fatal(e)
+	}
+
+	t.MRN = values[TxFieldMRN]
+	if len(t.MRN) == 0 {
+		return errors.New("empty MRN")
+	}
+
+	var txType util.TransactionType
+	var ok bool
+	if v, err := strconv.ParseUint(values[TxFieldTransactionType], 10, 16); err == nil {
+		txType, ok = types.ByID(uint16(v))
+	} else {
+		txType, ok = types.ByName("", values[TxFieldTransactionType])
+	}
+	if !ok {
+		types.ReportUnknown("tx", values[TxFieldTransactionType])
+		return errors.New("unknown transaction type " + values[TxFieldTransactionType])
+	}
+	t.TransactionType = txType.Name
+
+	internalMRN := values[TxFieldInternalMRN]
+	if len(internalMRN) == 0 || internalMRN == schema.SelfReference {
+		t.InternalMRN = t.MRN
+	} else {
+		t.InternalMRN = internalMRN
+	}
+	t.SOR = values[TxFieldSOR]
+	t.Partner = values[TxFieldPartner]
+
+	d, e := strconv.ParseUint(values[TxFieldDate], 10, 32)
+	if e != nil {
+		return
+	}
+	t.Date = uint32(d)
+
+	if len(values[TxFieldVersion]) > 0 {
+		var v uint64
+		if v, e = strconv.ParseUint(values[TxFieldVersion], 10, 32); e != nil {
+			return
 		}
+		t.Version = uint32(v)
 	}
+	return
+}
+
+// GetKeyHashCode - get hash of the transaction key
+func (t *Transaction) GetKeyHashCode() uint32 {
+	return util.Hash(t.MRN + "-" + t.TransactionType + "-" + strconv.FormatUint(uint64(t.Date), 10))
+}
+
+func (t *Transaction) sameKey(other Transaction) bool {
+	return t.MRN == other.MRN && t.TransactionType == other.TransactionType && t.Date == other.Date
+}
+
+func (t *Transaction) keySelector() bson.M {
+	return bson.M{"mrn": t.MRN, "transactiontype": t.TransactionType, "date": t.Date}
 }
 
 // GetTxHashCode - get transaction hash
@@ -128,7 +459,7 @@ func GetTxHashCode(mrn string, transactiontype string) uint32 {
 }
 
 // ReadTxFromStore - Load transactions of the same date to a hash map using mrn and tx type as combined key
-func ReadTxFromStore(date uint32, col *mgo.Collection) map[uint32]Transaction {
+func ReadTxFromStore(date uint32, col store.Collection) map[uint32]Transaction {
 	var transactions []Transaction
 	col.Find(bson.M{"date": date}).All(&transactions)
 	hashmap := make(map[uint32]Transaction)
@@ -138,3 +469,13 @@ func ReadTxFromStore(date uint32, col *mgo.Collection) map[uint32]Transaction {
 	}
 	return hashmap
 }
+
+// TxMapCost - approximate memory used by transactions of a date in bytes
+func TxMapCost(hashmap map[uint32]Transaction) (cost int64) {
+	// Map entry with key, value and bucket overhead
+	entry := int64(unsafe.Sizeof(uint32(0))+unsafe.Sizeof(Transaction{})) + 16
+	for _, tx := range hashmap {
+		cost += entry + int64(len(tx.MRN)+len(tx.TransactionType)+len(tx.InternalMRN)+len(tx.SOR)+len(tx.Partner))
+	}
+	return
+}
@@ -0,0 +1,288 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"../common"
+	"../store"
+)
+
+func TestTxSchemaResolve(t *testing.T) {
+	header := []string{"Date", " Type ", "Merchant Ref", "Seller"}
+	tests := []struct {
+		name    string
+		schema  *TxSchema
+		header  []string
+		columns TxColumns
+		ok      bool
+	}{
+		{"legacy positional", NewTxSchema(false, nil, ""), nil,
+			TxColumns{TxFieldMRN: 0, TxFieldTransactionType: 1, TxFieldInternalMRN: 2, TxFieldSOR: 3, TxFieldPartner: 4, TxFieldDate: 5, TxFieldVersion: -1}, true},
+		{"header by name", NewTxSchema(true, map[string]string{TxFieldMRN: "Merchant Ref", TxFieldTransactionType: "Type", TxFieldDate: "Date", TxFieldSOR: "Seller", TxFieldPartner: "Partner"}, ""), header,
+			TxColumns{TxFieldMRN: 2, TxFieldTransactionType: 1, TxFieldInternalMRN: -1, TxFieldSOR: 3, TxFieldPartner: -1, TxFieldDate: 0, TxFieldVersion: -1}, true},
+		{"missing required column", NewTxSchema(true, map[string]string{TxFieldMRN: "MRN", TxFieldTransactionType: "Type", TxFieldDate: "Date"}, ""), header, nil, false},
+		{"invalid index", NewTxSchema(false, map[string]string{TxFieldMRN: "first", TxFieldTransactionType: "1", TxFieldDate: "2"}, ""), nil, nil, false},
+	}
+	for _, test := range tests {
+		columns, err := test.schema.Resolve(test.header)
+		if (err == nil) != test.ok || test.ok && !reflect.DeepEqual(columns, test.columns) {
+			t.Errorf("%s: got %v, %v, want %v", test.name, columns, err, test.columns)
+		}
+	}
+}
+
+func TestTransactionLoadData(t *testing.T) {
+	schema := NewTxSchema(false, nil, "")
+	columns, _ := schema.Resolve(nil)
+	types := util.NewTypeRegistry(nil)
+	tests := []struct {
+		record []string
+		want   Transaction
+		ok     bool
+	}{
+		{[]string{"MRN1", "0", "#", "SOR1", "P1", "17226"}, Transaction{MRN: "MRN1", TransactionType: "Charge", InternalMRN: "MRN1", SOR: "SOR1", Partner: "P1", Date: 17226}, true},
+		{[]string{"MRN1", "Refund", "I1", "SOR1", "P1", "17226"}, Transaction{MRN: "MRN1", TransactionType: "Refund", InternalMRN: "I1", SOR: "SOR1", Partner: "P1", Date: 17226}, true},
+		// The baseline indexed the date beyond the length it checked
+		{[]string{"MRN1", "0", "#", "SOR1"}, Transaction{}, false},
+		{[]string{"", "0", "#", "SOR1", "P1", "17226"}, Transaction{}, false},
+		{[]string{"MRN1", "Payout", "#", "SOR1", "P1", "17226"}, Transaction{}, false},
+		{[]string{"MRN1", "0", "#", "SOR1", "P1", "yesterday"}, Transaction{}, false},
+	}
+	for _, test := range tests {
+		var tx Transaction
+		err := tx.LoadData(test.record, columns, schema, types)
+		if (err == nil) != test.ok || test.ok && tx != test.want {
+			t.Errorf("%v: got %+v, %v, want %+v", test.record, tx, err, test.want)
+		}
+	}
+}
+
+// writeTxFile - write a tx file to a new tx dir
+func writeTxFile(t *testing.T, lines ...string) (dir string, file string) {
+	t.Helper()
+	dir = t.TempDir()
+	file = filepath.Join(dir, "tx.csv")
+	if e := os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	return
+}
+
+func TestLoadTxFileRejects(t *testing.T) {
+	txDir, _ := writeTxFile(t, "MRN1,0,#,SOR1,P1,17226", "MRN2,0,#,SOR1", `MRN3,0,#"x,SOR1,P1,17226`, "MRN4,Payout,#,SOR1,P1,17226")
+	rejectDir := t.TempDir()
+	col := store.NewMemory()
+	loader := NewTxLoader(util.NewTypeRegistry(nil), NewTxSchema(false, nil, ""), rejectDir)
+	summary, err := loader.LoadTxFile(txDir, col)
+	if err != nil || summary.Inserted != 1 || summary.Rejected != 3 {
+		t.Fatalf("got %+v, %v", summary, err)
+	}
+	content, err := os.ReadFile(filepath.Join(rejectDir, "tx.csv.rej"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each rejected record is written with the reason
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "MRN2,0,#,SOR1,missing Date") || !strings.Contains(lines[2], "unknown transaction type Payout") {
+		t.Errorf("got reject file\n%s", content)
+	}
+	if files, _ := os.ReadDir(txDir); len(files) != 0 {
+		t.Errorf("loaded file kept in the tx dir")
+	}
+}
+
+// savedBatches - listener recording the number of transactions of each saved batch
+type savedBatches []int
+
+func (batches *savedBatches) TransactionsSaved(transactions []Transaction) {
+	*batches = append(*batches, len(transactions))
+}
+
+func TestLoadTxFileBatches(t *testing.T) {
+	txDir, _ := writeTxFile(t, "MRN1,0,#,SOR1,P1,17226", "MRN2,0,#,SOR1,P1,17226", "MRN3,0,#,SOR1,P1,17226", "MRN4,0,#,SOR1,P1,17226", "MRN5,0,#,SOR1,P1,17226")
+	col := store.NewMemory()
+	loader := NewTxLoader(util.NewTypeRegistry(nil), NewTxSchema(false, nil, ""), "")
+	loader.BatchSize = 2
+	var batches savedBatches
+	loader.Listeners = []TxListener{&batches}
+	summary, err := loader.LoadTxFile(txDir, col)
+	if err != nil || summary.Inserted != 5 {
+		t.Fatalf("got %+v, %v", summary, err)
+	}
+	if fmt.Sprint(batches) != "[2 2 1]" {
+		t.Errorf("got batches %v, want [2 2 1]", batches)
+	}
+}
+
+func TestLoadTxFileRejectsFile(t *testing.T) {
+	schema := NewTxSchema(true, map[string]string{TxFieldMRN: "MRN", TxFieldTransactionType: "Type", TxFieldDate: "Date"}, "")
+	txDir, _ := writeTxFile(t, "MRN,Type,Day", "MRN1,0,17226")
+	rejectDir := filepath.Join(t.TempDir(), "rejected")
+	loader := NewTxLoader(util.NewTypeRegistry(nil), schema, rejectDir)
+	if _, err := loader.LoadTxFile(txDir, store.NewMemory()); err == nil {
+		t.Error("no error for a missing column")
+	} else if _, ok := err.(*TxFileError); !ok {
+		t.Errorf("got %#v", err)
+	}
+	// The file is moved to the reject dir instead of failing again each round
+	if _, err := os.Stat(filepath.Join(rejectDir, "tx.csv")); err != nil {
+		t.Error(err)
+	}
+	if files, _ := os.ReadDir(txDir); len(files) != 0 {
+		t.Errorf("rejected file kept in the tx dir")
+	}
+}
+
+func TestLoadTxFileSkipsFailedFile(t *testing.T) {
+	schema := NewTxSchema(true, map[string]string{TxFieldMRN: "MRN", TxFieldTransactionType: "Type", TxFieldDate: "Date"}, "")
+	txDir, file := writeTxFile(t, "MRN,Type,Day", "MRN1,0,17226")
+	col := store.NewMemory()
+	loader := NewTxLoader(util.NewTypeRegistry(nil), schema, "")
+	if _, err := loader.LoadTxFile(txDir, col); err == nil {
+		t.Fatal("no error for a missing column")
+	}
+	// Without a reject dir the file is kept but not loaded again until it is modified
+	if _, err := loader.LoadTxFile(txDir, col); err != nil {
+		t.Errorf("loaded an unchanged failed file again: %v", err)
+	}
+	os.WriteFile(file, []byte("MRN,Type,Date\nMRN1,0,17226\n"), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(file, later, later)
+	if summary, err := loader.LoadTxFile(txDir, col); err != nil || summary.Inserted != 1 {
+		t.Errorf("got %+v, %v for the fixed file", summary, err)
+	}
+}
+
+func TestSaveTxLastWriterWins(t *testing.T) {
+	col := store.NewMemory()
+	col.EnsureIndex(txKeys, true)
+	a := Transaction{MRN: "MRN1", TransactionType: "Charge", SOR: "SOR1", Date: 17226}
+	b := Transaction{MRN: "MRN2", TransactionType: "Charge", SOR: "SOR1", Date: 17226}
+	if summary := saveTx([]Transaction{a, b}, col, false); summary != (TxIngestSummary{Inserted: 2}) {
+		t.Errorf("got %v", summary)
+	}
+	changed := a
+	changed.SOR = "SOR2"
+	c := Transaction{MRN: "MRN3", TransactionType: "Refund", SOR: "SOR1", Date: 17226}
+	if summary := saveTx([]Transaction{changed, b, c}, col, false); summary != (TxIngestSummary{Inserted: 1, Updated: 1, Unchanged: 1}) {
+		t.Errorf("got %v", summary)
+	}
+	var stored Transaction
+	col.Find(a.keySelector()).One(&stored)
+	if stored != changed {
+		t.Errorf("got %+v, want %+v", stored, changed)
+	}
+}
+
+func TestSaveTxVersion(t *testing.T) {
+	col := store.NewMemory()
+	col.EnsureIndex(txKeys, true)
+	// Stored before versions were tracked
+	col.Insert(bson.M{"mrn": "MRN1", "transactiontype": "Charge", "sor": "SOR0", "date": 17226})
+	a := Transaction{MRN: "MRN1", TransactionType: "Charge", SOR: "SOR1", Date: 17226, Version: 1}
+	b := Transaction{MRN: "MRN2", TransactionType: "Charge", SOR: "SOR1", Date: 17226, Version: 2}
+	if summary := saveTx([]Transaction{a, b}, col, true); summary != (TxIngestSummary{Inserted: 1, Updated: 1}) {
+		t.Errorf("got %v", summary)
+	}
+	older := b
+	older.Version, older.SOR = 1, "SOR2"
+	if summary := saveTx([]Transaction{a, older}, col, true); summary != (TxIngestSummary{Unchanged: 1, Stale: 1}) {
+		t.Errorf("got %v", summary)
+	}
+	var stored Transaction
+	col.Find(b.keySelector()).One(&stored)
+	if stored != b {
+		t.Errorf("got %+v, want %+v", stored, b)
+	}
+}
+
+func TestLoadTxFileDedupesBeforeIndexing(t *testing.T) {
+	col := store.NewMemory()
+	// Loaded before the unique index existed
+	col.Insert(&Transaction{MRN: "MRN1", TransactionType: "Charge", SOR: "v1", Date: 17226, Version: 1},
+		&Transaction{MRN: "MRN1", TransactionType: "Charge", SOR: "v2", Date: 17226, Version: 2},
+		&Transaction{MRN: "MRN1", TransactionType: "Charge", SOR: "v2 later", Date: 17226, Version: 2},
+		&Transaction{MRN: "MRN1", TransactionType: "Refund", SOR: "other", Date: 17226})
+	loader := NewTxLoader(util.NewTypeRegistry(nil), NewTxSchema(false, nil, ""), "")
+	if _, err := loader.LoadTxFile(t.TempDir(), col); err != nil || !loader.indexed {
+		t.Fatalf("got %v, indexed %v", err, loader.indexed)
+	}
+	var stored []Transaction
+	col.Find(nil).Sort("transactiontype").All(&stored)
+	if len(stored) != 2 || stored[0].SOR != "v2 later" || stored[1].SOR != "other" {
+		t.Errorf("got %+v", stored)
+	}
+	if err := col.Insert(&Transaction{MRN: "MRN1", TransactionType: "Charge", Date: 17226}); !store.IsDup(err) {
+		t.Errorf("got %v, want a duplicate error of the unique index", err)
+	}
+}
+
+// failingIndex - collection which cannot create indexes
+type failingIndex struct {
+	*store.Memory
+}
+
+func (col failingIndex) EnsureIndex(keys []string, unique bool) error {
+	return errors.New("not authorized")
+}
+
+func TestLoadTxFileIndexFailure(t *testing.T) {
+	txDir, file := writeTxFile(t, "MRN1,0,#,SOR1,P1,17226")
+	col := failingIndex{store.NewMemory()}
+	loader := NewTxLoader(util.NewTypeRegistry(nil), NewTxSchema(false, nil, ""), "")
+	if _, err := loader.LoadTxFile(txDir, col); err == nil {
+		t.Error("no error without the unique index")
+	}
+	if loader.indexed {
+		t.Error("collection marked indexed")
+	}
+	// Nothing is loaded and the file is kept for the next round
+	if count, _ := col.Find(nil).Count(); count != 0 {
+		t.Errorf("loaded %d transactions", count)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTxMapCost(t *testing.T) {
+	short := map[uint32]Transaction{1: {MRN: "M1", TransactionType: "Charge"}}
+	long := map[uint32]Transaction{1: {MRN: "M1", TransactionType: "Charge", InternalMRN: "a much longer internal MRN"}}
+	two := map[uint32]Transaction{1: short[1], 2: short[1]}
+	if cost := TxMapCost(nil); cost != 0 {
+		t.Errorf("got cost %d for no transactions", cost)
+	}
+	if TxMapCost(long) <= TxMapCost(short) || TxMapCost(two) != 2*TxMapCost(short) {
+		t.Errorf("got costs %d, %d and %d", TxMapCost(short), TxMapCost(long), TxMapCost(two))
+	}
+}
+
+func TestTxCacheBound(t *testing.T) {
+	col := store.NewMemory()
+	for date := uint32(1); date <= 3; date++ {
+		col.Insert(&Transaction{MRN: "MRN1", TransactionType: "Charge", Date: date}, &Transaction{MRN: "MRN2", TransactionType: "Charge", Date: date})
+	}
+	// Room for the transactions of two dates
+	capacity := 2 * TxMapCost(ReadTxFromStore(1, col))
+	batch := NewSubmissionActivityBatch()
+	batch.Cache = NewTxCache(1, capacity, 0)
+	for date := uint32(1); date <= 3; date++ {
+		if hashmap := batch.getTransactions(date, col); len(hashmap) != 2 {
+			t.Errorf("date %d: got %d transactions", date, len(hashmap))
+		}
+	}
+	batch.getTransactions(3, col)
+	stats := batch.Cache.Stats()
+	if stats.Cost > capacity || stats.Entries != 2 || stats.Evictions != 1 || stats.Hits != 1 || stats.Misses != 3 {
+		t.Errorf("got %+v for capacity %d", stats, capacity)
+	}
+}
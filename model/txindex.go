@@ -0,0 +1,132 @@
+package model
+
+import (
+	"gopkg.in/mgo.v2/bson"
+
+	"../bloom"
+	"../cache"
+	"../common"
+	"../logger"
+	"../store"
+)
+
+// txLookupChunk - number of MRNs per indexed query
+const txLookupChunk = 1000
+
+// TxIndex - indexed transaction lookups for small batches, with optional per-date bloom filters
+type TxIndex struct {
+	// Threshold - batches with at most this many submissions use indexed lookups
+	Threshold int
+	// Bloom - pre-check keys against per-date bloom filters before querying the store
+	Bloom   bool
+	fpRate  float64
+	filters *cache.LRUCache[uint32, *bloom.Filter]
+}
+
+// NewTxIndex - constructor
+func NewTxIndex(threshold int, useBloom bool, fpRate float64) *TxIndex {
+	var index TxIndex
+	index.Threshold = threshold
+	index.Bloom = useBloom
+	index.fpRate = fpRate
+	index.filters = cache.New[uint32, *bloom.Filter](util.BloomCacheBytes, 0)
+	return &index
+}
+
+// Lookup - query the transactions of the MRNs of the submissions on the candidate dates of their business days,
+// returns transactions keyed by date and tx hash; txTypes are the transaction types each submission matches
+func (index *TxIndex) Lookup(submissions []*SubmissionActivity, window uint32, day *util.BusinessDay, txTypes func(v *SubmissionActivity) []string, col store.Collection) (loaded map[uint32]map[uint32]Transaction) {
+	loaded = make(map[uint32]map[uint32]Transaction)
+	mrns := make(map[string]bool)
+	dates := make(map[uint32]bool)
+	for _, v := range submissions {
+		types := txTypes(v)
+		for _, d := range candidateDates(v.Time, window, day) {
+			if _, ok := loaded[d]; !ok {
+				loaded[d] = make(map[uint32]Transaction)
+			}
+			if index.Bloom && !index.mayContain(d, v.MerchantReferenceNumber, types, col) {
+				continue
+			}
+			mrns[v.MerchantReferenceNumber] = true
+			dates[d] = true
+		}
+	}
+	if len(mrns) == 0 {
+		return
+	}
+
+	dateList := make([]uint32, 0, len(dates))
+	for d := range dates {
+		dateList = append(dateList, d)
+	}
+	chunk := make([]string, 0, txLookupChunk)
+	query := func() {
+		var transactions []Transaction
+		err := col.Find(bson.M{"mrn": bson.M{"$in": chunk}, "date": bson.M{"$in": dateList}}).All(&transactions)
+		if err != nil {
+			logger.Fatal("Failed to look up transactions", logger.KeyCount, len(chunk), logger.KeyError, err)
+		}
+		for _, tx := range transactions {
+			if hashmap, ok := loaded[tx.Date]; ok {
+				hashmap[GetTxHashCode(tx.MRN, tx.TransactionType)] = tx
+			}
+		}
+		chunk = chunk[:0]
+	}
+	for mrn := range mrns {
+		chunk = append(chunk, mrn)
+		if len(chunk) >= txLookupChunk {
+			query()
+		}
+	}
+	if len(chunk) > 0 {
+		query()
+	}
+	return
+}
+
+// mayContain - the bloom filter of the date may contain a transaction of the MRN and one of the types
+func (index *TxIndex) mayContain(date uint32, mrn string, types []string, col store.Collection) bool {
+	filter := index.filter(date, col)
+	for _, t := range types {
+		if filter.Test(mrn + "-" + t) {
+			return true
+		}
+	}
+	return false
+}
+
+// TransactionsSaved - add saved transactions to the bloom filters of their dates which are in memory
+func (index *TxIndex) TransactionsSaved(transactions []Transaction) {
+	if !index.Bloom {
+		return
+	}
+	for _, tx := range transactions {
+		if filter, ok := index.filters.Get(tx.Date); ok {
+			filter.Add(tx.MRN + "-" + tx.TransactionType)
+		}
+	}
+}
+
+// filter - get the bloom filter of a date, building it from store if not in memory
+func (index *TxIndex) filter(date uint32, col store.Collection) *bloom.Filter {
+	filter, _ := index.filters.GetOrLoad(date, func() (*bloom.Filter, int64, error) {
+		query := col.Find(bson.M{"date": date})
+		n, err := query.Count()
+		if err != nil {
+			logger.Fatal("Failed to count transactions", "date", date, logger.KeyError, err)
+		}
+		filter := bloom.New(n, index.fpRate)
+		var tx Transaction
+		iter := query.Select(bson.M{"mrn": 1, "transactiontype": 1}).Iter()
+		for iter.Next(&tx) {
+			filter.Add(tx.MRN + "-" + tx.TransactionType)
+		}
+		if err = iter.Close(); err != nil {
+			logger.Fatal("Failed to read transactions", "date", date, logger.KeyError, err)
+		}
+		return filter, int64(filter.Size()), nil
+	})
+	return filter
+}
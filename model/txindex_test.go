@@ -0,0 +1,135 @@
+package model
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"../common"
+	"../store"
+)
+
+// indexQueries - queries of transactions by MRN
+func indexQueries(queries []bson.M) (count int) {
+	for _, query := range queries {
+		if _, ok := query["mrn"]; ok {
+			count++
+		}
+	}
+	return
+}
+
+// enrichWith - enrich the submissions with the index, returning the enriched submissions by MRN and type
+func enrichWith(index *TxIndex, matching string, cTx store.Collection, acts []SubmissionActivity) (enriched map[string]SubmissionActivity, stats EnrichmentStats) {
+	batch := NewSubmissionActivityBatch()
+	batch.Cache = NewTxCache(1, 1<<20, 0)
+	batch.Types = util.NewTypeRegistry(nil)
+	batch.Profiles = util.NewProfileRegistry(map[string]util.ProviderProfile{"Paypal": {Matching: matching}})
+	batch.DateWindow = 1
+	batch.Index = index
+	for i := range acts {
+		act := acts[i]
+		batch.Batch[act.GetHashCode()] = &act
+	}
+	batch.LoadAdditionalProperties(cTx)
+	enriched = make(map[string]SubmissionActivity)
+	for _, act := range batch.Batch {
+		enriched[act.MerchantReferenceNumber+act.ActivityType+act.Time.String()] = *act
+	}
+	return enriched, batch.Stats
+}
+
+func TestTxIndexMatchesScan(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	cTx := store.NewMemory()
+	start := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	types := []string{"Charge", "Refund", "Chargeback"}
+	for i := 0; i < 500; i++ {
+		cTx.Insert(&Transaction{MRN: "MRN" + strconv.Itoa(random.Intn(200)), TransactionType: types[random.Intn(len(types))],
+			InternalMRN: "I" + strconv.Itoa(i), Date: util.GetDate(start) + uint32(random.Intn(10))})
+	}
+	var acts []SubmissionActivity
+	for i := 0; i < 300; i++ {
+		act := newSubmission("MRN"+strconv.Itoa(random.Intn(250)), types[random.Intn(len(types))],
+			start.Add(time.Duration(random.Intn(10*24*60))*time.Minute).Format(time.RFC3339), 1, 1)
+		acts = append(acts, *act)
+	}
+
+	for _, matching := range []string{util.MatchMRNAndType, util.MatchMRN} {
+		scanned, scanStats := enrichWith(nil, matching, cTx, acts)
+		if scanStats.Matched == 0 || scanStats.Unmatched == 0 {
+			t.Errorf("%s: no matched or unmatched submissions to compare: %+v", matching, scanStats)
+		}
+		for _, useBloom := range []bool{false, true} {
+			indexed, stats := enrichWith(NewTxIndex(len(acts), useBloom, 0.01), matching, cTx, acts)
+			if stats != scanStats {
+				t.Errorf("%s bloom %v: got stats %+v, scan %+v", matching, useBloom, stats, scanStats)
+			}
+			if len(indexed) != len(scanned) {
+				t.Fatalf("%s bloom %v: got %d submissions, scan %d", matching, useBloom, len(indexed), len(scanned))
+			}
+			for key, act := range scanned {
+				if got := indexed[key]; got.InternalMRN != act.InternalMRN || got.SellerOfRecord != act.SellerOfRecord || got.Partner != act.Partner {
+					t.Errorf("%s bloom %v: %s got %q, scan %q", matching, useBloom, key, got.InternalMRN, act.InternalMRN)
+				}
+			}
+		}
+	}
+}
+
+func TestTxIndexBloomSkipsMissingMRNs(t *testing.T) {
+	tests := []struct {
+		mrn     string
+		bloom   bool
+		queries int
+	}{
+		{"missing", false, 1},
+		{"missing", true, 0},
+		{"MRN1", true, 1},
+	}
+	for _, test := range tests {
+		var queries []bson.M
+		cTx := countingCollection{store.NewMemory(), &queries}
+		act := newSubmission(test.mrn, "Charge", "2017-03-01T10:00:00Z", 1, 1)
+		cTx.Insert(&Transaction{MRN: "MRN1", TransactionType: "Charge", InternalMRN: "I1", Date: util.GetDate(act.Time)})
+		enrichWith(NewTxIndex(10, test.bloom, 0.01), util.MatchMRNAndType, cTx, []SubmissionActivity{*act})
+		if count := indexQueries(queries); count != test.queries {
+			t.Errorf("%s bloom %v: got %d queries by MRN, want %d", test.mrn, test.bloom, count, test.queries)
+		}
+	}
+}
+
+func TestTxIndexThreshold(t *testing.T) {
+	var queries []bson.M
+	cTx := countingCollection{store.NewMemory(), &queries}
+	acts := []SubmissionActivity{*newSubmission("MRN1", "Charge", "2017-03-01T10:00:00Z", 1, 1), *newSubmission("MRN2", "Charge", "2017-03-01T10:00:00Z", 1, 1)}
+	cTx.Insert(&Transaction{MRN: "MRN1", TransactionType: "Charge", InternalMRN: "I1", Date: util.GetDate(acts[0].Time)})
+
+	// Batches above the threshold load whole dates
+	if _, stats := enrichWith(NewTxIndex(1, false, 0.01), util.MatchMRNAndType, cTx, acts); stats.Matched != 1 || indexQueries(queries) != 0 {
+		t.Errorf("got %+v with %d queries by MRN, want a scan", stats, indexQueries(queries))
+	}
+	queries = queries[:0]
+	if _, stats := enrichWith(NewTxIndex(2, false, 0.01), util.MatchMRNAndType, cTx, acts); stats.Matched != 1 || indexQueries(queries) != 1 {
+		t.Errorf("got %+v with %d queries by MRN, want an indexed lookup", stats, indexQueries(queries))
+	}
+}
+
+func TestTxIndexTransactionsSaved(t *testing.T) {
+	cTx := store.NewMemory()
+	index := NewTxIndex(10, true, 0.01)
+	date := util.GetDate(time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC))
+	if index.mayContain(date, "MRN1", []string{"Charge"}, cTx) {
+		t.Fatal("empty date may contain MRN1")
+	}
+	// The filter in memory learns saved transactions without being rebuilt
+	tx := Transaction{MRN: "MRN1", TransactionType: "Charge", Date: date}
+	cTx.Insert(&tx)
+	index.TransactionsSaved([]Transaction{tx})
+	if !index.mayContain(date, "MRN1", []string{"Refund", "Charge"}, cTx) {
+		t.Error("saved transaction not in the filter")
+	}
+}
@@ -0,0 +1,167 @@
+package model
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"../logger"
+)
+
+// Transaction fields which can be mapped to csv columns
+const (
+	TxFieldMRN             = "MRN"
+	TxFieldTransactionType = "TransactionType"
+	TxFieldInternalMRN     = "InternalMRN"
+	TxFieldSOR             = "SOR"
+	TxFieldPartner         = "Partner"
+	TxFieldDate            = "Date"
+	TxFieldVersion         = "Version"
+)
+
+var requiredTxFields = []string{TxFieldMRN, TxFieldTransactionType, TxFieldDate}
+
+var optionalTxFields = []string{TxFieldInternalMRN, TxFieldSOR, TxFieldPartner, TxFieldVersion}
+
+// txFields - all fields in the order they are resolved and read, so errors name the same field each time
+var txFields = append(append([]string{}, requiredTxFields...), optionalTxFields...)
+
+// TxSchema - column mapping of transaction csv files
+type TxSchema struct {
+	// Header - the first row holds column names
+	Header bool
+	// Columns - field to column name if Header, otherwise to zero-based column index
+	Columns map[string]string
+	// SelfReference - InternalMRN value meaning the InternalMRN is the MRN itself
+	SelfReference string
+}
+
+// TxColumns - resolved column indexes of a transaction file, -1 if not present
+type TxColumns map[string]int
+
+// NewTxSchema - create a schema, the legacy positional layout is used if columns is empty
+func NewTxSchema(header bool, columns map[string]string, selfReference string) *TxSchema {
+	var schema TxSchema
+	schema.Header = header
+	schema.Columns = columns
+	if len(schema.Columns) == 0 {
+		schema.Header = false
+		schema.Columns = map[string]string{
+			TxFieldMRN:             "0",
+			TxFieldTransactionType: "1",
+			TxFieldInternalMRN:     "2",
+			TxFieldSOR:             "3",
+			TxFieldPartner:         "4",
+			TxFieldDate:            "5",
+		}
+	}
+	schema.SelfReference = selfReference
+	if len(schema.SelfReference) == 0 {
+		schema.SelfReference = "#"
+	}
+	return &schema
+}
+
+// Resolve - get column indexes from the header row, or from the positional mapping if header is nil
+func (schema *TxSchema) Resolve(header []string) (columns TxColumns, e error) {
+	columns = make(TxColumns)
+	names := make(map[string]int)
+	for i, name := range header {
+		names[strings.TrimSpace(name)] = i
+	}
+	for _, field := range txFields {
+		columns[field] = -1
+		column, ok := schema.Columns[field]
+		if !ok {
+			continue
+		}
+		if schema.Header {
+			if i, found := names[column]; found {
+				columns[field] = i
+			}
+		} else {
+			i, err := strconv.Atoi(column)
+			if err != nil || i < 0 {
+				return nil, fmt.Errorf("invalid column index %q for %s", column, field)
+			}
+			columns[field] = i
+		}
+	}
+	for _, field := range requiredTxFields {
+		if columns[field] < 0 {
+			return nil, errors.New("missing column for " + field)
+		}
+	}
+	return
+}
+
+// Value - get the value of a field from a record
+func (columns TxColumns) Value(record []string, field string) (value string, e error) {
+	i := columns[field]
+	if i < 0 {
+		return
+	}
+	if i >= len(record) {
+		e = fmt.Errorf("missing %s in column %d of %d", field, i, len(record))
+		return
+	}
+	value = strings.TrimSpace(record[i])
+	return
+}
+
+// TxFileError - a transaction file cannot be loaded at all, e.g. a required column is missing, so loading it again fails
+// the same way
+type TxFileError struct {
+	Err error
+}
+
+func (e *TxFileError) Error() string {
+	return e.Err.Error()
+}
+
+// rejectWriter - writes rejected records with the reason to a csv file
+type rejectWriter struct {
+	filename string
+	file     *os.File
+	writer   *csv.Writer
+}
+
+func newRejectWriter(dir string, source string) *rejectWriter {
+	var w rejectWriter
+	if len(dir) > 0 {
+		w.filename = path.Join(dir, path.Base(source)+".rej")
+	}
+	return &w
+}
+
+// Write - write a rejected record, or log it if there is no reject dir
+func (w *rejectWriter) Write(record []string, reason error) {
+	if len(w.filename) == 0 {
+		logger.Warn("Rejected tx record", "record", strings.Join(record, ","), logger.KeyError, reason)
+		return
+	}
+	if w.writer == nil {
+		f, e := os.Create(w.filename)
+		if e != nil {
+			logger.Error("Failed to create reject file", logger.KeyFile, w.filename, logger.KeyError, e)
+			w.filename = ""
+			w.Write(record, reason)
+			return
+		}
+		w.file = f
+		w.writer = csv.NewWriter(f)
+	}
+	w.writer.Write(append(append([]string{}, record...), reason.Error()))
+}
+
+// Close - flush and close the reject file
+func (w *rejectWriter) Close() {
+	if w.writer != nil {
+		w.writer.Flush()
+		w.file.Close()
+	}
+}
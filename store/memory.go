@@ -0,0 +1,700 @@
+package store
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Memory - in-process collection for tests and tools, supporting the queries used by the model
+type Memory struct {
+	docs   []bson.M
+	unique []uniqueIndex
+	// ids - ids of the documents, unique as in MongoDB
+	ids   map[string]bool
+	mutex *sync.RWMutex
+}
+
+// uniqueIndex - ids of documents by their unique keys
+type uniqueIndex struct {
+	keys []string
+	ids  map[string]interface{}
+}
+
+// NewMemory - create an empty in-process collection
+func NewMemory() *Memory {
+	var col Memory
+	col.ids = make(map[string]bool)
+	col.mutex = &sync.RWMutex{}
+	return &col
+}
+
+// Find - query documents
+func (col *Memory) Find(query bson.M) Query {
+	return &memoryQuery{col: col, query: query}
+}
+
+// Insert - insert documents, stopping at the first one violating a unique index
+func (col *Memory) Insert(docs ...interface{}) error {
+	col.mutex.Lock()
+	defer col.mutex.Unlock()
+	for _, doc := range docs {
+		if e := col.insert(doc); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Update - update the first document matching the selector
+func (col *Memory) Update(selector bson.M, update bson.M) error {
+	col.mutex.Lock()
+	defer col.mutex.Unlock()
+	_, _, e := col.update(selector, update, false)
+	return e
+}
+
+// Remove - remove the first document matching the selector
+func (col *Memory) Remove(selector bson.M) error {
+	col.mutex.Lock()
+	defer col.mutex.Unlock()
+	query, e := normalize(selector)
+	if e != nil {
+		return e
+	}
+	for i, doc := range col.docs {
+		if matches(doc, query) {
+			col.unindex(doc)
+			col.docs = append(col.docs[:i], col.docs[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// RemoveAll - remove all documents matching the selector
+func (col *Memory) RemoveAll(selector bson.M) (removed int, e error) {
+	col.mutex.Lock()
+	defer col.mutex.Unlock()
+	query, e := normalize(selector)
+	if e != nil {
+		return
+	}
+	kept := col.docs[:0]
+	for _, doc := range col.docs {
+		if matches(doc, query) {
+			col.unindex(doc)
+			removed++
+		} else {
+			kept = append(kept, doc)
+		}
+	}
+	col.docs = kept
+	return
+}
+
+// EnsureIndex - unique indexes are enforced on insert and upsert, others are ignored
+func (col *Memory) EnsureIndex(keys []string, unique bool) error {
+	col.mutex.Lock()
+	defer col.mutex.Unlock()
+	if !unique {
+		return nil
+	}
+	index := uniqueIndex{keys: keys, ids: make(map[string]interface{})}
+	for _, doc := range col.docs {
+		key := index.key(doc)
+		if _, ok := index.ids[key]; ok {
+			return ErrDuplicate
+		}
+		index.ids[key] = doc["_id"]
+	}
+	col.unique = append(col.unique, index)
+	return nil
+}
+
+// Bulk - start a bulk write
+func (col *Memory) Bulk() Bulk {
+	return &memoryBulk{col: col}
+}
+
+// Pipe - run an aggregation pipeline, only a single $group stage with $max, $min and $sum is supported
+func (col *Memory) Pipe(pipeline []bson.M) Pipe {
+	return &memoryPipe{col: col, pipeline: pipeline}
+}
+
+// Docs - get all documents in insertion order
+func (col *Memory) Docs() []bson.M {
+	col.mutex.RLock()
+	defer col.mutex.RUnlock()
+	return append([]bson.M{}, col.docs...)
+}
+
+func (col *Memory) insert(doc interface{}) error {
+	m, e := toM(doc)
+	if e != nil {
+		return e
+	}
+	if _, ok := m["_id"]; !ok {
+		m["_id"] = bson.NewObjectId()
+	}
+	if col.ids[idKey(m)] || col.duplicate(m) {
+		return ErrDuplicate
+	}
+	col.docs = append(col.docs, m)
+	col.index(m)
+	return nil
+}
+
+// update - update or upsert the first document matching the selector
+func (col *Memory) update(selector bson.M, update bson.M, upsert bool) (matched bool, modified bool, e error) {
+	query, e := normalize(selector)
+	if e != nil {
+		return
+	}
+	set, replace := update["$set"], true
+	if set != nil {
+		replace = false
+	} else {
+		set = update
+	}
+	fields, e := toM(set)
+	if e != nil {
+		return
+	}
+	for i, doc := range col.docs {
+		if !matches(doc, query) {
+			continue
+		}
+		matched = true
+		updated := bson.M{"_id": doc["_id"]}
+		if !replace {
+			for k, v := range doc {
+				updated[k] = v
+			}
+		}
+		for k, v := range fields {
+			if k != "_id" {
+				updated[k] = v
+			}
+		}
+		if col.duplicate(updated) {
+			e = ErrDuplicate
+			return
+		}
+		modified = !reflect.DeepEqual(doc, updated)
+		col.unindex(doc)
+		col.docs[i] = updated
+		col.index(updated)
+		return
+	}
+	if !upsert {
+		e = ErrNotFound
+		return
+	}
+	// Insert the equality fields of the selector with the update
+	doc := bson.M{}
+	for k, v := range query {
+		if _, ok := v.(bson.M); !ok {
+			doc[k] = v
+		}
+	}
+	for k, v := range fields {
+		doc[k] = v
+	}
+	e = col.insert(doc)
+	return
+}
+
+// duplicate - another document has the same unique keys
+func (col *Memory) duplicate(doc bson.M) bool {
+	for _, index := range col.unique {
+		if id, ok := index.ids[index.key(doc)]; ok && !equal(id, doc["_id"]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (col *Memory) index(doc bson.M) {
+	col.ids[idKey(doc)] = true
+	for _, index := range col.unique {
+		index.ids[index.key(doc)] = doc["_id"]
+	}
+}
+
+func (col *Memory) unindex(doc bson.M) {
+	delete(col.ids, idKey(doc))
+	for _, index := range col.unique {
+		delete(index.ids, index.key(doc))
+	}
+}
+
+func idKey(doc bson.M) string {
+	return string(mustMarshal(bson.D{{Name: "_id", Value: doc["_id"]}}))
+}
+
+func (index uniqueIndex) key(doc bson.M) string {
+	values := make(bson.D, len(index.keys))
+	for i, k := range index.keys {
+		values[i] = bson.DocElem{Name: k, Value: doc[k]}
+	}
+	return string(mustMarshal(values))
+}
+
+// find - matching documents with the selected fields
+func (col *Memory) find(query bson.M, fields bson.M) (docs []bson.M, e error) {
+	query, e = normalize(query)
+	if e != nil {
+		return
+	}
+	col.mutex.RLock()
+	defer col.mutex.RUnlock()
+	for _, doc := range col.docs {
+		if !matches(doc, query) {
+			continue
+		}
+		if len(fields) > 0 {
+			selected := bson.M{"_id": doc["_id"]}
+			for k := range fields {
+				if v, ok := doc[k]; ok {
+					selected[k] = v
+				}
+			}
+			doc = selected
+		}
+		docs = append(docs, doc)
+	}
+	return
+}
+
+type memoryQuery struct {
+	col    *Memory
+	query  bson.M
+	fields bson.M
+	sort   []string
+}
+
+// find - matching documents in sort order
+func (query *memoryQuery) find() (docs []bson.M, e error) {
+	docs, e = query.col.find(query.query, query.fields)
+	if e != nil || len(query.sort) == 0 {
+		return
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, field := range query.sort {
+			desc := strings.HasPrefix(field, "-")
+			field = strings.TrimPrefix(field, "-")
+			if c := compare(docs[i][field], docs[j][field]); c != 0 {
+				return c < 0 != desc
+			}
+		}
+		return false
+	})
+	return
+}
+
+func (query *memoryQuery) All(result interface{}) error {
+	docs, e := query.find()
+	if e != nil {
+		return e
+	}
+	return unmarshalAll(docs, result)
+}
+
+func (query *memoryQuery) One(result interface{}) error {
+	docs, e := query.find()
+	if e != nil {
+		return e
+	}
+	if len(docs) == 0 {
+		return ErrNotFound
+	}
+	return unmarshal(docs[0], result)
+}
+
+func (query *memoryQuery) Count() (int, error) {
+	docs, e := query.col.find(query.query, nil)
+	return len(docs), e
+}
+
+func (query *memoryQuery) Select(fields bson.M) Query {
+	return &memoryQuery{col: query.col, query: query.query, fields: fields, sort: query.sort}
+}
+
+func (query *memoryQuery) Sort(fields ...string) Query {
+	return &memoryQuery{col: query.col, query: query.query, fields: query.fields, sort: fields}
+}
+
+func (query *memoryQuery) Iter() Iter {
+	docs, e := query.find()
+	return &memoryIter{docs: docs, err: e}
+}
+
+type memoryIter struct {
+	docs []bson.M
+	err  error
+}
+
+func (iter *memoryIter) Next(result interface{}) bool {
+	if iter.err != nil || len(iter.docs) == 0 {
+		return false
+	}
+	iter.err = unmarshal(iter.docs[0], result)
+	iter.docs = iter.docs[1:]
+	return iter.err == nil
+}
+
+func (iter *memoryIter) Close() error {
+	return iter.err
+}
+
+// memoryBulk - writes are applied in order when run
+type memoryBulk struct {
+	col *Memory
+	ops []func(result *BulkResult) error
+}
+
+func (bulk *memoryBulk) Insert(docs ...interface{}) {
+	for _, doc := range docs {
+		doc := doc
+		bulk.ops = append(bulk.ops, func(result *BulkResult) error {
+			e := bulk.col.insert(doc)
+			if e == ErrDuplicate {
+				result.Duplicates++
+				return nil
+			}
+			return e
+		})
+	}
+}
+
+func (bulk *memoryBulk) Update(pairs ...interface{}) {
+	bulk.pairs(pairs, false)
+}
+
+func (bulk *memoryBulk) Upsert(pairs ...interface{}) {
+	bulk.pairs(pairs, true)
+}
+
+func (bulk *memoryBulk) pairs(pairs []interface{}, upsert bool) {
+	for i := 0; i+1 < len(pairs); i += 2 {
+		selector, update := pairs[i].(bson.M), pairs[i+1].(bson.M)
+		bulk.ops = append(bulk.ops, func(result *BulkResult) error {
+			matched, modified, e := bulk.col.update(selector, update, upsert)
+			if e == ErrNotFound {
+				return nil
+			}
+			if matched {
+				result.Matched++
+			}
+			if modified {
+				result.Modified++
+			}
+			return e
+		})
+	}
+}
+
+func (bulk *memoryBulk) Run() (*BulkResult, error) {
+	bulk.col.mutex.Lock()
+	defer bulk.col.mutex.Unlock()
+	var result BulkResult
+	var failed error
+	for _, op := range bulk.ops {
+		// Unordered, so failures do not stop the remaining writes
+		if e := op(&result); e != nil && failed == nil {
+			failed = e
+		}
+	}
+	if failed != nil {
+		return nil, failed
+	}
+	return &result, nil
+}
+
+type memoryPipe struct {
+	col      *Memory
+	pipeline []bson.M
+}
+
+func (pipe *memoryPipe) All(result interface{}) error {
+	if len(pipe.pipeline) != 1 || pipe.pipeline[0]["$group"] == nil {
+		return errors.New("unsupported pipeline")
+	}
+	stage, ok := pipe.pipeline[0]["$group"].(bson.M)
+	if !ok {
+		return errors.New("unsupported $group stage")
+	}
+	docs, e := pipe.col.find(nil, nil)
+	if e != nil {
+		return e
+	}
+
+	groups := make(map[string]bson.M)
+	var order []string
+	for _, doc := range docs {
+		id := evaluate(doc, stage["_id"])
+		key := string(mustMarshal(bson.M{"k": id}))
+		group, ok := groups[key]
+		if !ok {
+			group = bson.M{"_id": id}
+			groups[key] = group
+			order = append(order, key)
+		}
+		for field, spec := range stage {
+			if field == "_id" {
+				continue
+			}
+			acc, ok := spec.(bson.M)
+			if !ok || len(acc) != 1 {
+				return errors.New("unsupported accumulator for " + field)
+			}
+			for op, expr := range acc {
+				v := evaluate(doc, expr)
+				current, exists := group[field]
+				switch op {
+				case "$max":
+					if !exists || compare(v, current) > 0 {
+						group[field] = v
+					}
+				case "$min":
+					if !exists || compare(v, current) < 0 {
+						group[field] = v
+					}
+				case "$sum":
+					sum, _ := number(current)
+					n, _ := number(v)
+					group[field] = sum + n
+				default:
+					return errors.New("unsupported accumulator " + op)
+				}
+			}
+		}
+	}
+	sort.Strings(order)
+	out := make([]bson.M, 0, len(order))
+	for _, key := range order {
+		out = append(out, groups[key])
+	}
+	return unmarshalAll(out, result)
+}
+
+// evaluate - value of a $field path or a document of paths
+func evaluate(doc bson.M, expr interface{}) interface{} {
+	switch x := expr.(type) {
+	case string:
+		if strings.HasPrefix(x, "$") {
+			return doc[x[1:]]
+		}
+		return x
+	case bson.M:
+		m := bson.M{}
+		for k, v := range x {
+			m[k] = evaluate(doc, v)
+		}
+		return m
+	}
+	return expr
+}
+
+// matches - the document satisfies all conditions of the normalized query
+func matches(doc bson.M, query bson.M) bool {
+	for k, cond := range query {
+		if k == "$or" {
+			if !matchesAny(doc, cond) {
+				return false
+			}
+			continue
+		}
+		v, exists := doc[k]
+		ops, ok := cond.(bson.M)
+		if !ok || !isOperator(ops) {
+			if !equal(v, cond) {
+				return false
+			}
+			continue
+		}
+		for op, arg := range ops {
+			switch op {
+			case "$in":
+				found := false
+				for _, a := range arg.([]interface{}) {
+					if equal(v, a) {
+						found = true
+						break
+					}
+				}
+				if !found {
+					return false
+				}
+			case "$exists":
+				if exists != arg.(bool) {
+					return false
+				}
+			case "$ne":
+				if equal(v, arg) {
+					return false
+				}
+			case "$lt":
+				if v == nil || compare(v, arg) >= 0 {
+					return false
+				}
+			case "$lte":
+				if v == nil || compare(v, arg) > 0 {
+					return false
+				}
+			case "$gt":
+				if v == nil || compare(v, arg) <= 0 {
+					return false
+				}
+			case "$gte":
+				if v == nil || compare(v, arg) < 0 {
+					return false
+				}
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchesAny - the document satisfies one of the queries of an $or
+func matchesAny(doc bson.M, queries interface{}) bool {
+	list, _ := queries.([]interface{})
+	for _, query := range list {
+		if m, ok := query.(bson.M); ok && matches(doc, m) {
+			return true
+		}
+	}
+	return false
+}
+
+func isOperator(m bson.M) bool {
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return len(m) > 0
+}
+
+func equal(a interface{}, b interface{}) bool {
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		return ok && x == y
+	}
+	if x, ok := a.(time.Time); ok {
+		y, ok := b.(time.Time)
+		return ok && x.Equal(y)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// compare - order numbers, times, ids and strings, missing values first as in MongoDB
+func compare(a interface{}, b interface{}) int {
+	if a == nil || b == nil {
+		switch {
+		case a != nil:
+			return 1
+		case b != nil:
+			return -1
+		}
+		return 0
+	}
+	if x, ok := a.(bson.ObjectId); ok {
+		y, _ := b.(bson.ObjectId)
+		return strings.Compare(string(x), string(y))
+	}
+	if x, ok := number(a); ok {
+		y, _ := number(b)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	if x, ok := a.(time.Time); ok {
+		y, _ := b.(time.Time)
+		switch {
+		case x.Before(y):
+			return -1
+		case x.After(y):
+			return 1
+		}
+		return 0
+	}
+	x, _ := a.(string)
+	y, _ := b.(string)
+	return strings.Compare(x, y)
+}
+
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// normalize - round trip a query through bson so values have the types of stored documents
+func normalize(query bson.M) (bson.M, error) {
+	if query == nil {
+		return bson.M{}, nil
+	}
+	return toM(query)
+}
+
+func toM(doc interface{}) (m bson.M, e error) {
+	data, e := bson.Marshal(doc)
+	if e != nil {
+		return
+	}
+	e = bson.Unmarshal(data, &m)
+	return
+}
+
+func mustMarshal(doc interface{}) []byte {
+	data, e := bson.Marshal(doc)
+	if e != nil {
+		panic(e)
+	}
+	return data
+}
+
+func unmarshal(doc bson.M, result interface{}) error {
+	data, e := bson.Marshal(doc)
+	if e != nil {
+		return e
+	}
+	return bson.Unmarshal(data, result)
+}
+
+// unmarshalAll - unmarshal documents into a pointer to slice
+func unmarshalAll(docs []bson.M, result interface{}) error {
+	slice := reflect.ValueOf(result)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return errors.New("result must be a pointer to slice")
+	}
+	elems := reflect.MakeSlice(slice.Elem().Type(), 0, len(docs))
+	for _, doc := range docs {
+		elem := reflect.New(slice.Elem().Type().Elem())
+		if e := unmarshal(doc, elem.Interface()); e != nil {
+			return e
+		}
+		elems = reflect.Append(elems, elem.Elem())
+	}
+	slice.Elem().Set(elems)
+	return nil
+}
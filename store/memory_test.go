@@ -0,0 +1,149 @@
+package store
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type doc struct {
+	Name  string
+	Kind  string
+	Value int
+}
+
+func newDocs(t *testing.T) *Memory {
+	col := NewMemory()
+	err := col.Insert(&doc{"a", "x", 1}, &doc{"b", "x", 2}, &doc{"c", "y", 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return col
+}
+
+func TestMemoryFind(t *testing.T) {
+	tests := []struct {
+		name  string
+		query bson.M
+		count int
+	}{
+		{"all", nil, 3},
+		{"equal", bson.M{"kind": "x"}, 2},
+		{"missing field", bson.M{"other": ""}, 0},
+		{"in", bson.M{"name": bson.M{"$in": []string{"a", "c", "d"}}}, 2},
+		{"ne", bson.M{"kind": bson.M{"$ne": "x"}}, 1},
+		{"range", bson.M{"value": bson.M{"$gt": 1, "$lte": 3}}, 2},
+		{"lt", bson.M{"value": bson.M{"$lt": 2}}, 1},
+		{"gte and equal", bson.M{"value": bson.M{"$gte": 2}, "kind": "x"}, 1},
+		{"exists", bson.M{"value": bson.M{"$exists": true}}, 3},
+		{"not exists", bson.M{"other": bson.M{"$exists": false}}, 3},
+		{"or", bson.M{"$or": []bson.M{{"name": "a"}, {"value": bson.M{"$gt": 2}}}}, 2},
+		{"or and equal", bson.M{"kind": "x", "$or": []bson.M{{"other": bson.M{"$exists": false}}, {"other": 1}}}, 2},
+	}
+	col := newDocs(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if count, err := col.Find(test.query).Count(); err != nil || count != test.count {
+				t.Errorf("got %d, %v, want %d", count, err, test.count)
+			}
+		})
+	}
+}
+
+func TestMemoryUpdateAndRemove(t *testing.T) {
+	col := newDocs(t)
+	if err := col.Update(bson.M{"name": "a"}, bson.M{"$set": bson.M{"value": 10}}); err != nil {
+		t.Fatal(err)
+	}
+	var a doc
+	if err := col.Find(bson.M{"name": "a"}).One(&a); err != nil || a.Value != 10 || a.Kind != "x" {
+		t.Errorf("got %+v, %v", a, err)
+	}
+	if err := col.Update(bson.M{"name": "z"}, bson.M{"$set": bson.M{"value": 1}}); err != ErrNotFound {
+		t.Errorf("update of missing document got %v", err)
+	}
+	if err := col.Remove(bson.M{"name": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := col.RemoveAll(bson.M{"kind": bson.M{"$in": []string{"x", "y"}}}); err != nil || removed != 2 {
+		t.Errorf("removed %d, %v", removed, err)
+	}
+	if err := col.Find(nil).One(&a); err != ErrNotFound {
+		t.Errorf("got %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestMemoryUniqueIndex(t *testing.T) {
+	col := newDocs(t)
+	if err := col.EnsureIndex([]string{"kind", "value"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := col.Insert(&doc{"d", "x", 1}); !IsDup(err) {
+		t.Errorf("got %v, want duplicate key error", err)
+	}
+	if err := col.Insert(&doc{"d", "y", 1}); err != nil {
+		t.Error(err)
+	}
+
+	bulk := col.Bulk()
+	bulk.Insert(&doc{"e", "x", 2}, &doc{"f", "z", 1})
+	bulk.Upsert(bson.M{"name": "g"}, bson.M{"$set": bson.M{"kind": "z", "value": 2}})
+	bulk.Update(bson.M{"name": "c"}, bson.M{"$set": bson.M{"value": 4}})
+	result, err := bulk.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := BulkResult{Matched: 1, Modified: 1, Duplicates: 1}
+	if *result != want {
+		t.Errorf("got %+v, want %+v", *result, want)
+	}
+	if count, _ := col.Find(nil).Count(); count != 6 {
+		t.Errorf("got %d documents, want 6", count)
+	}
+}
+
+func TestMemoryPipe(t *testing.T) {
+	col := newDocs(t)
+	var result []struct {
+		ID    string `bson:"_id"`
+		Max   int
+		Total int
+	}
+	err := col.Pipe([]bson.M{{"$group": bson.M{"_id": "$kind", "max": bson.M{"$max": "$value"}, "total": bson.M{"$sum": "$value"}}}}).All(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string][2]int)
+	for _, r := range result {
+		got[r.ID] = [2]int{r.Max, r.Total}
+	}
+	if len(got) != 2 || got["x"] != [2]int{2, 3} || got["y"] != [2]int{3, 3} {
+		t.Errorf("unexpected groups %+v", result)
+	}
+}
+
+func TestMemorySort(t *testing.T) {
+	col := newDocs(t)
+	col.Insert(&doc{"d", "x", 0})
+	tests := []struct {
+		fields []string
+		want   string
+	}{
+		{[]string{"value"}, "dabc"},
+		{[]string{"-value"}, "cbad"},
+		{[]string{"kind", "-name"}, "dbac"},
+	}
+	for _, test := range tests {
+		var docs []doc
+		if err := col.Find(nil).Sort(test.fields...).All(&docs); err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		for _, d := range docs {
+			got += d.Name
+		}
+		if got != test.want {
+			t.Errorf("sort %v: got %s, want %s", test.fields, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package store
+
+import (
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Mongo - collection in MongoDB
+type Mongo struct {
+	C *mgo.Collection
+}
+
+// NewMongo - wrap a MongoDB collection
+func NewMongo(col *mgo.Collection) *Mongo {
+	return &Mongo{C: col}
+}
+
+// Find - query documents
+func (col *Mongo) Find(query bson.M) Query {
+	return mongoQuery{col.C.Find(query)}
+}
+
+// Insert - insert documents
+func (col *Mongo) Insert(docs ...interface{}) error {
+	return col.C.Insert(docs...)
+}
+
+// Update - update the first document matching the selector
+func (col *Mongo) Update(selector bson.M, update bson.M) error {
+	return col.C.Update(selector, update)
+}
+
+// Remove - remove the first document matching the selector
+func (col *Mongo) Remove(selector bson.M) error {
+	return col.C.Remove(selector)
+}
+
+// RemoveAll - remove all documents matching the selector
+func (col *Mongo) RemoveAll(selector bson.M) (removed int, e error) {
+	info, e := col.C.RemoveAll(selector)
+	if info != nil {
+		removed = info.Removed
+	}
+	return
+}
+
+// EnsureIndex - create an index on the keys if it does not exist
+func (col *Mongo) EnsureIndex(keys []string, unique bool) error {
+	return col.C.EnsureIndex(mgo.Index{Key: keys, Unique: unique, Background: true})
+}
+
+// Bulk - start an unordered bulk write
+func (col *Mongo) Bulk() Bulk {
+	bulk := col.C.Bulk()
+	bulk.Unordered()
+	return mongoBulk{bulk}
+}
+
+// Refresh - reset the connections of the session after a transient error
+func (col *Mongo) Refresh() {
+	col.C.Database.Session.Refresh()
+}
+
+// Pipe - run an aggregation pipeline
+func (col *Mongo) Pipe(pipeline []bson.M) Pipe {
+	return col.C.Pipe(pipeline)
+}
+
+type mongoQuery struct {
+	q *mgo.Query
+}
+
+func (query mongoQuery) All(result interface{}) error {
+	return query.q.All(result)
+}
+
+func (query mongoQuery) One(result interface{}) error {
+	return query.q.One(result)
+}
+
+func (query mongoQuery) Count() (int, error) {
+	return query.q.Count()
+}
+
+func (query mongoQuery) Select(fields bson.M) Query {
+	return mongoQuery{query.q.Select(fields)}
+}
+
+func (query mongoQuery) Sort(fields ...string) Query {
+	return mongoQuery{query.q.Sort(fields...)}
+}
+
+func (query mongoQuery) Iter() Iter {
+	return query.q.Iter()
+}
+
+type mongoBulk struct {
+	b *mgo.Bulk
+}
+
+func (bulk mongoBulk) Insert(docs ...interface{}) {
+	bulk.b.Insert(docs...)
+}
+
+func (bulk mongoBulk) Update(pairs ...interface{}) {
+	bulk.b.Update(pairs...)
+}
+
+func (bulk mongoBulk) Upsert(pairs ...interface{}) {
+	bulk.b.Upsert(pairs...)
+}
+
+// Run - run the writes, inserts rejected by a unique index are counted instead of failing
+func (bulk mongoBulk) Run() (*BulkResult, error) {
+	r, e := bulk.b.Run()
+	if e != nil {
+		berr, ok := e.(*mgo.BulkError)
+		if !ok || !mgo.IsDup(berr) {
+			return nil, e
+		}
+		return &BulkResult{Duplicates: len(berr.Cases())}, nil
+	}
+	return &BulkResult{Matched: r.Matched, Modified: r.Modified}, nil
+}
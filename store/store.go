@@ -0,0 +1,126 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrNotFound - no document matches the query
+var ErrNotFound = mgo.ErrNotFound
+
+// ErrDuplicate - a document violates a unique index
+var ErrDuplicate = errors.New("duplicate key")
+
+// Collection - document collection used by the model
+type Collection interface {
+	Find(query bson.M) Query
+	Insert(docs ...interface{}) error
+	// Update - update the first document matching the selector
+	Update(selector bson.M, update bson.M) error
+	// Remove - remove the first document matching the selector
+	Remove(selector bson.M) error
+	// RemoveAll - remove all documents matching the selector
+	RemoveAll(selector bson.M) (removed int, e error)
+	// EnsureIndex - create an index on the keys if it does not exist
+	EnsureIndex(keys []string, unique bool) error
+	Bulk() Bulk
+	Pipe(pipeline []bson.M) Pipe
+}
+
+// Query - query of a collection
+type Query interface {
+	All(result interface{}) error
+	One(result interface{}) error
+	Count() (int, error)
+	Select(fields bson.M) Query
+	// Sort - order results by the fields, descending if prefixed with -
+	Sort(fields ...string) Query
+	Iter() Iter
+}
+
+// Iter - iterator over query results
+type Iter interface {
+	Next(result interface{}) bool
+	Close() error
+}
+
+// Pipe - aggregation pipeline
+type Pipe interface {
+	All(result interface{}) error
+}
+
+// Bulk - unordered batch of write operations
+type Bulk interface {
+	Insert(docs ...interface{})
+	// Update - pairs of selector and update
+	Update(pairs ...interface{})
+	// Upsert - pairs of selector and update, inserting if no document matches
+	Upsert(pairs ...interface{})
+	Run() (*BulkResult, error)
+}
+
+// BulkResult - outcome of a bulk write
+type BulkResult struct {
+	Matched  int
+	Modified int
+	// Duplicates - inserts rejected by a unique index
+	Duplicates int
+}
+
+// IsDup - the error is caused by a unique index
+func IsDup(e error) bool {
+	return e == ErrDuplicate || mgo.IsDup(e)
+}
+
+// Refresher - collection whose connection can be reset after a transient error
+type Refresher interface {
+	Refresh()
+}
+
+// transientCodes - server error codes of failovers, shutdowns and timeouts
+var transientCodes = map[int]bool{6: true, 7: true, 89: true, 91: true, 189: true, 10107: true, 11600: true, 11602: true, 13435: true, 13436: true}
+
+// transientMessages - driver errors of lost or unavailable connections
+var transientMessages = []string{"no reachable servers", "connection reset", "broken pipe", "not master", "i/o timeout", "Closed explicitly"}
+
+// IsTransient - the error is caused by a lost connection or a failover, so the write may succeed if retried
+func IsTransient(e error) bool {
+	if e == nil {
+		return false
+	}
+	if e == io.EOF || e == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := e.(net.Error); ok {
+		return true
+	}
+	switch err := e.(type) {
+	case *mgo.LastError:
+		if transientCodes[err.Code] {
+			return true
+		}
+	case *mgo.QueryError:
+		if transientCodes[err.Code] {
+			return true
+		}
+	case *mgo.BulkError:
+		for _, c := range err.Cases() {
+			if !IsDup(c.Err) && !IsTransient(c.Err) {
+				return false
+			}
+		}
+		return true
+	}
+	message := e.Error()
+	for _, m := range transientMessages {
+		if strings.Contains(message, m) {
+			return true
+		}
+	}
+	return false
+}
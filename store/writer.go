@@ -0,0 +1,153 @@
+package store
+
+import (
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"../logger"
+)
+
+// DefaultWriteBatchSize - documents per bulk write when none is configured
+const DefaultWriteBatchSize = 1000
+
+// WriteConfig - bulk write settings
+type WriteConfig struct {
+	// BatchSize - documents per bulk write, DefaultWriteBatchSize if 0
+	BatchSize int
+	// Retries - retries of a bulk write failing with a transient error
+	Retries int
+	// RetryInterval - wait before the first retry, doubled for each next one
+	RetryInterval time.Duration
+	// Stats - metrics shared by writers, optional
+	Stats *WriteStats
+}
+
+// WriteStats - throughput metrics of bulk writes, safe for concurrent use
+type WriteStats struct {
+	docs     int64
+	batches  int64
+	retries  int64
+	failures int64
+	nanos    int64
+}
+
+// WriteSnapshot - values of the write metrics at a point in time
+type WriteSnapshot struct {
+	Docs     int64
+	Batches  int64
+	Retries  int64
+	Failures int64
+	Elapsed  time.Duration
+}
+
+// Snapshot - get the metrics and reset them
+func (stats *WriteStats) Snapshot() (s WriteSnapshot) {
+	s.Docs = atomic.SwapInt64(&stats.docs, 0)
+	s.Batches = atomic.SwapInt64(&stats.batches, 0)
+	s.Retries = atomic.SwapInt64(&stats.retries, 0)
+	s.Failures = atomic.SwapInt64(&stats.failures, 0)
+	s.Elapsed = time.Duration(atomic.SwapInt64(&stats.nanos, 0))
+	return
+}
+
+// DocsPerSecond - write throughput while writing
+func (s WriteSnapshot) DocsPerSecond() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Docs) / s.Elapsed.Seconds()
+}
+
+// Document - document with an _id field which a writer sets
+type Document interface {
+	SetID(id bson.ObjectId)
+}
+
+// Writer - buffer inserts into unordered bulk writes, retrying transient errors
+//
+// Documents get an _id before the first attempt, so a retried write skips the documents a failed attempt
+// already inserted as duplicates instead of inserting them twice.
+type Writer struct {
+	col     Collection
+	config  WriteConfig
+	pending []interface{}
+}
+
+// NewWriter - create a writer to a collection
+func NewWriter(col Collection, config WriteConfig) *Writer {
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultWriteBatchSize
+	}
+	return &Writer{col: col, config: config}
+}
+
+// Insert - add documents to the pending bulk write, writing it once it is full
+//
+// A Document gets a new _id on each insert and is kept as is until written, so it must not change before the next Flush
+func (w *Writer) Insert(docs ...interface{}) error {
+	for _, doc := range docs {
+		switch d := doc.(type) {
+		case Document:
+			// Each insert is a new document, even of a record read from a store, e.g. a reversal
+			d.SetID(bson.NewObjectId())
+		case bson.M:
+			if _, ok := d["_id"]; !ok {
+				d["_id"] = bson.NewObjectId()
+			}
+		default:
+			m, e := toM(doc)
+			if e != nil {
+				return e
+			}
+			if _, ok := m["_id"]; !ok {
+				m["_id"] = bson.NewObjectId()
+			}
+			doc = m
+		}
+		w.pending = append(w.pending, doc)
+		if len(w.pending) >= w.config.BatchSize {
+			if e := w.Flush(); e != nil {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// Flush - write the pending documents
+func (w *Writer) Flush() (e error) {
+	if len(w.pending) == 0 {
+		return
+	}
+	start := time.Now()
+	wait := w.config.RetryInterval
+	for attempt := 0; ; attempt++ {
+		bulk := w.col.Bulk()
+		bulk.Insert(w.pending...)
+		if _, e = bulk.Run(); e == nil || attempt >= w.config.Retries || !IsTransient(e) {
+			break
+		}
+		logger.Warn("Retrying bulk write", logger.KeyCount, len(w.pending), "attempt", attempt+1, logger.KeyError, e)
+		if stats := w.config.Stats; stats != nil {
+			atomic.AddInt64(&stats.retries, 1)
+		}
+		time.Sleep(wait)
+		wait *= 2
+		if r, ok := w.col.(Refresher); ok {
+			r.Refresh()
+		}
+	}
+	if stats := w.config.Stats; stats != nil {
+		if e == nil {
+			atomic.AddInt64(&stats.docs, int64(len(w.pending)))
+			atomic.AddInt64(&stats.batches, 1)
+		} else {
+			atomic.AddInt64(&stats.failures, 1)
+		}
+		atomic.AddInt64(&stats.nanos, int64(time.Since(start)))
+	}
+	w.pending = w.pending[:0]
+	return
+}
@@ -0,0 +1,168 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// flaky - collection whose bulk writes apply half their inserts then fail until failures is 0
+type flaky struct {
+	*Memory
+	failures  int
+	refreshes int
+}
+
+func (col *flaky) Bulk() Bulk {
+	return &flakyBulk{col: col}
+}
+
+func (col *flaky) Refresh() {
+	col.refreshes++
+}
+
+type flakyBulk struct {
+	col  *flaky
+	docs []interface{}
+}
+
+func (bulk *flakyBulk) Insert(docs ...interface{}) {
+	bulk.docs = append(bulk.docs, docs...)
+}
+
+func (bulk *flakyBulk) Update(pairs ...interface{}) {}
+
+func (bulk *flakyBulk) Upsert(pairs ...interface{}) {}
+
+func (bulk *flakyBulk) Run() (*BulkResult, error) {
+	inner := bulk.col.Memory.Bulk()
+	if bulk.col.failures > 0 {
+		bulk.col.failures--
+		inner.Insert(bulk.docs[:len(bulk.docs)/2]...)
+		inner.Run()
+		return nil, io.ErrUnexpectedEOF
+	}
+	inner.Insert(bulk.docs...)
+	return inner.Run()
+}
+
+func insertDocs(w *Writer, n int) error {
+	for i := 0; i < n; i++ {
+		if e := w.Insert(&doc{Name: string(rune('a' + i)), Value: i}); e != nil {
+			return e
+		}
+	}
+	return w.Flush()
+}
+
+func TestWriterBatches(t *testing.T) {
+	col := NewMemory()
+	stats := &WriteStats{}
+	w := NewWriter(col, WriteConfig{BatchSize: 3, Stats: stats})
+	if e := insertDocs(w, 7); e != nil {
+		t.Fatal(e)
+	}
+	if e := w.Flush(); e != nil {
+		t.Fatal(e)
+	}
+	if n := len(col.Docs()); n != 7 {
+		t.Errorf("got %d documents, want 7", n)
+	}
+	s := stats.Snapshot()
+	if s.Docs != 7 || s.Batches != 3 || s.Retries != 0 {
+		t.Errorf("got %+v", s)
+	}
+	if s = stats.Snapshot(); s.Docs != 0 {
+		t.Errorf("snapshot did not reset the stats: %+v", s)
+	}
+}
+
+func TestWriterRetriesTransientErrors(t *testing.T) {
+	col := &flaky{Memory: NewMemory(), failures: 2}
+	stats := &WriteStats{}
+	w := NewWriter(col, WriteConfig{BatchSize: 4, Retries: 2, Stats: stats})
+	if e := insertDocs(w, 4); e != nil {
+		t.Fatal(e)
+	}
+	// The documents written by the failed attempts are not written again
+	if n := len(col.Docs()); n != 4 {
+		t.Errorf("got %d documents, want 4", n)
+	}
+	if s := stats.Snapshot(); s.Docs != 4 || s.Retries != 2 || col.refreshes != 2 {
+		t.Errorf("got %+v and %d refreshes", s, col.refreshes)
+	}
+
+	col.failures = 3
+	w = NewWriter(col, WriteConfig{BatchSize: 4, Retries: 2, Stats: stats})
+	if e := insertDocs(w, 4); e != io.ErrUnexpectedEOF {
+		t.Errorf("got %v, want %v", e, io.ErrUnexpectedEOF)
+	}
+	if s := stats.Snapshot(); s.Failures != 1 {
+		t.Errorf("got %+v", s)
+	}
+}
+
+// idDoc - document whose _id the writer sets
+type idDoc struct {
+	ID   bson.ObjectId `bson:"_id,omitempty"`
+	Name string
+}
+
+func (d *idDoc) SetID(id bson.ObjectId) {
+	d.ID = id
+}
+
+func TestWriterSetsDocumentID(t *testing.T) {
+	col := &flaky{Memory: NewMemory(), failures: 1}
+	w := NewWriter(col, WriteConfig{BatchSize: 4, Retries: 1})
+	first := &idDoc{Name: "a"}
+	if e := w.Insert(first); e != nil {
+		t.Fatal(e)
+	}
+	// A document read back from a store is inserted as a new one
+	again := *first
+	if e := w.Insert(&again, &idDoc{Name: "b"}, &idDoc{Name: "c"}); e != nil {
+		t.Fatal(e)
+	}
+	if e := w.Flush(); e != nil {
+		t.Fatal(e)
+	}
+	if !first.ID.Valid() || again.ID == first.ID {
+		t.Errorf("got ids %q and %q", first.ID, again.ID)
+	}
+	// The ids set before the failed attempt skip the documents it wrote
+	var docs []idDoc
+	if e := col.Find(nil).All(&docs); e != nil {
+		t.Fatal(e)
+	}
+	if len(docs) != 4 {
+		t.Errorf("got %d documents, want 4", len(docs))
+	}
+	for _, d := range docs {
+		if !d.ID.Valid() {
+			t.Errorf("%s: got id %q", d.Name, d.ID)
+		}
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err       error
+		transient bool
+	}{
+		{nil, false},
+		{io.EOF, true},
+		{errors.New("no reachable servers"), true},
+		{errors.New("write tcp: broken pipe"), true},
+		{ErrDuplicate, false},
+		{ErrNotFound, false},
+		{errors.New("invalid document"), false},
+	}
+	for _, test := range tests {
+		if got := IsTransient(test.err); got != test.transient {
+			t.Errorf("%v: got %v, want %v", test.err, got, test.transient)
+		}
+	}
+}